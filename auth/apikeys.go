@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Scopes that can be granted to an API key
+const (
+	ScopeReadProfile   = "read:profile"
+	ScopeReadBookings  = "read:bookings"
+	ScopeWriteBookings = "write:bookings"
+	ScopeReadInvoices  = "read:invoices"
+)
+
+// APIKeyPrefix starts every API key so it can be told apart from a JWT
+const APIKeyPrefix = "ecs_"
+
+// ErrAPIKeyNotAllowed is returned when an API key is used where only user
+// sessions are accepted
+var ErrAPIKeyNotAllowed = errors.New("API keys are not accepted here")
+
+// ValidScope reports whether scope is one of the known scopes
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeReadProfile, ScopeReadBookings, ScopeWriteBookings, ScopeReadInvoices:
+		return true
+	}
+	return false
+}
+
+// HasScope reports whether the user may act within scope. Users signed in
+// with a session token are not limited by scopes.
+func (u User) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKey reports whether a bearer token looks like an API key
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// GenerateAPIKey returns a new key together with the lookup prefix and hash to
+// store. The key itself is only ever shown to the user once.
+func GenerateAPIKey() (key, prefix, hash string, err error) {
+	buf := make([]byte, 38)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", "", err
+	}
+	prefix = hex.EncodeToString(buf[:6])
+	key = APIKeyPrefix + prefix + "_" + hex.EncodeToString(buf[6:])
+	return key, prefix, HashAPIKey(key), nil
+}
+
+// HashAPIKey hashes a key for storage. Keys carry 256 bits of randomness, so a
+// fast hash is sufficient.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyResolver looks up the user an API key belongs to
+type APIKeyResolver interface {
+	ResolveAPIKey(key string) (User, error)
+}
+
+// APIKeyStore resolves API keys from the shared api_keys table
+type APIKeyStore struct {
+	DB *sql.DB
+}
+
+// NewAPIKeyStore returns an APIKeyStore backed by db
+func NewAPIKeyStore(db *sql.DB) *APIKeyStore {
+	return &APIKeyStore{DB: db}
+}
+
+// ResolveAPIKey returns the owner of an active key, limited to the key's
+// scopes, and records when the key was last used
+func (s *APIKeyStore) ResolveAPIKey(key string) (User, error) {
+	rest, ok := strings.CutPrefix(key, APIKeyPrefix)
+	prefix, _, ok2 := strings.Cut(rest, "_")
+	if !ok || !ok2 {
+		return User{}, errors.New("malformed API key")
+	}
+
+	var keyID int
+	var keyHash, scopes string
+	var active, disabled bool
+	var user User
+	err := s.DB.QueryRow(`
+		SELECT k.key_id, k.key_hash, k.scopes, k.revoked_at IS NULL AND (k.expires_at IS NULL OR k.expires_at > NOW()),
+			u.user_id, u.email, u.membership_tier, u.disabled
+		FROM api_keys k
+		JOIN users u ON u.user_id = k.user_id
+		WHERE k.key_prefix = ?`, prefix).
+		Scan(&keyID, &keyHash, &scopes, &active, &user.ID, &user.Email, &user.Tier, &disabled)
+	if err != nil {
+		return User{}, errors.New("unknown API key")
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(HashAPIKey(key))) != 1 {
+		return User{}, errors.New("unknown API key")
+	}
+	if !active || disabled {
+		return User{}, errors.New("API key is revoked or expired")
+	}
+
+	rows, err := s.DB.Query(`SELECT role FROM user_roles WHERE user_id = ?`, user.ID)
+	if err != nil {
+		return User{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return User{}, err
+		}
+		// Keys never carry admin rights, which require a 2FA session
+		if role != RoleAdmin {
+			user.Roles = append(user.Roles, role)
+		}
+	}
+	if len(user.Roles) == 0 {
+		user.Roles = []string{RoleCustomer}
+	}
+
+	user.Scopes = strings.Split(scopes, ",")
+	user.APIKeyID = keyID
+
+	// Only touch the row once a minute so busy scripts do not hammer it
+	s.DB.Exec(`UPDATE api_keys SET last_used_at = NOW() WHERE key_id = ? AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL 1 MINUTE)`, keyID)
+	return user, nil
+}
+
+// RequireScope rejects API key requests whose key lacks scope. It must run
+// after Middleware of an Authenticator that accepts API keys.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := UserFromContext(r.Context())
+			if !ok {
+				Unauthorized(w, "Missing authorization token")
+				return
+			}
+			if !user.HasScope(scope) {
+				Forbidden(w, "API key is missing the "+scope+" scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// ImpersonationAuditor persists requests made by an admin acting as a user
+type ImpersonationAuditor interface {
+	RecordImpersonation(user User, r *http.Request) error
+}
+
+// AuditStore writes impersonated requests to the shared audit_log table
+type AuditStore struct {
+	DB *sql.DB
+}
+
+// NewAuditStore returns an AuditStore backed by db
+func NewAuditStore(db *sql.DB) *AuditStore {
+	return &AuditStore{DB: db}
+}
+
+// RecordImpersonation adds an audit entry for the request. Only the method
+// and path are kept; query strings and bodies may hold secrets.
+func (s *AuditStore) RecordImpersonation(user User, r *http.Request) error {
+	details := "method=" + r.Method + " path=" + r.URL.Path
+	if len(details) > 255 {
+		details = details[:255]
+	}
+	_, err := s.DB.Exec(`INSERT INTO audit_log (actor_id, action, target_user_id, details) VALUES (?, 'impersonated_request', ?, ?)`,
+		user.ImpersonatorID, user.ID, details)
+	return err
+}
@@ -0,0 +1,324 @@
+// Package auth provides JWT issuing, validation and HTTP middleware shared by
+// the user, vehicle and billing services.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// TokenTTL is how long an issued token stays valid
+const TokenTTL = 24 * time.Hour
+
+// ErrMissingToken is returned when a request carries no bearer token
+var ErrMissingToken = errors.New("missing bearer token")
+
+// User is the authenticated identity carried in a token
+type User struct {
+	ID    int      `json:"user_id"`
+	Email string   `json:"email"`
+	Tier  string   `json:"membership_tier"`
+	Roles []string `json:"roles"`
+	// ImpersonatorID is the admin acting as this user, or zero
+	ImpersonatorID int `json:"impersonator_id,omitempty"`
+	// Scopes limits requests made with an API key; nil for session tokens
+	Scopes []string `json:"scopes,omitempty"`
+	// APIKeyID is the API key used for the request, or zero
+	APIKeyID int `json:"api_key_id,omitempty"`
+	// TokenVersion is the user's token version when their token was issued
+	TokenVersion int `json:"-"`
+}
+
+// HasRole reports whether the user holds the given role
+func (u User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims structure for JWT
+type Claims struct {
+	UserID int      `json:"user_id"`
+	Email  string   `json:"email"`
+	Tier   string   `json:"membership_tier"`
+	Roles  []string `json:"roles"`
+	// ImpersonatorID is set on tokens issued to an admin acting as the user
+	ImpersonatorID int `json:"impersonator_id,omitempty"`
+	// TokenVersion must match the user's current token version; bumping it
+	// revokes every token issued before
+	TokenVersion int `json:"token_version"`
+	// Purpose marks single-use tokens (such as a pending 2FA login) that must
+	// not be accepted as an access token
+	Purpose string `json:"purpose,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// User returns the identity described by the claims
+func (c *Claims) User() User {
+	return User{ID: c.UserID, Email: c.Email, Tier: c.Tier, Roles: c.Roles, ImpersonatorID: c.ImpersonatorID, TokenVersion: c.TokenVersion}
+}
+
+// GenerateToken signs a token for the given user valid for TokenTTL
+func GenerateToken(key []byte, user User) (string, error) {
+	return GenerateTokenWithTTL(key, user, TokenTTL)
+}
+
+// GenerateTokenWithTTL signs a token for the given user valid for ttl
+func GenerateTokenWithTTL(key []byte, user User, ttl time.Duration) (string, error) {
+	claims := &Claims{
+		UserID:         user.ID,
+		Email:          user.Email,
+		Tier:           user.Tier,
+		Roles:          user.Roles,
+		ImpersonatorID: user.ImpersonatorID,
+		TokenVersion:   user.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(key)
+}
+
+// GeneratePurposeToken signs a restricted token that is only accepted by
+// ValidatePurposeToken with the same purpose
+func GeneratePurposeToken(key []byte, user User, purpose string, ttl time.Duration) (string, error) {
+	claims := &Claims{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(key)
+}
+
+// ValidatePurposeToken parses a token issued by GeneratePurposeToken
+func ValidatePurposeToken(key []byte, tokenString, purpose string) (*Claims, error) {
+	claims, err := parseToken(key, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != purpose {
+		return nil, errors.New("token issued for a different purpose")
+	}
+	return claims, nil
+}
+
+// ValidateToken parses an access token and checks its signature and expiry
+func ValidateToken(key []byte, tokenString string) (*Claims, error) {
+	claims, err := parseToken(key, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, errors.New("token is not an access token")
+	}
+	return claims, nil
+}
+
+// parseToken verifies the token signature and expiry
+func parseToken(key []byte, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// BearerToken extracts the token from the Authorization header
+func BearerToken(r *http.Request) (string, error) {
+	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.TrimSpace(tokenString) == "" {
+		return "", ErrMissingToken
+	}
+	return strings.TrimSpace(tokenString), nil
+}
+
+type contextKey struct{}
+
+// WithUser returns a copy of ctx carrying the authenticated user
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, contextKey{}, user)
+}
+
+// UserFromContext returns the authenticated user stored by Middleware
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(contextKey{}).(User)
+	return user, ok
+}
+
+// Authenticator validates bearer tokens and gateway identity headers
+type Authenticator struct {
+	// JWTKey signs and verifies user tokens
+	JWTKey []byte
+	// GatewayKey verifies identity headers forwarded by the gateway; when
+	// empty, identity headers are ignored and only bearer tokens are accepted
+	GatewayKey []byte
+	// APIKeys resolves API keys; when nil, API keys are rejected
+	APIKeys APIKeyResolver
+	// Sessions checks that a token's session has not been revoked; when nil,
+	// any unexpired token is accepted
+	Sessions SessionChecker
+	// Audit persists requests made while impersonating; when nil, they are
+	// only logged
+	Audit ImpersonationAuditor
+}
+
+// New returns an Authenticator using the given keys
+func New(jwtKey, gatewayKey []byte) *Authenticator {
+	return &Authenticator{JWTKey: jwtKey, GatewayKey: gatewayKey}
+}
+
+// WithAPIKeys returns a copy of the Authenticator that also accepts API keys
+// resolved by resolver
+func (a *Authenticator) WithAPIKeys(resolver APIKeyResolver) *Authenticator {
+	withKeys := *a
+	withKeys.APIKeys = resolver
+	return &withKeys
+}
+
+// WithSessions returns a copy of the Authenticator that also rejects tokens
+// whose session checker reports them revoked
+func (a *Authenticator) WithSessions(checker SessionChecker) *Authenticator {
+	withSessions := *a
+	withSessions.Sessions = checker
+	return &withSessions
+}
+
+// WithAudit returns a copy of the Authenticator whose Middleware persists
+// every impersonated request through auditor
+func (a *Authenticator) WithAudit(auditor ImpersonationAuditor) *Authenticator {
+	withAudit := *a
+	withAudit.Audit = auditor
+	return &withAudit
+}
+
+// Authenticate resolves the user making the request, preferring signed
+// gateway identity headers and falling back to the bearer token, which may be
+// a JWT or, when enabled, an API key. The gateway checks sessions before
+// signing identity headers, so only bearer JWTs are checked here.
+func (a *Authenticator) Authenticate(r *http.Request) (User, error) {
+	if len(a.GatewayKey) > 0 {
+		user, err := IdentityFromHeaders(r.Header, a.GatewayKey)
+		if err == nil && user.Scopes != nil && a.APIKeys == nil {
+			return User{}, ErrAPIKeyNotAllowed
+		}
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, ErrNoIdentity) {
+			return User{}, err
+		}
+	}
+
+	tokenString, err := BearerToken(r)
+	if err != nil {
+		return User{}, err
+	}
+
+	if IsAPIKey(tokenString) {
+		if a.APIKeys == nil {
+			return User{}, ErrAPIKeyNotAllowed
+		}
+		return a.APIKeys.ResolveAPIKey(tokenString)
+	}
+
+	claims, err := ValidateToken(a.JWTKey, tokenString)
+	if err != nil {
+		return User{}, err
+	}
+	if a.Sessions != nil {
+		if err := a.Sessions.CheckSession(claims); err != nil {
+			return User{}, err
+		}
+	}
+	return claims.User(), nil
+}
+
+// Middleware rejects unauthenticated requests and stores the authenticated
+// user in the request context
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.Authenticate(r)
+		if errors.Is(err, ErrMissingToken) {
+			Unauthorized(w, "Missing authorization token")
+			return
+		}
+		if errors.Is(err, ErrAPIKeyNotAllowed) {
+			Forbidden(w, "API keys cannot be used for this endpoint")
+			return
+		}
+		if err != nil {
+			Unauthorized(w, "Invalid or expired token")
+			return
+		}
+		a.serveUser(w, r, user, next)
+	})
+}
+
+// OptionalMiddleware stores the authenticated user in the request context when
+// there is one and otherwise serves the request anonymously, for public
+// endpoints that show more to some users
+func (a *Authenticator) OptionalMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.Authenticate(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a.serveUser(w, r, user, next)
+	})
+}
+
+// serveUser passes the request to next as user, auditing it first when user
+// is impersonated
+func (a *Authenticator) serveUser(w http.ResponseWriter, r *http.Request, user User, next http.Handler) {
+	// Every request made while impersonating is audited, and one that
+	// cannot be recorded is refused
+	if user.ImpersonatorID != 0 {
+		log.Printf("Impersonated request: admin %d as user %d: %s %s", user.ImpersonatorID, user.ID, r.Method, r.URL.Path)
+		if a.Audit != nil {
+			if err := a.Audit.RecordImpersonation(user, r); err != nil {
+				log.Printf("Failed to audit impersonated request by admin %d: %v", user.ImpersonatorID, err)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				json.NewEncoder(w).Encode(map[string]string{"message": "Could not record impersonated request"})
+				return
+			}
+		}
+	}
+
+	next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+}
+
+// Unauthorized writes a 401 response with a JSON message
+func Unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="ecs"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
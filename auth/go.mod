@@ -0,0 +1,5 @@
+module auth
+
+go 1.23.3
+
+require github.com/golang-jwt/jwt/v4 v4.5.1 // direct
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identity headers set by the gateway for downstream services
+const (
+	HeaderUserID       = "X-User-ID"
+	HeaderUserEmail    = "X-User-Email"
+	HeaderUserTier     = "X-User-Tier"
+	HeaderUserRoles    = "X-User-Roles"
+	HeaderImpersonator = "X-User-Impersonator"
+	HeaderScopes       = "X-User-Scopes"
+	HeaderTimestamp    = "X-User-Timestamp"
+	HeaderSignature    = "X-User-Signature"
+)
+
+// MaxIdentityAge bounds how old a signed identity may be before it is rejected
+const MaxIdentityAge = 5 * time.Minute
+
+var identityHeaders = []string{
+	HeaderUserID, HeaderUserEmail, HeaderUserTier, HeaderUserRoles, HeaderImpersonator, HeaderScopes, HeaderTimestamp, HeaderSignature,
+}
+
+// ErrNoIdentity is returned when a request carries no gateway identity headers
+var ErrNoIdentity = errors.New("no identity headers")
+
+// StripIdentityHeaders removes any identity headers so clients cannot spoof them
+func StripIdentityHeaders(h http.Header) {
+	for _, name := range identityHeaders {
+		h.Del(name)
+	}
+}
+
+// SetIdentityHeaders writes the user's identity and an HMAC signature over it
+func SetIdentityHeaders(h http.Header, key []byte, user User) {
+	StripIdentityHeaders(h)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set(HeaderUserID, strconv.Itoa(user.ID))
+	h.Set(HeaderUserEmail, user.Email)
+	h.Set(HeaderUserTier, user.Tier)
+	h.Set(HeaderUserRoles, strings.Join(user.Roles, ","))
+	if user.ImpersonatorID != 0 {
+		h.Set(HeaderImpersonator, strconv.Itoa(user.ImpersonatorID))
+	}
+	// Scoped API key identities must stay scoped downstream
+	if user.Scopes != nil {
+		h.Set(HeaderScopes, strings.Join(user.Scopes, ","))
+	}
+	h.Set(HeaderTimestamp, timestamp)
+	h.Set(HeaderSignature, signIdentity(key, h))
+}
+
+// IdentityFromHeaders verifies the gateway signature and returns the user it describes
+func IdentityFromHeaders(h http.Header, key []byte) (User, error) {
+	signature := h.Get(HeaderSignature)
+	if signature == "" {
+		return User{}, ErrNoIdentity
+	}
+	if len(key) == 0 {
+		return User{}, errors.New("gateway key not configured")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(signIdentity(key, h))) {
+		return User{}, errors.New("invalid identity signature")
+	}
+
+	issued, err := strconv.ParseInt(h.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return User{}, errors.New("invalid identity timestamp")
+	}
+	age := time.Since(time.Unix(issued, 0))
+	if age > MaxIdentityAge || age < -MaxIdentityAge {
+		return User{}, errors.New("identity headers expired")
+	}
+
+	userID, err := strconv.Atoi(h.Get(HeaderUserID))
+	if err != nil {
+		return User{}, errors.New("invalid user ID header")
+	}
+
+	user := User{ID: userID, Email: h.Get(HeaderUserEmail), Tier: h.Get(HeaderUserTier)}
+	if roles := h.Get(HeaderUserRoles); roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	if impersonator := h.Get(HeaderImpersonator); impersonator != "" {
+		user.ImpersonatorID, err = strconv.Atoi(impersonator)
+		if err != nil {
+			return User{}, errors.New("invalid impersonator header")
+		}
+	}
+	if scopes := h.Get(HeaderScopes); scopes != "" {
+		user.Scopes = strings.Split(scopes, ",")
+	}
+	return user, nil
+}
+
+// signIdentity computes the HMAC over the identity header values
+func signIdentity(key []byte, h http.Header) string {
+	mac := hmac.New(sha256.New, key)
+	for _, name := range identityHeaders[:len(identityHeaders)-1] {
+		mac.Write([]byte(h.Get(name)))
+		mac.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Roles a user can hold
+const (
+	RoleCustomer      = "customer"
+	RoleFleetOperator = "fleet_operator"
+	RoleFinance       = "finance"
+	RoleAdmin         = "admin"
+)
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	switch role {
+	case RoleCustomer, RoleFleetOperator, RoleFinance, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// HasAnyRole reports whether the user holds at least one of the given roles.
+// Admins implicitly hold every role.
+func (u User) HasAnyRole(roles ...string) bool {
+	if u.HasRole(RoleAdmin) {
+		return true
+	}
+	for _, role := range roles {
+		if u.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole rejects requests whose authenticated user holds none of the
+// given roles. It must run after Middleware.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := UserFromContext(r.Context())
+			if !ok {
+				Unauthorized(w, "Missing authorization token")
+				return
+			}
+			if !user.HasAnyRole(roles...) {
+				Forbidden(w, "You do not have permission to perform this action")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Forbidden writes a 403 response with a JSON message
+func Forbidden(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ErrSessionRevoked is returned for tokens whose session has been ended, for
+// example because the account was disabled or its password changed
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+// SessionChecker decides whether the session behind a validated token is
+// still live
+type SessionChecker interface {
+	CheckSession(claims *Claims) error
+}
+
+// SessionStore checks sessions against the shared users table
+type SessionStore struct {
+	DB *sql.DB
+}
+
+// NewSessionStore returns a SessionStore backed by db
+func NewSessionStore(db *sql.DB) *SessionStore {
+	return &SessionStore{DB: db}
+}
+
+// CheckSession rejects tokens for disabled or deleted accounts and tokens
+// issued before the user's token version was last bumped. Impersonation
+// tokens also end when the admin's own account is disabled.
+func (s *SessionStore) CheckSession(claims *Claims) error {
+	var version int
+	var disabled bool
+	err := s.DB.QueryRow(`SELECT token_version, disabled FROM users WHERE user_id = ?`, claims.UserID).Scan(&version, &disabled)
+	if err == sql.ErrNoRows {
+		return ErrSessionRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if disabled || version != claims.TokenVersion {
+		return ErrSessionRevoked
+	}
+
+	if claims.ImpersonatorID != 0 {
+		err := s.DB.QueryRow(`SELECT disabled FROM users WHERE user_id = ?`, claims.ImpersonatorID).Scan(&disabled)
+		if err == sql.ErrNoRows || (err == nil && disabled) {
+			return ErrSessionRevoked
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
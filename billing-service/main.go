@@ -2,18 +2,43 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"auth"
+
+	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
+// JWT secret key
+var jwtKey []byte
+
+// Shared secret for verifying identity headers signed by the gateway
+var gatewayKey []byte
+
+// Invoice struct for a user's invoice listing
+type Invoice struct {
+	ReservationID int     `json:"reservation_id"`
+	InvoiceID     string  `json:"invoice_id"`
+	ChargeType    string  `json:"charge_type"` // "rental" or "damage"
+	Amount        float64 `json:"amount"`
+	PaymentStatus string  `json:"payment_status"`
+	CreatedAt     string  `json:"created_at"` // Use string for date
+	VehicleModel  string  `json:"vehicle_model"`
+	StartTime     string  `json:"start_time"`
+	EndTime       string  `json:"end_time"`
+}
+
 func main() {
 	// Load environment variables
 	err := godotenv.Load(".env")
@@ -22,6 +47,8 @@ func main() {
 	}
 
 	dbDSN := os.Getenv("DB_DSN")
+	jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
+	gatewayKey = []byte(os.Getenv("GATEWAY_SECRET"))
 
 	// Connect to the database
 	db, err := sql.Open("mysql", dbDSN)
@@ -33,13 +60,50 @@ func main() {
 	// Initialize router
 	r := mux.NewRouter()
 
-	// Billing endpoints
+	// Cost estimates are public
 	r.HandleFunc("/calculate-cost", func(w http.ResponseWriter, r *http.Request) { CalculateCostHandler(w, r, db) }).Methods("POST")
-	r.HandleFunc("/generate-invoice", func(w http.ResponseWriter, r *http.Request) { GenerateInvoiceHandler(w, r, db) }).Methods("POST")
-	r.HandleFunc("/invoices/{reservation_id}", func(w http.ResponseWriter, r *http.Request) { FetchInvoiceHandler(w, r, db) }).Methods("GET")
-	r.HandleFunc("/invoices/user/{user_id}", func(w http.ResponseWriter, r *http.Request) { FetchInvoicesByUserHandler(w, r, db) }).Methods("GET")
-	r.HandleFunc("/update-payment-status", func(w http.ResponseWriter, r *http.Request) { UpdatePaymentStatusHandler(w, r, db) }).Methods("PATCH")
-	r.HandleFunc("/make-payment", func(w http.ResponseWriter, r *http.Request) { MakePaymentHandler(w, r, db) }).Methods("POST")
+
+	authenticator := auth.New(jwtKey, gatewayKey).WithSessions(auth.NewSessionStore(db)).WithAudit(auth.NewAuditStore(db))
+
+	// The caller's own invoices are also available to API keys with read:invoices
+	readInvoices := r.NewRoute().Subrouter()
+	readInvoices.Use(authenticator.WithAPIKeys(auth.NewAPIKeyStore(db)).Middleware, auth.RequireScope(auth.ScopeReadInvoices))
+	readInvoices.HandleFunc("/invoices/user", func(w http.ResponseWriter, r *http.Request) { FetchInvoicesByUserHandler(w, r, db) }).Methods("GET")
+	readInvoices.HandleFunc("/invoices/{reservation_id}", func(w http.ResponseWriter, r *http.Request) { FetchInvoiceHandler(w, r, db) }).Methods("GET")
+	readInvoices.HandleFunc("/statements", func(w http.ResponseWriter, r *http.Request) { ListStatementsHandler(w, r, db) }).Methods("GET")
+	readInvoices.HandleFunc("/statements/{period:[0-9]{4}-[0-9]{2}}", func(w http.ResponseWriter, r *http.Request) { FetchStatementHandler(w, r, db) }).Methods("GET")
+
+	// Remaining billing endpoints require a valid JWT
+	protected := r.NewRoute().Subrouter()
+	protected.Use(authenticator.Middleware)
+	protected.HandleFunc("/generate-invoice", func(w http.ResponseWriter, r *http.Request) { GenerateInvoiceHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/invoices/user/{user_id}", func(w http.ResponseWriter, r *http.Request) { FetchInvoicesByUserHandler(w, r, db) }).Methods("GET")
+	protected.HandleFunc("/make-payment", func(w http.ResponseWriter, r *http.Request) { MakePaymentHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/statements/user/{user_id}", func(w http.ResponseWriter, r *http.Request) { ListStatementsHandler(w, r, db) }).Methods("GET")
+	protected.HandleFunc("/statements/user/{user_id}/{period:[0-9]{4}-[0-9]{2}}", func(w http.ResponseWriter, r *http.Request) { FetchStatementHandler(w, r, db) }).Methods("GET")
+
+	// Fleet operators charge damage fees after reviewing a damage report
+	fleet := protected.NewRoute().Subrouter()
+	fleet.Use(auth.RequireRole(auth.RoleFleetOperator))
+	fleet.HandleFunc("/damage-fees", func(w http.ResponseWriter, r *http.Request) { ChargeDamageFeeHandler(w, r, db) }).Methods("POST")
+
+	// Finance staff can re-run the monthly statement job for a period
+	finance := protected.PathPrefix("/statements").Subrouter()
+	finance.Use(auth.RequireRole(auth.RoleFinance))
+	finance.HandleFunc("/generate", func(w http.ResponseWriter, r *http.Request) { GenerateStatementsHandler(w, r, db) }).Methods("POST")
+
+	// Payment status is only changed by finance staff; customers pay through /make-payment
+	payments := protected.NewRoute().Subrouter()
+	payments.Use(auth.RequireRole(auth.RoleFinance))
+	payments.HandleFunc("/update-payment-status", func(w http.ResponseWriter, r *http.Request) { UpdatePaymentStatusHandler(w, r, db) }).Methods("PATCH")
+
+	// Consolidated invoices for organisation admins and finance staff
+	protected.HandleFunc("/organisations/{org_id}/invoices", func(w http.ResponseWriter, r *http.Request) { GenerateOrgInvoiceHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/organisations/{org_id}/invoices", func(w http.ResponseWriter, r *http.Request) { ListOrgInvoicesHandler(w, r, db) }).Methods("GET")
+	protected.HandleFunc("/organisations/{org_id}/invoices/{org_invoice_id}", func(w http.ResponseWriter, r *http.Request) { FetchOrgInvoiceHandler(w, r, db) }).Methods("GET")
+
+	// Monthly statements and organisation invoices are issued in the background
+	startStatementJob(db)
 
 	// Start server
 	log.Println("Billing service running on port 8082")
@@ -82,6 +146,8 @@ func CalculateCostHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 // GenerateInvoiceHandler generates an invoice for a completed rental
 func GenerateInvoiceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
 	var data struct {
 		ReservationID int     `json:"reservation_id"`
 		Amount        float64 `json:"amount"`
@@ -93,8 +159,20 @@ func GenerateInvoiceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB)
 		return
 	}
 
-	_, err = db.Exec(`INSERT INTO billing (reservation_id, amount, payment_status) VALUES (?, ?, ?)`,
-		data.ReservationID, data.Amount, "Pending")
+	if !checkReservationOwner(w, db, data.ReservationID, authUser) {
+		return
+	}
+
+	// One-way trips add the drop-off station's fee to the rental cost
+	var oneWayFee float64
+	err = db.QueryRow(`SELECT one_way_fee FROM reservations WHERE reservation_id = ?`, data.ReservationID).Scan(&oneWayFee)
+	if err != nil {
+		http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec(`INSERT INTO billing (reservation_id, amount, one_way_fee, payment_status) VALUES (?, ?, ?, ?)`,
+		data.ReservationID, data.Amount+oneWayFee, oneWayFee, "Pending")
 	if err != nil {
 		http.Error(w, "Failed to generate invoice", http.StatusInternalServerError)
 		return
@@ -104,8 +182,10 @@ func GenerateInvoiceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Invoice generated successfully"})
 }
 
-// FetchInvoiceHandler retrieves an invoice for a specific reservation
+// FetchInvoiceHandler retrieves an invoice for a specific reservation owned by the authenticated user
 func FetchInvoiceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
 	vars := mux.Vars(r)
 	reservationID, err := strconv.Atoi(vars["reservation_id"])
 	if err != nil {
@@ -113,15 +193,27 @@ func FetchInvoiceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
+	if !checkReservationOwner(w, db, reservationID, authUser) {
+		return
+	}
+
 	var invoice struct {
 		ReservationID int       `json:"reservation_id"`
 		Amount        float64   `json:"amount"`
+		OneWayFee     float64   `json:"one_way_fee"`
+		DamageFees    float64   `json:"damage_fees"`
 		PaymentStatus string    `json:"payment_status"`
 		CreatedAt     time.Time `json:"created_at"`
 	}
 
-	err = db.QueryRow(`SELECT reservation_id, amount, payment_status, created_at FROM billing WHERE reservation_id = ?`, reservationID).
-		Scan(&invoice.ReservationID, &invoice.Amount, &invoice.PaymentStatus, &invoice.CreatedAt)
+	// Damage fees are billed separately and only summarised on the rental invoice
+	err = db.QueryRow(`
+		SELECT reservation_id, amount, one_way_fee,
+			(SELECT COALESCE(SUM(fees.amount), 0) FROM billing AS fees WHERE fees.reservation_id = billing.reservation_id AND fees.charge_type = 'damage'),
+			payment_status, created_at
+		FROM billing
+		WHERE reservation_id = ? AND charge_type = 'rental'`, reservationID).
+		Scan(&invoice.ReservationID, &invoice.Amount, &invoice.OneWayFee, &invoice.DamageFees, &invoice.PaymentStatus, &invoice.CreatedAt)
 	if err != nil {
 		http.Error(w, "Invoice not found", http.StatusNotFound)
 		return
@@ -131,11 +223,13 @@ func FetchInvoiceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	json.NewEncoder(w).Encode(invoice)
 }
 
-// UpdatePaymentStatusHandler updates the payment status of a reservation
+// UpdatePaymentStatusHandler lets finance staff update the payment status of a
+// reservation's rental or damage charge
 func UpdatePaymentStatusHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	var data struct {
 		ReservationID int    `json:"reservation_id"`
 		Status        string `json:"status"`
+		ChargeType    string `json:"charge_type"` // "rental" (default) or "damage"
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -144,7 +238,64 @@ func UpdatePaymentStatusHandler(w http.ResponseWriter, r *http.Request, db *sql.
 		return
 	}
 
-	_, err = db.Exec(`UPDATE billing SET payment_status = ? WHERE reservation_id = ?`, data.Status, data.ReservationID)
+	if data.ChargeType == "" {
+		data.ChargeType = "rental"
+	}
+	if data.ChargeType != "rental" && data.ChargeType != "damage" {
+		http.Error(w, "charge_type must be rental or damage", http.StatusBadRequest)
+		return
+	}
+
+	if data.Status != "Pending" && data.Status != "Paid" && data.Status != "Refunded" {
+		http.Error(w, "status must be Pending, Paid or Refunded", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update payment status", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Statements report paid_at and refunded_at as money movements, so only a
+	// paid charge can be refunded and a refund is final. A charge can span
+	// several rows, all of which are updated, so every one is checked.
+	var count, refunded, unpaid int
+	err = tx.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(payment_status = 'Refunded'), 0), COALESCE(SUM(paid_at IS NULL), 0)
+		FROM billing
+		WHERE reservation_id = ? AND charge_type = ?
+		FOR UPDATE`,
+		data.ReservationID, data.ChargeType).Scan(&count, &refunded, &unpaid)
+	if err != nil {
+		http.Error(w, "Failed to fetch charge", http.StatusInternalServerError)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "Charge not found", http.StatusNotFound)
+		return
+	}
+	if refunded > 0 && data.Status != "Refunded" {
+		http.Error(w, "Refunded charges cannot be changed", http.StatusConflict)
+		return
+	}
+	if data.Status == "Refunded" && unpaid > 0 {
+		http.Error(w, "Only paid charges can be refunded", http.StatusConflict)
+		return
+	}
+
+	// Record when a charge was first paid or refunded, for monthly statements
+	_, err = tx.Exec(`
+		UPDATE billing SET
+			payment_status = ?,
+			paid_at = IF(? = 'Paid', COALESCE(paid_at, NOW()), paid_at),
+			refunded_at = IF(? = 'Refunded', COALESCE(refunded_at, NOW()), refunded_at)
+		WHERE reservation_id = ? AND charge_type = ?`,
+		data.Status, data.Status, data.Status, data.ReservationID, data.ChargeType)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		http.Error(w, "Failed to update payment status", http.StatusInternalServerError)
 		return
@@ -154,48 +305,56 @@ func UpdatePaymentStatusHandler(w http.ResponseWriter, r *http.Request, db *sql.
 	json.NewEncoder(w).Encode(map[string]string{"message": "Payment status updated successfully"})
 }
 
-// FetchInvoicesByUserHandler retrieves all invoices for a specific user
+// FetchInvoicesByUserHandler retrieves all invoices for the authenticated user.
+// A user_id in the path must match the caller unless they are finance staff.
 func FetchInvoicesByUserHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+	userID := authUser.ID
+
 	vars := mux.Vars(r)
-	userID, err := strconv.Atoi(vars["user_id"])
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+	if rawUserID, ok := vars["user_id"]; ok {
+		pathUserID, err := strconv.Atoi(rawUserID)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if pathUserID != authUser.ID && !authUser.HasAnyRole(auth.RoleFinance) {
+			http.Error(w, "You do not have access to these invoices", http.StatusForbidden)
+			return
+		}
+		userID = pathUserID
 	}
 
 	// Query the database for invoices
 	rows, err := db.Query(`
         SELECT 
             billing.reservation_id, 
+            COALESCE(billing.invoice_id, ''),
+            billing.charge_type,
             billing.amount, 
             billing.payment_status, 
-            DATE_FORMAT(billing.created_at, '%Y-%m-%d') AS created_at 
+            DATE_FORMAT(billing.created_at, '%Y-%m-%d') AS created_at,
+            COALESCE(vehicles.model, ''),
+            DATE_FORMAT(reservations.start_time, '%Y-%m-%d %H:%i:%s'),
+            DATE_FORMAT(reservations.end_time, '%Y-%m-%d %H:%i:%s')
         FROM billing
         JOIN reservations ON billing.reservation_id = reservations.reservation_id
-        WHERE reservations.user_id = ?`, userID)
+        LEFT JOIN vehicles ON vehicles.vehicle_id = reservations.vehicle_id
+        WHERE reservations.user_id = ?
+        ORDER BY billing.created_at, billing.billing_id`, userID)
 	if err != nil {
 		http.Error(w, "Failed to fetch invoices", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	// Define a struct for individual invoice data
-	var invoices []struct {
-		ReservationID int     `json:"reservation_id"`
-		Amount        float64 `json:"amount"`
-		PaymentStatus string  `json:"payment_status"`
-		CreatedAt     string  `json:"created_at"` // Use string for date
-	}
+	var invoices []Invoice
 
 	// Loop through the rows and scan data into the struct
 	for rows.Next() {
-		var invoice struct {
-			ReservationID int     `json:"reservation_id"`
-			Amount        float64 `json:"amount"`
-			PaymentStatus string  `json:"payment_status"`
-			CreatedAt     string  `json:"created_at"` // Use string for date
-		}
-		if err := rows.Scan(&invoice.ReservationID, &invoice.Amount, &invoice.PaymentStatus, &invoice.CreatedAt); err != nil {
+		var invoice Invoice
+		if err := rows.Scan(&invoice.ReservationID, &invoice.InvoiceID, &invoice.ChargeType, &invoice.Amount, &invoice.PaymentStatus, &invoice.CreatedAt,
+			&invoice.VehicleModel, &invoice.StartTime, &invoice.EndTime); err != nil {
 			http.Error(w, "Error scanning invoice data", http.StatusInternalServerError)
 			return
 		}
@@ -208,13 +367,46 @@ func FetchInvoicesByUserHandler(w http.ResponseWriter, r *http.Request, db *sql.
 		return
 	}
 
+	// CSV downloads are used for expense claims
+	if r.URL.Query().Get("format") == "csv" {
+		writeInvoicesCSV(w, invoices)
+		return
+	}
+
 	// Encode the data to JSON and send it in the response
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(invoices)
 }
 
-// MakePaymentHandler creates a new billing record for a payment
+// writeInvoicesCSV writes invoices as a CSV download
+func writeInvoicesCSV(w http.ResponseWriter, invoices []Invoice) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="invoices.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"invoice_id", "charge_type", "reservation_id", "date", "vehicle_model", "start_time", "end_time", "amount", "payment_status"})
+	for _, invoice := range invoices {
+		out.Write([]string{
+			invoice.InvoiceID,
+			invoice.ChargeType,
+			strconv.Itoa(invoice.ReservationID),
+			invoice.CreatedAt,
+			invoice.VehicleModel,
+			invoice.StartTime,
+			invoice.EndTime,
+			strconv.FormatFloat(invoice.Amount, 'f', 2, 64),
+			invoice.PaymentStatus,
+		})
+	}
+	out.Flush()
+}
+
+// MakePaymentHandler creates a new billing record for a payment. Customers
+// can only create pending charges.
 func MakePaymentHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
 	var data struct {
 		ReservationID int     `json:"reservation_id"`
 		Amount        float64 `json:"amount"`
@@ -235,12 +427,46 @@ func MakePaymentHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
+	// Refunds are only issued by finance staff
+	if data.PaymentStatus != "Pending" && data.PaymentStatus != "Paid" {
+		http.Error(w, "payment_status must be Pending or Paid", http.StatusBadRequest)
+		return
+	}
+
+	// Until a payment provider confirms payments, only finance staff can
+	// record one as paid; customers' charges stay pending
+	if data.PaymentStatus == "Paid" && !authUser.HasAnyRole(auth.RoleFinance) {
+		http.Error(w, "Only finance staff can record a payment as Paid", http.StatusForbidden)
+		return
+	}
+
+	if !checkReservationOwner(w, db, data.ReservationID, authUser) {
+		return
+	}
+
+	// Bookings charged to an organisation are settled by its consolidated invoice,
+	// and one-way trips add the drop-off station's fee to the rental cost
+	var orgID sql.NullInt64
+	var oneWayFee float64
+	err = db.QueryRow(`SELECT org_id, one_way_fee FROM reservations WHERE reservation_id = ?`, data.ReservationID).Scan(&orgID, &oneWayFee)
+	if err != nil {
+		http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
+		return
+	}
+	if orgID.Valid {
+		data.PaymentStatus = "Pending"
+	}
+
 	// Insert a new row into the billing table
 	_, err = db.Exec(`
-		INSERT INTO billing (reservation_id, amount, payment_status, invoice_id, created_at)
-		VALUES (?, ?, ?, ?, NOW())`,
-		data.ReservationID, data.Amount, data.PaymentStatus, data.InvoiceID,
+		INSERT INTO billing (reservation_id, amount, one_way_fee, payment_status, invoice_id, paid_at, created_at)
+		VALUES (?, ?, ?, ?, ?, IF(? = 'Paid', NOW(), NULL), NOW())`,
+		data.ReservationID, data.Amount+oneWayFee, oneWayFee, data.PaymentStatus, data.InvoiceID, data.PaymentStatus,
 	)
+	if isDuplicateKey(err) {
+		http.Error(w, "Invoice ID has already been used", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to create billing record", http.StatusInternalServerError)
 		return
@@ -250,3 +476,93 @@ func MakePaymentHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Billing record created successfully"})
 }
+
+// ChargeDamageFeeHandler bills the renter of a reservation for damage found
+// in a reviewed damage report. Charging the same report again has no effect.
+func ChargeDamageFeeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var data struct {
+		ReservationID int     `json:"reservation_id"`
+		ReportID      int     `json:"report_id"`
+		Amount        float64 `json:"amount"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if data.ReservationID == 0 || data.ReportID == 0 || data.Amount <= 0 || data.Amount > 100000 {
+		http.Error(w, "reservation_id, report_id and an amount between 0 and 100000 are required", http.StatusBadRequest)
+		return
+	}
+
+	// Only a fee set on a reviewed damage report for this reservation can be charged
+	var reservationID int
+	var reportType, status string
+	var fee sql.NullFloat64
+	err = db.QueryRow(`SELECT reservation_id, report_type, status, fee FROM damage_reports WHERE report_id = ?`, data.ReportID).
+		Scan(&reservationID, &reportType, &status, &fee)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Damage report not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch damage report", http.StatusInternalServerError)
+		return
+	}
+	if reservationID != data.ReservationID || reportType != "damage" {
+		http.Error(w, "Damage report does not belong to this reservation", http.StatusBadRequest)
+		return
+	}
+	if status != "reviewed" || !fee.Valid || math.Round(fee.Float64*100) != math.Round(data.Amount*100) {
+		http.Error(w, "Damage report has not been reviewed with this fee", http.StatusConflict)
+		return
+	}
+
+	// The invoice ID is derived from the report and unique, so a retried request is not billed twice
+	invoiceID := fmt.Sprintf("DMG-%d", data.ReportID)
+	_, err = db.Exec(`
+		INSERT INTO billing (reservation_id, amount, charge_type, payment_status, invoice_id)
+		VALUES (?, ?, 'damage', 'Pending', ?)`,
+		data.ReservationID, data.Amount, invoiceID)
+	if isDuplicateKey(err) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Damage fee already charged", "invoice_id": invoiceID})
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to charge damage fee", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Damage fee charged successfully", "invoice_id": invoiceID})
+}
+
+// checkReservationOwner verifies that the reservation belongs to the user, writing
+// a 404 or 403 response and returning false when it does not. Finance staff and
+// admins may act on any reservation.
+func checkReservationOwner(w http.ResponseWriter, db *sql.DB, reservationID int, user auth.User) bool {
+	var ownerID int
+	err := db.QueryRow(`SELECT user_id FROM reservations WHERE reservation_id = ?`, reservationID).Scan(&ownerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Reservation not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	if ownerID != user.ID && !user.HasAnyRole(auth.RoleFinance) {
+		http.Error(w, "You do not have access to this reservation", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// isDuplicateKey reports whether err is MySQL's duplicate key error
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
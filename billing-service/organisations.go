@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// OrgInvoice struct for an organisation's consolidated monthly invoice
+type OrgInvoice struct {
+	OrgInvoiceID  int                `json:"org_invoice_id"`
+	OrgID         int                `json:"org_id"`
+	Period        string             `json:"period"`
+	Total         float64            `json:"total"`
+	PaymentStatus string             `json:"payment_status"`
+	CreatedAt     string             `json:"created_at"`
+	Members       []OrgInvoiceMember `json:"members,omitempty"`
+}
+
+// OrgInvoiceMember struct for one member's share of a consolidated invoice
+type OrgInvoiceMember struct {
+	UserID   int              `json:"user_id"`
+	Email    string           `json:"email"`
+	Subtotal float64          `json:"subtotal"`
+	Lines    []OrgInvoiceLine `json:"lines"`
+}
+
+// OrgInvoiceLine struct for a booking on a consolidated invoice
+type OrgInvoiceLine struct {
+	ReservationID int     `json:"reservation_id"`
+	VehicleModel  string  `json:"vehicle_model"`
+	StartTime     string  `json:"start_time"`
+	EndTime       string  `json:"end_time"`
+	Amount        float64 `json:"amount"`
+}
+
+// GenerateOrgInvoiceHandler produces the consolidated invoice for a completed
+// month. Generating a month that is already invoiced returns the existing invoice.
+func GenerateOrgInvoiceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	orgID, ok := orgFromPath(w, r, db)
+	if !ok {
+		return
+	}
+
+	var data struct {
+		Month string `json:"month"` // YYYY-MM
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	periodStart, err := time.Parse("2006-01", data.Month)
+	if err != nil {
+		http.Error(w, "month must be in YYYY-MM format", http.StatusBadRequest)
+		return
+	}
+	if periodStart.AddDate(0, 1, 0).After(time.Now()) {
+		http.Error(w, "Only completed months can be invoiced", http.StatusBadRequest)
+		return
+	}
+
+	invoiceID, created, err := generateOrgInvoice(db, orgID, periodStart)
+	if err != nil {
+		http.Error(w, "Failed to generate organisation invoice", http.StatusInternalServerError)
+		return
+	}
+
+	invoice, err := loadOrgInvoice(db, orgID, invoiceID)
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation invoice", http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(invoice)
+}
+
+// ListOrgInvoicesHandler lists an organisation's consolidated invoices
+func ListOrgInvoicesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	orgID, ok := orgFromPath(w, r, db)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT org_invoice_id, org_id, DATE_FORMAT(period_start, '%Y-%m'), total, payment_status, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')
+		FROM org_invoices
+		WHERE org_id = ?
+		ORDER BY period_start DESC`, orgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation invoices", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invoices := []OrgInvoice{}
+	for rows.Next() {
+		var invoice OrgInvoice
+		if err := rows.Scan(&invoice.OrgInvoiceID, &invoice.OrgID, &invoice.Period, &invoice.Total, &invoice.PaymentStatus, &invoice.CreatedAt); err != nil {
+			http.Error(w, "Error scanning invoice data", http.StatusInternalServerError)
+			return
+		}
+		invoices = append(invoices, invoice)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(invoices)
+}
+
+// FetchOrgInvoiceHandler retrieves a consolidated invoice with its line items
+// grouped by member
+func FetchOrgInvoiceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	orgID, ok := orgFromPath(w, r, db)
+	if !ok {
+		return
+	}
+
+	invoiceID, err := strconv.Atoi(mux.Vars(r)["org_invoice_id"])
+	if err != nil {
+		http.Error(w, "Invalid invoice ID", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := loadOrgInvoice(db, orgID, invoiceID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invoice not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation invoice", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(invoice)
+}
+
+// generateOrgInvoice invoices every booking charged to the organisation that
+// started in the month, returning the invoice ID and whether it was created
+// by this call
+func generateOrgInvoice(db *sql.DB, orgID int, periodStart time.Time) (int, bool, error) {
+	period := periodStart.Format("2006-01-02")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Claim the month first; the unique key stops a concurrent run invoicing it twice
+	result, err := tx.Exec(`INSERT IGNORE INTO org_invoices (org_id, period_start, total) VALUES (?, ?, 0)`, orgID, period)
+	if err != nil {
+		return 0, false, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		var invoiceID int
+		err := tx.QueryRow(`SELECT org_invoice_id FROM org_invoices WHERE org_id = ? AND period_start = ?`, orgID, period).Scan(&invoiceID)
+		return invoiceID, false, err
+	}
+	invoiceID, _ := result.LastInsertId()
+
+	_, err = tx.Exec(`
+		INSERT INTO org_invoice_lines (org_invoice_id, user_id, reservation_id, amount)
+		SELECT ?, reservations.user_id, reservations.reservation_id, billing.amount
+		FROM billing
+		JOIN reservations ON reservations.reservation_id = billing.reservation_id
+		WHERE reservations.org_id = ? AND reservations.status <> 'Cancelled' AND billing.payment_status <> 'Refunded'
+			AND reservations.start_time >= ? AND reservations.start_time < ? + INTERVAL 1 MONTH`,
+		invoiceID, orgID, period, period)
+	if err != nil {
+		return 0, false, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE org_invoices
+		SET total = (SELECT COALESCE(SUM(amount), 0) FROM org_invoice_lines WHERE org_invoice_id = ?)
+		WHERE org_invoice_id = ?`, invoiceID, invoiceID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return int(invoiceID), true, nil
+}
+
+// loadOrgInvoice reads a consolidated invoice and its line items
+func loadOrgInvoice(db *sql.DB, orgID, invoiceID int) (OrgInvoice, error) {
+	var invoice OrgInvoice
+	err := db.QueryRow(`
+		SELECT org_invoice_id, org_id, DATE_FORMAT(period_start, '%Y-%m'), total, payment_status, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')
+		FROM org_invoices
+		WHERE org_invoice_id = ? AND org_id = ?`, invoiceID, orgID).
+		Scan(&invoice.OrgInvoiceID, &invoice.OrgID, &invoice.Period, &invoice.Total, &invoice.PaymentStatus, &invoice.CreatedAt)
+	if err != nil {
+		return invoice, err
+	}
+
+	rows, err := db.Query(`
+		SELECT org_invoice_lines.user_id, users.email, org_invoice_lines.reservation_id, COALESCE(vehicles.model, ''),
+			DATE_FORMAT(reservations.start_time, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(reservations.end_time, '%Y-%m-%d %H:%i:%s'),
+			org_invoice_lines.amount
+		FROM org_invoice_lines
+		JOIN users ON users.user_id = org_invoice_lines.user_id
+		JOIN reservations ON reservations.reservation_id = org_invoice_lines.reservation_id
+		LEFT JOIN vehicles ON vehicles.vehicle_id = reservations.vehicle_id
+		WHERE org_invoice_lines.org_invoice_id = ?
+		ORDER BY org_invoice_lines.user_id, reservations.start_time`, invoiceID)
+	if err != nil {
+		return invoice, err
+	}
+	defer rows.Close()
+
+	invoice.Members = []OrgInvoiceMember{}
+	for rows.Next() {
+		var userID int
+		var email string
+		var line OrgInvoiceLine
+		if err := rows.Scan(&userID, &email, &line.ReservationID, &line.VehicleModel, &line.StartTime, &line.EndTime, &line.Amount); err != nil {
+			return invoice, err
+		}
+		// Rows are ordered by member, so a new member starts a new group
+		if n := len(invoice.Members); n == 0 || invoice.Members[n-1].UserID != userID {
+			invoice.Members = append(invoice.Members, OrgInvoiceMember{UserID: userID, Email: email})
+		}
+		member := &invoice.Members[len(invoice.Members)-1]
+		member.Lines = append(member.Lines, line)
+		member.Subtotal += line.Amount
+	}
+	return invoice, rows.Err()
+}
+
+// orgFromPath returns the organisation in the path, writing a 403 response
+// and returning false unless the caller administers it or is finance staff
+func orgFromPath(w http.ResponseWriter, r *http.Request, db *sql.DB) (int, bool) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	orgID, err := strconv.Atoi(mux.Vars(r)["org_id"])
+	if err != nil {
+		http.Error(w, "Invalid organisation ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var exists, admin bool
+	err = db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM organisations WHERE org_id = ?),
+			EXISTS(SELECT 1 FROM organisation_members WHERE user_id = ? AND org_id = ? AND role = 'admin')`,
+		orgID, authUser.ID, orgID).Scan(&exists, &admin)
+	if err != nil {
+		http.Error(w, "Failed to check organisation membership", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !exists {
+		http.Error(w, "Organisation not found", http.StatusNotFound)
+		return 0, false
+	}
+	if !admin && !authUser.HasAnyRole(auth.RoleFinance) {
+		http.Error(w, "Only organisation admins can view organisation invoices", http.StatusForbidden)
+		return 0, false
+	}
+	return orgID, true
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// statementJobInterval is how often the statement job looks for a completed
+// month to issue. Issued periods are skipped, so frequent runs are cheap.
+const statementJobInterval = time.Hour
+
+// Statement struct for a statement listing
+type Statement struct {
+	StatementID    int     `json:"statement_id"`
+	Period         string  `json:"period"`
+	OpeningBalance float64 `json:"opening_balance"`
+	Charges        float64 `json:"charges"`
+	Refunds        float64 `json:"refunds"`
+	Payments       float64 `json:"payments"`
+	ClosingBalance float64 `json:"closing_balance"`
+	DocumentSHA256 string  `json:"document_sha256"`
+	CreatedAt      string  `json:"created_at"`
+}
+
+// statementDocument is the statement as issued and stored
+type statementDocument struct {
+	UserID         int             `json:"user_id"`
+	Email          string          `json:"email"`
+	Period         string          `json:"period"`
+	PeriodStart    string          `json:"period_start"`
+	PeriodEnd      string          `json:"period_end"`
+	OpeningBalance float64         `json:"opening_balance"`
+	Charges        float64         `json:"charges"`
+	Refunds        float64         `json:"refunds"`
+	Payments       float64         `json:"payments"`
+	ClosingBalance float64         `json:"closing_balance"`
+	Lines          []statementLine `json:"lines"`
+	GeneratedAt    string          `json:"generated_at"`
+}
+
+// statementLine is one charge, payment or refund on a statement
+type statementLine struct {
+	Date          string  `json:"date"`
+	Type          string  `json:"type"`
+	ReservationID int     `json:"reservation_id"`
+	InvoiceID     string  `json:"invoice_id"`
+	Amount        float64 `json:"amount"`
+}
+
+// startStatementJob issues statements and organisation invoices for the
+// previous month in the background
+func startStatementJob(db *sql.DB) {
+	go func() {
+		for {
+			runStatementJob(db, time.Now())
+			time.Sleep(statementJobInterval)
+		}
+	}()
+}
+
+// runStatementJob issues everything due for the month before now
+func runStatementJob(db *sql.DB, now time.Time) {
+	periodStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, -1, 0)
+
+	issued, err := generateStatements(db, periodStart)
+	if err != nil {
+		log.Printf("Statement job for %s failed: %v", periodStart.Format("2006-01"), err)
+	} else if issued > 0 {
+		log.Printf("Statement job issued %d statements for %s", issued, periodStart.Format("2006-01"))
+	}
+
+	if err := generateOrgInvoices(db, periodStart); err != nil {
+		log.Printf("Organisation invoice job for %s failed: %v", periodStart.Format("2006-01"), err)
+	}
+}
+
+// generateStatements issues the statement for the month to every user with
+// billing activity who does not have one yet, returning how many were issued
+func generateStatements(db *sql.DB, periodStart time.Time) (int, error) {
+	// Dates are passed as strings so the driver does not convert them to UTC
+	start := periodStart.Format("2006-01-02")
+	end := periodStart.AddDate(0, 1, 0).Format("2006-01-02")
+
+	// Users with activity in the month, or with a balance carried into it
+	rows, err := db.Query(`
+		SELECT reservations.user_id
+		FROM billing
+		JOIN reservations ON reservations.reservation_id = billing.reservation_id
+		WHERE reservations.org_id IS NULL AND billing.created_at < ?
+			AND NOT EXISTS (SELECT 1 FROM statements WHERE statements.user_id = reservations.user_id AND statements.period_start = ?)
+		GROUP BY reservations.user_id
+		HAVING SUM(billing.created_at >= ? OR (billing.paid_at >= ? AND billing.paid_at < ?) OR (billing.refunded_at >= ? AND billing.refunded_at < ?)) > 0
+			OR SUM(billing.amount) <> SUM(CASE WHEN billing.paid_at < ? THEN billing.amount ELSE 0 END)`,
+		end, start, start, start, end, start, end, start)
+	if err != nil {
+		return 0, err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	issued := 0
+	for _, userID := range userIDs {
+		created, err := generateStatement(db, userID, periodStart)
+		if err != nil {
+			return issued, fmt.Errorf("user %d: %w", userID, err)
+		}
+		if created {
+			issued++
+		}
+	}
+	return issued, nil
+}
+
+// generateStatement builds and stores one user's statement for the month. It
+// returns false without storing anything when the statement already exists or
+// would be empty.
+func generateStatement(db *sql.DB, userID int, periodStart time.Time) (bool, error) {
+	periodEnd := periodStart.AddDate(0, 1, 0)
+	start := periodStart.Format("2006-01-02")
+	end := periodEnd.Format("2006-01-02")
+	doc := statementDocument{
+		UserID:      userID,
+		Period:      periodStart.Format("2006-01"),
+		PeriodStart: start,
+		PeriodEnd:   periodEnd.AddDate(0, 0, -1).Format("2006-01-02"),
+		Lines:       []statementLine{},
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := db.QueryRow(`SELECT email FROM users WHERE user_id = ?`, userID).Scan(&doc.Email); err != nil {
+		return false, err
+	}
+
+	// Carry the balance over from the last statement so consecutive statements
+	// always agree. Without one, the balance is worked out from the ledger as
+	// summariseStatement does: charges less payments.
+	err := db.QueryRow(`
+		SELECT closing_balance FROM statements
+		WHERE user_id = ? AND period_start < ?
+		ORDER BY period_start DESC LIMIT 1`, userID, doc.PeriodStart).Scan(&doc.OpeningBalance)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow(`
+			SELECT COALESCE(SUM(billing.amount), 0)
+				- COALESCE(SUM(CASE WHEN billing.paid_at < ? THEN billing.amount END), 0)
+			FROM billing
+			JOIN reservations ON reservations.reservation_id = billing.reservation_id
+			WHERE reservations.user_id = ? AND reservations.org_id IS NULL AND billing.created_at < ?`,
+			start, userID, start).Scan(&doc.OpeningBalance)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Each billing row can contribute a charge, a payment and a refund, each
+	// dated by its own timestamp
+	var parts []string
+	var args []interface{}
+	for _, event := range []struct{ column, kind string }{{"created_at", "charge"}, {"paid_at", "payment"}, {"refunded_at", "refund"}} {
+		parts = append(parts, fmt.Sprintf(`
+			SELECT DATE_FORMAT(billing.%[1]s, '%%Y-%%m-%%d %%H:%%i:%%s') AS event_time, '%[2]s' AS kind,
+				billing.reservation_id, COALESCE(billing.invoice_id, ''), billing.amount
+			FROM billing
+			JOIN reservations ON reservations.reservation_id = billing.reservation_id
+			WHERE reservations.user_id = ? AND reservations.org_id IS NULL
+				AND billing.%[1]s >= ? AND billing.%[1]s < ?`, event.column, event.kind))
+		args = append(args, userID, start, end)
+	}
+	rows, err := db.Query(strings.Join(parts, " UNION ALL ")+" ORDER BY event_time, kind", args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line statementLine
+		if err := rows.Scan(&line.Date, &line.Type, &line.ReservationID, &line.InvoiceID, &line.Amount); err != nil {
+			return false, err
+		}
+		doc.Lines = append(doc.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	if len(doc.Lines) == 0 && roundMoney(doc.OpeningBalance) == 0 {
+		return false, nil
+	}
+	summariseStatement(&doc)
+
+	document, err := json.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(document)
+
+	// Statements are never rewritten; a re-run for the same period is a no-op
+	result, err := db.Exec(`
+		INSERT IGNORE INTO statements
+			(user_id, period_start, opening_balance, charges, refunds, payments, closing_balance, document, document_sha256)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, doc.PeriodStart, doc.OpeningBalance, doc.Charges, doc.Refunds, doc.Payments, doc.ClosingBalance,
+		string(document), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// summariseStatement totals the statement's lines and works out its closing
+// balance. Only paid charges are refunded, and a refund both cancels the
+// charge and returns the payment, so refunds are listed but leave the balance
+// unchanged: it is the opening balance plus charges less payments.
+func summariseStatement(doc *statementDocument) {
+	doc.Charges, doc.Payments, doc.Refunds = 0, 0, 0
+	for _, line := range doc.Lines {
+		switch line.Type {
+		case "charge":
+			doc.Charges += line.Amount
+		case "payment":
+			doc.Payments += line.Amount
+		case "refund":
+			doc.Refunds += line.Amount
+		}
+	}
+
+	doc.OpeningBalance = roundMoney(doc.OpeningBalance)
+	doc.Charges = roundMoney(doc.Charges)
+	doc.Payments = roundMoney(doc.Payments)
+	doc.Refunds = roundMoney(doc.Refunds)
+	doc.ClosingBalance = roundMoney(doc.OpeningBalance + doc.Charges - doc.Payments)
+}
+
+// generateOrgInvoices issues the consolidated invoice for the month to every
+// organisation with bookings charged to it
+func generateOrgInvoices(db *sql.DB, periodStart time.Time) error {
+	rows, err := db.Query(`
+		SELECT DISTINCT org_id FROM reservations
+		WHERE org_id IS NOT NULL AND start_time >= ? AND start_time < ?`,
+		periodStart.Format("2006-01-02"), periodStart.AddDate(0, 1, 0).Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	var orgIDs []int
+	for rows.Next() {
+		var orgID int
+		if err := rows.Scan(&orgID); err != nil {
+			rows.Close()
+			return err
+		}
+		orgIDs = append(orgIDs, orgID)
+	}
+	rows.Close()
+
+	for _, orgID := range orgIDs {
+		if _, _, err := generateOrgInvoice(db, orgID, periodStart); err != nil {
+			return fmt.Errorf("organisation %d: %w", orgID, err)
+		}
+	}
+	return rows.Err()
+}
+
+// GenerateStatementsHandler lets finance staff run the statement job for a
+// completed month, for example to backfill. Re-running a month is safe.
+func GenerateStatementsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var data struct {
+		Month string `json:"month"` // YYYY-MM
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	periodStart, err := time.ParseInLocation("2006-01", data.Month, time.Local)
+	if err != nil {
+		http.Error(w, "month must be in YYYY-MM format", http.StatusBadRequest)
+		return
+	}
+	if periodStart.AddDate(0, 1, 0).After(time.Now()) {
+		http.Error(w, "Only completed months can be issued", http.StatusBadRequest)
+		return
+	}
+
+	issued, err := generateStatements(db, periodStart)
+	if err != nil {
+		log.Printf("Statement generation for %s failed: %v", data.Month, err)
+		http.Error(w, "Failed to generate statements", http.StatusInternalServerError)
+		return
+	}
+	if err := generateOrgInvoices(db, periodStart); err != nil {
+		log.Printf("Organisation invoice generation for %s failed: %v", data.Month, err)
+		http.Error(w, "Failed to generate organisation invoices", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"period": data.Month, "statements_issued": issued})
+}
+
+// ListStatementsHandler lists the statements of the authenticated user. A
+// user_id in the path must match the caller unless they are finance staff.
+func ListStatementsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, ok := statementUserID(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT statement_id, DATE_FORMAT(period_start, '%Y-%m'), opening_balance, charges, refunds, payments, closing_balance,
+			document_sha256, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')
+		FROM statements
+		WHERE user_id = ?
+		ORDER BY period_start DESC`, userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch statements", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	statements := []Statement{}
+	for rows.Next() {
+		var statement Statement
+		if err := rows.Scan(&statement.StatementID, &statement.Period, &statement.OpeningBalance, &statement.Charges, &statement.Refunds,
+			&statement.Payments, &statement.ClosingBalance, &statement.DocumentSHA256, &statement.CreatedAt); err != nil {
+			http.Error(w, "Error scanning statement data", http.StatusInternalServerError)
+			return
+		}
+		statements = append(statements, statement)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(statements)
+}
+
+// FetchStatementHandler returns a statement document exactly as it was issued
+func FetchStatementHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, ok := statementUserID(w, r)
+	if !ok {
+		return
+	}
+
+	periodStart, err := time.Parse("2006-01", mux.Vars(r)["period"])
+	if err != nil {
+		http.Error(w, "Period must be in YYYY-MM format", http.StatusBadRequest)
+		return
+	}
+
+	var document, hash string
+	err = db.QueryRow(`SELECT document, document_sha256 FROM statements WHERE user_id = ? AND period_start = ?`,
+		userID, periodStart.Format("2006-01-02")).Scan(&document, &hash)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Statement not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch statement", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Document-SHA256", hash)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(document))
+}
+
+// statementUserID returns whose statements are requested, writing a 400 or
+// 403 response and returning false when the caller may not see them
+func statementUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	rawUserID, ok := mux.Vars(r)["user_id"]
+	if !ok {
+		return authUser.ID, true
+	}
+	userID, err := strconv.Atoi(rawUserID)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+	if userID != authUser.ID && !authUser.HasAnyRole(auth.RoleFinance) {
+		http.Error(w, "You do not have access to these statements", http.StatusForbidden)
+		return 0, false
+	}
+	return userID, true
+}
+
+// roundMoney rounds an amount to whole cents
+func roundMoney(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestSummariseStatementRefund(t *testing.T) {
+	// A charge paid and refunded in the same month nets to nothing
+	doc := statementDocument{
+		OpeningBalance: 10,
+		Lines: []statementLine{
+			{Type: "charge", Amount: 25.5},
+			{Type: "payment", Amount: 25.5},
+			{Type: "refund", Amount: 25.5},
+		},
+	}
+	summariseStatement(&doc)
+	if doc.Charges != 25.5 || doc.Payments != 25.5 || doc.Refunds != 25.5 {
+		t.Errorf("totals: charges %v, payments %v, refunds %v", doc.Charges, doc.Payments, doc.Refunds)
+	}
+	if doc.ClosingBalance != 10 {
+		t.Errorf("closing balance %v, want the opening balance 10", doc.ClosingBalance)
+	}
+
+	// Paid in one month and refunded in the next, the balance carried into the
+	// second month is unchanged by the refund, matching the ledger's opening
+	// balance of charges less payments
+	first := statementDocument{Lines: []statementLine{{Type: "charge", Amount: 40}, {Type: "payment", Amount: 40}}}
+	summariseStatement(&first)
+	second := statementDocument{OpeningBalance: first.ClosingBalance, Lines: []statementLine{{Type: "refund", Amount: 40}}}
+	summariseStatement(&second)
+	if first.ClosingBalance != 0 || second.ClosingBalance != 0 {
+		t.Errorf("closing balances %v then %v, want 0 then 0", first.ClosingBalance, second.ClosingBalance)
+	}
+
+	// An unpaid charge is owed
+	unpaid := statementDocument{OpeningBalance: 5, Lines: []statementLine{{Type: "charge", Amount: 12.5}}}
+	summariseStatement(&unpaid)
+	if unpaid.ClosingBalance != 17.5 {
+		t.Errorf("closing balance %v, want 17.5", unpaid.ClosingBalance)
+	}
+}
@@ -12,10 +12,179 @@ CREATE TABLE users (
     phone_number VARCHAR(15) NOT NULL,
     country_code VARCHAR(5) NOT NULL,
     phone_verified BOOLEAN DEFAULT FALSE,
+    disabled BOOLEAN DEFAULT FALSE,
+    token_version INT NOT NULL DEFAULT 0,
+    totp_secret VARCHAR(64) DEFAULT NULL,
+    totp_enabled BOOLEAN DEFAULT FALSE,
+    totp_last_step BIGINT DEFAULT 0,
+    deleted_at DATETIME DEFAULT NULL,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 );
 
+-- User Roles table
+CREATE TABLE user_roles (
+    user_id INT NOT NULL,
+    role ENUM('customer', 'fleet_operator', 'finance', 'admin') NOT NULL,
+    granted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role),
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+-- Recovery Codes table
+CREATE TABLE recovery_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at DATETIME DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+-- Email Changes table
+CREATE TABLE email_changes (
+    user_id INT PRIMARY KEY,
+    new_email VARCHAR(255) NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+-- Data Exports table
+CREATE TABLE data_exports (
+    export_id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    status ENUM('pending', 'processing', 'completed', 'failed', 'expired') DEFAULT 'pending',
+    file_path VARCHAR(255) DEFAULT NULL,
+    error VARCHAR(255) DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    completed_at DATETIME DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+-- Audit Log table
+CREATE TABLE audit_log (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    actor_id INT NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    target_user_id INT DEFAULT NULL,
+    details VARCHAR(255) DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (actor_id) REFERENCES users(user_id),
+    FOREIGN KEY (target_user_id) REFERENCES users(user_id)
+);
+
+-- User Identities table
+CREATE TABLE user_identities (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255) DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+-- OAuth States table
+CREATE TABLE oauth_states (
+    state VARCHAR(64) PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+
+-- API Keys table
+CREATE TABLE api_keys (
+    key_id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    key_prefix CHAR(12) UNIQUE NOT NULL,
+    key_hash CHAR(64) NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    expires_at DATETIME DEFAULT NULL,
+    last_used_at DATETIME DEFAULT NULL,
+    revoked_at DATETIME DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+-- Calendar Feeds table
+CREATE TABLE calendar_feeds (
+    user_id INT PRIMARY KEY,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_fetched_at DATETIME DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+-- Driver Licences table
+CREATE TABLE driver_licences (
+    user_id INT PRIMARY KEY,
+    licence_number VARCHAR(50) NOT NULL,
+    country CHAR(2) NOT NULL,
+    expiry_date DATE NOT NULL,
+    image_path VARCHAR(255) DEFAULT NULL,
+    status ENUM('pending', 'approved', 'rejected') DEFAULT 'pending',
+    rejection_reason VARCHAR(255) DEFAULT NULL,
+    reviewed_by INT DEFAULT NULL,
+    reviewed_at DATETIME DEFAULT NULL,
+    submitted_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
+    FOREIGN KEY (reviewed_by) REFERENCES users(user_id)
+);
+
+-- Organisations table
+CREATE TABLE organisations (
+    org_id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    monthly_spending_limit DECIMAL(10, 2) DEFAULT NULL,
+    created_by INT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by) REFERENCES users(user_id)
+);
+
+-- Organisation Members table
+CREATE TABLE organisation_members (
+    user_id INT PRIMARY KEY,
+    org_id INT NOT NULL,
+    role ENUM('admin', 'member') DEFAULT 'member',
+    joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
+    FOREIGN KEY (org_id) REFERENCES organisations(org_id) ON DELETE CASCADE
+);
+
+-- Organisation Invitations table
+CREATE TABLE organisation_invitations (
+    invitation_id INT AUTO_INCREMENT PRIMARY KEY,
+    org_id INT NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    invited_by INT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    accepted_at DATETIME DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (org_id) REFERENCES organisations(org_id) ON DELETE CASCADE,
+    FOREIGN KEY (invited_by) REFERENCES users(user_id)
+);
+
+-- Stations table
+CREATE TABLE stations (
+    station_id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) UNIQUE NOT NULL,
+    address VARCHAR(255) NOT NULL,
+    latitude DECIMAL(9, 6) NOT NULL,
+    longitude DECIMAL(9, 6) NOT NULL,
+    capacity INT NOT NULL CHECK (capacity > 0),
+    opens_at TIME DEFAULT NULL,
+    closes_at TIME DEFAULT NULL,
+    one_way_fee DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Vehicles table
 CREATE TABLE vehicles (
     vehicle_id INT AUTO_INCREMENT PRIMARY KEY,
@@ -23,10 +192,85 @@ CREATE TABLE vehicles (
     license_plate VARCHAR(50) UNIQUE NOT NULL,
     charge_level INT CHECK (charge_level BETWEEN 0 AND 100),
     cleanliness ENUM('Clean', 'Needs Cleaning') DEFAULT 'Clean',
+    seats TINYINT NOT NULL DEFAULT 5 CHECK (seats > 0),
+    price_band ENUM('Economy', 'Standard', 'Premium') NOT NULL DEFAULT 'Standard',
+    range_km SMALLINT NOT NULL DEFAULT 300 CHECK (range_km > 0),
     last_service_date DATETIME DEFAULT NULL,
     availability BOOLEAN DEFAULT TRUE,
     location VARCHAR(255),
-    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    latitude DECIMAL(9, 6) DEFAULT NULL,
+    longitude DECIMAL(9, 6) DEFAULT NULL,
+    station_id INT DEFAULT NULL,
+    odometer_km DECIMAL(10, 1) DEFAULT NULL,
+    locked BOOLEAN DEFAULT NULL,
+    telemetry_at DATETIME DEFAULT NULL,
+    retired_at DATETIME DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_vehicles_coordinates (latitude, longitude),
+    INDEX idx_vehicles_availability (availability, charge_level),
+    FOREIGN KEY (station_id) REFERENCES stations(station_id)
+);
+
+-- Vehicle devices table
+CREATE TABLE vehicle_devices (
+    vehicle_id INT PRIMARY KEY,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at DATETIME DEFAULT NULL,
+    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id)
+);
+
+-- Vehicle telemetry table
+CREATE TABLE vehicle_telemetry (
+    telemetry_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    vehicle_id INT NOT NULL,
+    recorded_at DATETIME NOT NULL,
+    received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    charge_level INT DEFAULT NULL CHECK (charge_level BETWEEN 0 AND 100),
+    odometer_km DECIMAL(10, 1) DEFAULT NULL,
+    latitude DECIMAL(9, 6) DEFAULT NULL,
+    longitude DECIMAL(9, 6) DEFAULT NULL,
+    locked BOOLEAN DEFAULT NULL,
+    INDEX idx_vehicle_telemetry_recorded (vehicle_id, recorded_at),
+    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id)
+);
+
+-- Vehicle commands table
+CREATE TABLE vehicle_commands (
+    command_id INT AUTO_INCREMENT PRIMARY KEY,
+    vehicle_id INT NOT NULL,
+    user_id INT NOT NULL,
+    reservation_id INT NOT NULL,
+    command ENUM('unlock', 'lock', 'honk') NOT NULL,
+    status ENUM('pending', 'succeeded', 'failed', 'timed_out') NOT NULL DEFAULT 'pending',
+    detail VARCHAR(255) DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    completed_at DATETIME DEFAULT NULL,
+    INDEX idx_vehicle_commands_vehicle (vehicle_id, command_id),
+    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+-- Maintenance tasks table
+CREATE TABLE maintenance_tasks (
+    task_id INT AUTO_INCREMENT PRIMARY KEY,
+    vehicle_id INT NOT NULL,
+    task_type ENUM('cleaning', 'servicing', 'repair', 'charging') NOT NULL,
+    status ENUM('open', 'completed', 'cancelled') NOT NULL DEFAULT 'open',
+    scheduled_start DATETIME NOT NULL,
+    scheduled_end DATETIME NOT NULL,
+    notes VARCHAR(500) DEFAULT NULL,
+    automatic BOOLEAN NOT NULL DEFAULT FALSE,
+    created_by INT DEFAULT NULL,
+    completed_by INT DEFAULT NULL,
+    completed_at DATETIME DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_maintenance_tasks_vehicle (vehicle_id, status, scheduled_start),
+    INDEX idx_maintenance_tasks_schedule (status, scheduled_start),
+    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id),
+    FOREIGN KEY (created_by) REFERENCES users(user_id),
+    FOREIGN KEY (completed_by) REFERENCES users(user_id),
+    CHECK (scheduled_end > scheduled_start)
 );
 
 -- Reservations table
@@ -37,9 +281,49 @@ CREATE TABLE reservations (
     start_time DATETIME NOT NULL,
     end_time DATETIME NOT NULL,
     status ENUM('Booked', 'Cancelled', 'Completed') DEFAULT 'Booked',
+    org_id INT DEFAULT NULL,
+    pickup_station_id INT DEFAULT NULL,
+    dropoff_station_id INT DEFAULT NULL,
+    one_way_fee DECIMAL(10, 2) NOT NULL DEFAULT 0,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_reservations_org_start (org_id, start_time),
     FOREIGN KEY (user_id) REFERENCES users(user_id),
-    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id)
+    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id),
+    FOREIGN KEY (org_id) REFERENCES organisations(org_id),
+    FOREIGN KEY (pickup_station_id) REFERENCES stations(station_id),
+    FOREIGN KEY (dropoff_station_id) REFERENCES stations(station_id)
+);
+
+-- Damage reports table
+CREATE TABLE damage_reports (
+    report_id INT AUTO_INCREMENT PRIMARY KEY,
+    reservation_id INT NOT NULL,
+    vehicle_id INT NOT NULL,
+    user_id INT NOT NULL,
+    report_type ENUM('damage', 'cleanliness', 'low_charge') NOT NULL,
+    description VARCHAR(1000) DEFAULT NULL,
+    status ENUM('pending_review', 'reviewed') NOT NULL DEFAULT 'pending_review',
+    task_id INT DEFAULT NULL,
+    fee DECIMAL(10, 2) DEFAULT NULL,
+    review_notes VARCHAR(1000) DEFAULT NULL,
+    reviewed_by INT DEFAULT NULL,
+    reviewed_at DATETIME DEFAULT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_damage_reports_status (status, report_id),
+    FOREIGN KEY (reservation_id) REFERENCES reservations(reservation_id),
+    FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id),
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (task_id) REFERENCES maintenance_tasks(task_id),
+    FOREIGN KEY (reviewed_by) REFERENCES users(user_id)
+);
+
+-- Damage report photos table
+CREATE TABLE damage_report_photos (
+    photo_id INT AUTO_INCREMENT PRIMARY KEY,
+    report_id INT NOT NULL,
+    file_path VARCHAR(255) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (report_id) REFERENCES damage_reports(report_id)
 );
 
 -- Billing table
@@ -47,12 +331,57 @@ CREATE TABLE billing (
     billing_id INT AUTO_INCREMENT PRIMARY KEY,
     reservation_id INT NOT NULL,
     amount DECIMAL(10, 2) NOT NULL,
+    one_way_fee DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    charge_type ENUM('rental', 'damage') NOT NULL DEFAULT 'rental',
     payment_status ENUM('Pending', 'Paid', 'Refunded') DEFAULT 'Pending',
-    invoice_id VARCHAR(50) DEFAULT NULL,
+    invoice_id VARCHAR(50) DEFAULT NULL UNIQUE,
+    paid_at DATETIME DEFAULT NULL,
+    refunded_at DATETIME DEFAULT NULL,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (reservation_id) REFERENCES reservations(reservation_id)
 );
 
+-- Statements table
+CREATE TABLE statements (
+    statement_id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    period_start DATE NOT NULL,
+    opening_balance DECIMAL(10, 2) NOT NULL,
+    charges DECIMAL(10, 2) NOT NULL,
+    refunds DECIMAL(10, 2) NOT NULL,
+    payments DECIMAL(10, 2) NOT NULL,
+    closing_balance DECIMAL(10, 2) NOT NULL,
+    document MEDIUMTEXT NOT NULL,
+    document_sha256 CHAR(64) NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (user_id, period_start),
+    FOREIGN KEY (user_id) REFERENCES users(user_id)
+);
+
+-- Organisation Invoices table
+CREATE TABLE org_invoices (
+    org_invoice_id INT AUTO_INCREMENT PRIMARY KEY,
+    org_id INT NOT NULL,
+    period_start DATE NOT NULL,
+    total DECIMAL(10, 2) NOT NULL,
+    payment_status ENUM('Pending', 'Paid') DEFAULT 'Pending',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY (org_id, period_start),
+    FOREIGN KEY (org_id) REFERENCES organisations(org_id)
+);
+
+-- Organisation Invoice Lines table
+CREATE TABLE org_invoice_lines (
+    line_id INT AUTO_INCREMENT PRIMARY KEY,
+    org_invoice_id INT NOT NULL,
+    user_id INT NOT NULL,
+    reservation_id INT NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL,
+    FOREIGN KEY (org_invoice_id) REFERENCES org_invoices(org_invoice_id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(user_id),
+    FOREIGN KEY (reservation_id) REFERENCES reservations(reservation_id)
+);
+
 -- Promotions table
 CREATE TABLE promotions (
     promotion_id INT AUTO_INCREMENT PRIMARY KEY,
@@ -80,6 +409,7 @@ CREATE TABLE rental_history (
     start_time DATETIME NOT NULL,
     end_time DATETIME NOT NULL,
     total_cost DECIMAL(10, 2) NOT NULL,
+    INDEX idx_rental_history_user_start (user_id, start_time),
     FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE,
     FOREIGN KEY (vehicle_id) REFERENCES vehicles(vehicle_id) ON DELETE CASCADE
 );
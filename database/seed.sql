@@ -5,12 +5,27 @@ VALUES
 ('alice@example.com', '$2a$10$DkF1f2m9Khz9yJHd2MqYuOMbZjm5wyPryOaR/u50AVzAeQ3Dj43G6', 'Premium', '512345678', '+1', TRUE, NOW()),
 ('bob@example.com', '$2a$10$6g8Tz1o5QUH.Qx4EpREhEu/HFsX8hbZ8oM2PEHzH1B6zGUN4dJ.gK', 'Basic', '441234567', '+44', TRUE, NOW());
 
+-- Insert data into user roles
+INSERT INTO user_roles (user_id, role)
+VALUES
+(1, 'customer'),
+(1, 'admin'),
+(2, 'customer'),
+(3, 'customer');
+
+-- Insert data into stations
+INSERT INTO stations (name, address, latitude, longitude, capacity, opens_at, closes_at, one_way_fee)
+VALUES
+('Orchard', 'Orchard Road, Singapore', 1.304833, 103.831867, 10, NULL, NULL, 5.00),
+('Jurong East', 'Jurong East, Singapore', 1.333152, 103.742257, 8, '06:00:00', '23:00:00', 5.00),
+('Changi Airport', 'Changi Airport, Singapore', 1.364420, 103.991531, 20, NULL, NULL, 10.00);
+
 -- Insert data into vehicles
-INSERT INTO vehicles (model, license_plate, charge_level, cleanliness, last_service_date, availability, location)
+INSERT INTO vehicles (model, license_plate, charge_level, cleanliness, seats, price_band, range_km, last_service_date, availability, location, latitude, longitude, station_id)
 VALUES
-('Tesla Model 3', 'SGP1234T', 80, 'Clean', '2024-03-01 12:00:00', TRUE, 'Orchard Road, Singapore'),
-('Hyundai Kona', 'SGP5678U', 100, 'Needs Cleaning', '2024-02-28 15:30:00', TRUE, 'Jurong East, Singapore'),
-('Nissan Leaf', 'SGP9012X', 50, 'Clean', '2024-01-15 09:00:00', FALSE, 'Changi Airport, Singapore');
+('Tesla Model 3', 'SGP1234T', 80, 'Clean', 5, 'Premium', 490, '2024-03-01 12:00:00', TRUE, 'Orchard Road, Singapore', 1.304833, 103.831867, 1),
+('Hyundai Kona', 'SGP5678U', 100, 'Needs Cleaning', 5, 'Standard', 450, '2024-02-28 15:30:00', TRUE, 'Jurong East, Singapore', 1.333152, 103.742257, 2),
+('Nissan Leaf', 'SGP9012X', 50, 'Clean', 5, 'Economy', 270, '2024-01-15 09:00:00', FALSE, 'Changi Airport, Singapore', 1.364420, 103.991531, 3);
 
 -- Insert data into promotions
 INSERT INTO promotions (name, discount_percent, valid_from, valid_to)
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,11 +11,46 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
+	"auth"
+
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
+// routeRule declares whether a gateway path can be reached without a token
+type routeRule struct {
+	Method string // empty matches any method
+	Path   string // a trailing slash matches any path below it
+	Public bool
+}
+
+// Gateway routes that do not require authentication; every other /api path does
+var routeRules = []routeRule{
+	{Method: "POST", Path: "/api/user/login", Public: true},
+	{Method: "POST", Path: "/api/user/login/2fa", Public: true},
+	{Method: "GET", Path: "/api/user/oauth/", Public: true},
+	{Method: "POST", Path: "/api/user/register", Public: true},
+	{Method: "POST", Path: "/api/user/generate-otp", Public: true},
+	{Method: "POST", Path: "/api/user/verify-otp", Public: true},
+	{Method: "GET", Path: "/api/vehicle/vehicles", Public: true},
+	{Method: "GET", Path: "/api/vehicle/vehicles/nearby", Public: true},
+	{Method: "GET", Path: "/api/vehicle/vehicle-status/", Public: true},
+	{Method: "GET", Path: "/api/vehicle/stations", Public: true},
+	{Method: "GET", Path: "/api/vehicle/stations/", Public: true},
+	{Method: "GET", Path: "/api/vehicle/calendar/", Public: true},
+	{Method: "POST", Path: "/api/vehicle/telemetry", Public: true},
+	{Method: "POST", Path: "/api/billing/calculate-cost", Public: true},
+}
+
+// JWT secret key used to authenticate clients at the gateway
+var jwtKey []byte
+
+// Shared secret used to sign identity headers forwarded to services
+var gatewayKey []byte
+
 func main() {
 	// Load environment variables
 	err := godotenv.Load(".env")
@@ -21,16 +58,29 @@ func main() {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 
+	jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
+	gatewayKey = []byte(os.Getenv("GATEWAY_SECRET"))
+	if len(gatewayKey) == 0 {
+		log.Fatal("GATEWAY_SECRET must be set")
+	}
+
+	// The gateway reads users to reject tokens whose session has been revoked
+	db, err := sql.Open("mysql", os.Getenv("DB_DSN"))
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
 	// Start microservices
 	startMicroservices()
 
 	// Initialize router
 	r := mux.NewRouter()
 
-	// Proxy routes to microservices
-	r.HandleFunc("/api/user/{endpoint:.*}", proxyHandler("http://localhost:8081")).Methods("GET", "POST", "PATCH", "DELETE")
-	r.HandleFunc("/api/billing/{endpoint:.*}", proxyHandler("http://localhost:8082")).Methods("GET", "POST", "PATCH", "DELETE")
-	r.HandleFunc("/api/vehicle/{endpoint:.*}", proxyHandler("http://localhost:8083")).Methods("GET", "POST", "PATCH", "DELETE")
+	// Proxy routes to microservices, authenticating at the gateway first
+	r.Handle("/api/user/{endpoint:.*}", authenticateGateway(db, proxyHandler("http://localhost:8081"))).Methods("GET", "POST", "PATCH", "DELETE")
+	r.Handle("/api/billing/{endpoint:.*}", authenticateGateway(db, proxyHandler("http://localhost:8082"))).Methods("GET", "POST", "PATCH", "DELETE")
+	r.Handle("/api/vehicle/{endpoint:.*}", authenticateGateway(db, proxyHandler("http://localhost:8083"))).Methods("GET", "POST", "PATCH", "DELETE")
 
 	// Debugging proxy
 	r.HandleFunc("/api/debug", func(w http.ResponseWriter, r *http.Request) {
@@ -62,10 +112,22 @@ func startMicroservices() {
 	}
 
 	for _, service := range services {
-		cmd := exec.Command("go", "run", filepath.Join(service.Path, "main.go"))
+		// Services span several files, so pass every non-test source file
+		files, err := filepath.Glob(filepath.Join(service.Path, "*.go"))
+		if err != nil {
+			log.Fatalf("Failed to list sources for %s: %v", service.Name, err)
+		}
+		args := []string{"run"}
+		for _, file := range files {
+			if !strings.HasSuffix(file, "_test.go") {
+				args = append(args, file)
+			}
+		}
+
+		cmd := exec.Command("go", args...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		err := cmd.Start()
+		err = cmd.Start()
 		if err != nil {
 			log.Fatalf("Failed to start %s: %v", service.Name, err)
 		}
@@ -73,6 +135,57 @@ func startMicroservices() {
 	}
 }
 
+// isPublicRoute reports whether the request matches a public route rule
+func isPublicRoute(r *http.Request) bool {
+	for _, rule := range routeRules {
+		if rule.Method != "" && rule.Method != r.Method {
+			continue
+		}
+		matched := r.URL.Path == rule.Path
+		if strings.HasSuffix(rule.Path, "/") {
+			matched = strings.HasPrefix(r.URL.Path, rule.Path)
+		}
+		if matched {
+			return rule.Public
+		}
+	}
+	return false
+}
+
+// authenticateGateway validates the client's JWT and session once at the
+// edge, strips any client-supplied identity headers and forwards a signed
+// identity instead
+func authenticateGateway(db *sql.DB, next http.HandlerFunc) http.Handler {
+	authenticator := auth.New(jwtKey, nil).WithSessions(auth.NewSessionStore(db))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.StripIdentityHeaders(r.Header)
+
+		// API keys are verified by the services, which can reach the key store
+		if token, err := auth.BearerToken(r); err == nil && auth.IsAPIKey(token) {
+			next(w, r)
+			return
+		}
+
+		user, err := authenticator.Authenticate(r)
+		if err != nil {
+			if !isPublicRoute(r) {
+				if errors.Is(err, auth.ErrMissingToken) {
+					auth.Unauthorized(w, "Missing authorization token")
+				} else {
+					auth.Unauthorized(w, "Invalid or expired token")
+				}
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		auth.SetIdentityHeaders(r.Header, gatewayKey, user)
+		next(w, r)
+	})
+}
+
 // proxyHandler correctly proxies requests to the target microservice
 func proxyHandler(target string) func(w http.ResponseWriter, r *http.Request) {
 	// Parse the target URL once
@@ -0,0 +1,258 @@
+// Package issuer is a minimal OpenID Connect provider that lets anyone log in
+// as any email. It backs the mock-oidc server and the user service's tests.
+package issuer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Mock issuer settings
+const (
+	keyID    = "mock-key"
+	codeTTL  = time.Minute
+	tokenTTL = time.Hour
+)
+
+// Issuer is a mock OpenID Connect provider. URL is its public base URL;
+// ClientID and ClientSecret are the only client credentials it accepts, and
+// an empty ClientSecret accepts any.
+type Issuer struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+
+	// signingKey signs ID tokens; it is generated by New
+	signingKey *rsa.PrivateKey
+
+	// Issued authorization codes
+	codesMu sync.Mutex
+	codes   map[string]authCode
+}
+
+// authCode struct for an issued but not yet redeemed authorization code
+type authCode struct {
+	RedirectURI   string
+	Challenge     string
+	Nonce         string
+	Email         string
+	EmailVerified bool
+	ExpiresAt     time.Time
+}
+
+// loginPage asks which identity to log in as
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Mock OIDC Login</title></head>
+<body>
+    <h1>Mock OIDC Login</h1>
+    <form method="POST">
+        {{range $key, $values := .Query}}{{range $values}}<input type="hidden" name="{{$key}}" value="{{.}}">{{end}}{{end}}
+        <input type="email" name="email" placeholder="Email" value="{{.LoginHint}}" required>
+        <label><input type="checkbox" name="email_verified" value="true" checked> Email verified</label>
+        <button type="submit">Log in</button>
+    </form>
+</body>
+</html>`))
+
+// New creates an issuer with a fresh signing key
+func New(issuerURL, clientID, clientSecret string) (*Issuer, error) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &Issuer{
+		URL:          issuerURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		signingKey:   signingKey,
+		codes:        make(map[string]authCode),
+	}, nil
+}
+
+// Handler serves the issuer's discovery, authorization, token and key endpoints
+func (i *Issuer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.DiscoveryHandler)
+	mux.HandleFunc("/authorize", i.AuthorizeHandler)
+	mux.HandleFunc("/token", i.TokenHandler)
+	mux.HandleFunc("/jwks", i.JWKSHandler)
+	return mux
+}
+
+// DiscoveryHandler serves the OpenID Connect discovery document
+func (i *Issuer) DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// AuthorizeHandler shows a login form and, once submitted, redirects back to
+// the client with an authorization code
+func (i *Issuer) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI := r.Form.Get("redirect_uri")
+	if r.Form.Get("client_id") != i.ClientID || redirectURI == "" {
+		http.Error(w, "Unknown client or missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("response_type") != "code" || r.Form.Get("code_challenge_method") != "S256" || r.Form.Get("code_challenge") == "" {
+		http.Error(w, "Only the authorization code flow with S256 PKCE is supported", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		loginPage.Execute(w, map[string]interface{}{"Query": query, "LoginHint": query.Get("login_hint")})
+		return
+	}
+
+	code, err := randomString()
+	if err != nil {
+		http.Error(w, "Failed to issue code", http.StatusInternalServerError)
+		return
+	}
+
+	i.codesMu.Lock()
+	i.codes[code] = authCode{
+		RedirectURI:   redirectURI,
+		Challenge:     r.Form.Get("code_challenge"),
+		Nonce:         r.Form.Get("nonce"),
+		Email:         r.Form.Get("email"),
+		EmailVerified: r.Form.Get("email_verified") == "true",
+		ExpiresAt:     time.Now().Add(codeTTL),
+	}
+	i.codesMu.Unlock()
+
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "Invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	query := target.Query()
+	query.Set("code", code)
+	query.Set("state", r.Form.Get("state"))
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// TokenHandler redeems an authorization code for a signed ID token
+func (i *Issuer) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+	if r.FormValue("client_id") != i.ClientID || (i.ClientSecret != "" && r.FormValue("client_secret") != i.ClientSecret) {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	// Codes are single use
+	i.codesMu.Lock()
+	code, ok := i.codes[r.FormValue("code")]
+	delete(i.codes, r.FormValue("code"))
+	i.codesMu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || time.Now().After(code.ExpiresAt) || code.RedirectURI != r.FormValue("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != code.Challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	// A stable subject per email, like a real provider's account ID
+	subject := sha256.Sum256([]byte(code.Email))
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            i.URL,
+		"sub":            hex.EncodeToString(subject[:8]),
+		"aud":            i.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(tokenTTL).Unix(),
+		"nonce":          code.Nonce,
+		"email":          code.Email,
+		"email_verified": code.EmailVerified,
+	})
+	idToken.Header["kid"] = keyID
+
+	signed, err := idToken.SignedString(i.signingKey)
+	if err != nil {
+		http.Error(w, "Failed to sign token", http.StatusInternalServerError)
+		return
+	}
+
+	accessToken, err := randomString()
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokenTTL.Seconds()),
+		"id_token":     signed,
+	})
+}
+
+// JWKSHandler publishes the public signing key
+func (i *Issuer) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	public := i.signingKey.PublicKey
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": keyID,
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}},
+	})
+}
+
+// tokenError writes an OAuth2 error response
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// randomString returns a random URL-safe string
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"mock-oidc/issuer"
+)
+
+func main() {
+	addr := getenv("MOCK_OIDC_ADDR", ":9000")
+	mock, err := issuer.New(
+		getenv("MOCK_OIDC_ISSUER", "http://localhost:9000"),
+		getenv("MOCK_OIDC_CLIENT_ID", "mock-client"),
+		os.Getenv("MOCK_OIDC_CLIENT_SECRET"),
+	)
+	if err != nil {
+		log.Fatalf("Failed to generate signing key: %v", err)
+	}
+
+	log.Printf("Mock OIDC issuer %s running on %s", mock.URL, addr)
+	log.Fatal(http.ListenAndServe(addr, mock.Handler()))
+}
+
+// getenv returns the environment variable or a fallback
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -129,18 +129,96 @@ document.getElementById("loginForm")?.addEventListener("submit", async function
             body: formData,
         });
 
-        const result = await response.json();
+        let result = await response.json();
         if (!response.ok) {
             alert(result.message || "Login failed");
             return;
         }
 
-        localStorage.setItem("token", result.token); // Save JWT token
-        console.log(result.token);
-        alert("Login successful");
-        window.location.href = "../html/profile.html"; // Redirect to profile
+        await completeLogin(result);
     } catch (error) {
         console.error("Error during login:", error);
         alert("An error occurred. Please try again.");
     }
 });
+
+// Finish a login from the password or external provider step, asking for a
+// two-factor code when the account needs one
+async function completeLogin(result) {
+    // Second login step for accounts with two-factor authentication
+    if (result.mfa_required) {
+        const code = prompt("Enter the code from your authenticator app (or a recovery code):");
+        if (!code) {
+            alert("A code is required to log in.");
+            return;
+        }
+
+        const mfaFormData = new FormData();
+        mfaFormData.append("mfa_token", result.mfa_token);
+        mfaFormData.append("code", code);
+
+        const mfaResponse = await fetch(`http://localhost:8080/api/user/login/2fa`, {
+            method: "POST",
+            body: mfaFormData,
+        });
+
+        result = await mfaResponse.json();
+        if (!mfaResponse.ok) {
+            alert(result.message || "Invalid code");
+            return;
+        }
+    }
+
+    if (result.mfa_enrollment_required) {
+        alert(result.message);
+    }
+
+    localStorage.setItem("token", result.token); // Save JWT token
+    console.log(result.token);
+    alert("Login successful");
+    window.location.href = "../html/profile.html"; // Redirect to profile
+}
+
+// Show a button for each configured external login provider
+const providerList = document.getElementById("oauthProviders");
+if (providerList) {
+    fetch(`http://localhost:8080/api/user/oauth/providers`)
+        .then((response) => response.json())
+        .then((providers) => {
+            providers.forEach((provider) => {
+                const button = document.createElement("button");
+                button.className = "btn";
+                button.textContent = `Log in with ${provider}`;
+                button.addEventListener("click", async () => {
+                    const response = await fetch(`http://localhost:8080/api/user/oauth/${encodeURIComponent(provider)}/start`);
+                    const result = await response.json();
+                    if (!response.ok) {
+                        alert(result.message || "Failed to start login");
+                        return;
+                    }
+                    window.location.href = result.authorization_url;
+                });
+                providerList.appendChild(button);
+            });
+        })
+        .catch((error) => console.error("Error loading login providers:", error));
+}
+
+// Complete an external login when the provider redirects back
+if (window.location.pathname.endsWith("oauth-callback.html")) {
+    (async function () {
+        try {
+            const response = await fetch(`http://localhost:8080/api/user/oauth/callback${window.location.search}`);
+            const result = await response.json();
+            if (!response.ok) {
+                alert(result.message || "Login failed");
+                window.location.href = "../html/login.html";
+                return;
+            }
+            await completeLogin(result);
+        } catch (error) {
+            console.error("Error during login:", error);
+            alert("An error occurred. Please try again.");
+        }
+    })();
+}
@@ -1,10 +1,14 @@
 const API_VEHICLE = "/api/vehicle";
 const API_BILLING = "/api/billing";
 
+// Vehicles and stations as loaded, keyed by ID, for one-way fee estimates
+const vehiclesByID = {};
+const stationsByID = {};
+
 // Load available vehicles and populate the booking page
 async function loadVehicles() {
     try {
-        const response = await fetch(`http://localhost:8080/api/vehicle/vehicles?availability=true`, {
+        const response = await fetch(`http://localhost:8080/api/vehicle/vehicles?availability=true&limit=100`, {
             method: "GET",
         });
 
@@ -13,10 +17,10 @@ async function loadVehicles() {
             return;
         }
 
-        const vehicles = await response.json();
+        const { vehicles } = await response.json();
         const vehicleSelect = document.getElementById("vehicleSelect");
         const vehicleList = document.getElementById("vehicleList");
-        if (vehicles === null || vehicles.length === 0) {
+        if (vehicles.length === 0) {
             vehicleSelect.innerHTML = "<option value=''>No vehicles available</option>";
             vehicleList.innerHTML = "<p>No vehicles available</p>";
             return;
@@ -24,6 +28,7 @@ async function loadVehicles() {
 
         // Populate the dropdown
         vehicles.forEach((vehicle) => {
+            vehiclesByID[vehicle.vehicle_id] = vehicle;
             const option = document.createElement("option");
             option.value = vehicle.vehicle_id;
             option.textContent = `${vehicle.model} (${vehicle.license_plate}) - ${vehicle.location}`;
@@ -34,7 +39,7 @@ async function loadVehicles() {
         vehicleList.innerHTML = vehicles
             .map(
                 (vehicle) =>
-                    `<p><strong>${vehicle.model}</strong> - License: ${vehicle.license_plate}, Location: ${vehicle.location}, Charge Level: ${vehicle.charge_level}%</p>`
+                    `<p><strong>${vehicle.model}</strong> - License: ${vehicle.license_plate}, Location: ${vehicle.location}, Charge Level: ${vehicle.charge_level}%, ${vehicle.cleanliness}</p>`
             )
             .join("");
     } catch (error) {
@@ -43,6 +48,33 @@ async function loadVehicles() {
     }
 }
 
+// Load stations into the drop-off selector
+async function loadStations() {
+    try {
+        const response = await fetch(`http://localhost:8080/api/vehicle/stations`, {
+            method: "GET",
+        });
+
+        if (!response.ok) {
+            return;
+        }
+
+        const stations = await response.json();
+        const dropoffSelect = document.getElementById("dropoffStation");
+        stations.forEach((station) => {
+            stationsByID[station.station_id] = station;
+            const option = document.createElement("option");
+            option.value = station.station_id;
+            option.textContent = station.one_way_fee > 0
+                ? `Return to ${station.name} ($${station.one_way_fee.toFixed(2)} one-way fee)`
+                : `Return to ${station.name}`;
+            dropoffSelect.appendChild(option);
+        });
+    } catch (error) {
+        console.error("Error loading stations:", error);
+    }
+}
+
 // Handle booking submission
 document.getElementById("bookingForm")?.addEventListener("submit", async function (e) {
     e.preventDefault();
@@ -69,21 +101,6 @@ document.getElementById("bookingForm")?.addEventListener("submit", async functio
             return;
         }
 
-        // Fetch user ID using the /user-id endpoint
-        const userIdResponse = await fetch("http://localhost:8080/api/user/user-id", {
-            method: "GET",
-            headers: {
-                Authorization: `Bearer ${token}`,
-            },
-        });
-
-        const userIdData = await userIdResponse.json();
-        console.log('User ID:', userIdData);
-        console.log(typeof(userIdData.user_id));
-        console.log(typeof(vehicleID));
-        console.log(typeof(startTime));
-        console.log(typeof(endTime));
-
         // Estimate cost before booking
         const estimateResponse = await fetch(`http://localhost:8080/api/billing/calculate-cost`, {
             method: "POST",
@@ -103,8 +120,18 @@ document.getElementById("bookingForm")?.addEventListener("submit", async functio
             return;
         }
 
+        // Returning to a different station adds that station's one-way fee
+        const dropoffStationID = formData.get("dropoff_station_id");
+        const vehicle = vehiclesByID[vehicleID];
+        let oneWayFee = 0;
+        if (dropoffStationID && vehicle && vehicle.station_id !== parseInt(dropoffStationID)) {
+            oneWayFee = stationsByID[dropoffStationID].one_way_fee;
+        }
+
         const confirmBooking = confirm(
-            `Estimated Cost: $${estimate.estimated_cost.toFixed(2)}. Do you want to proceed?`
+            oneWayFee > 0
+                ? `Estimated Cost: $${estimate.estimated_cost.toFixed(2)} plus a $${oneWayFee.toFixed(2)} one-way drop-off fee. Do you want to proceed?`
+                : `Estimated Cost: $${estimate.estimated_cost.toFixed(2)}. Do you want to proceed?`
         );
         const Amount = estimate.estimated_cost.toFixed(2);
         if (!confirmBooking) return;
@@ -117,18 +144,25 @@ document.getElementById("bookingForm")?.addEventListener("submit", async functio
                 Authorization: `Bearer ${token}`,
             },
             body: JSON.stringify({
-                user_id: parseInt(userIdData.user_id),
                 vehicle_id: parseInt(vehicleID),
                 start_time: toSQLFormat(startTime),
                 end_time: toSQLFormat(endTime),
+                charge_to: formData.get("charge_to"),
+                dropoff_station_id: dropoffStationID ? parseInt(dropoffStationID) : null,
+                planned_distance_km: formData.get("planned_distance_km") ? parseFloat(formData.get("planned_distance_km")) : null,
             }),
         });
 
-        const bookingResult = await bookingResponse.json();
+        // Refusals, such as a vehicle without enough range, come back as plain text
+        const bookingText = await bookingResponse.text();
         if (!bookingResponse.ok) {
-            alert(bookingResult.message || "Failed to book the vehicle.");
+            alert(bookingText || "Failed to book the vehicle.");
             return;
         }
+        const bookingResult = JSON.parse(bookingText);
+        if (bookingResult.range_warning) {
+            alert(bookingResult.range_warning);
+        }
 
         // Retrieve the reservation ID from the booking result
         const reservationResponse = await fetch(`http://localhost:8080/api/vehicle/find-reservationid`, {
@@ -138,7 +172,6 @@ document.getElementById("bookingForm")?.addEventListener("submit", async functio
                 Authorization: `Bearer ${token}`,
             },
             body: JSON.stringify({
-                user_id: parseInt(userIdData.user_id),
                 vehicle_id: parseInt(vehicleID),
                 start_time: toSQLFormat(startTime),
                 end_time: toSQLFormat(endTime),     
@@ -148,7 +181,7 @@ document.getElementById("bookingForm")?.addEventListener("submit", async functio
         const reservationData = await reservationResponse.json();
         console.log(reservationData);
         console.log('Reservation Data:', reservationData.reservation_id);
-        PaymentStatus = "Paid"; // Hardcoded payment status for now as theres no official payment method
+        PaymentStatus = "Pending"; // Charges stay pending until finance staff record the payment
         InvoiceID = generateInvoiceID(reservationData.reservation_id);
         console.log('Invoice ID:', InvoiceID);
 
@@ -168,6 +201,7 @@ document.getElementById("bookingForm")?.addEventListener("submit", async functio
             }),
         });
 
+        // The billing service adds the one-way fee to the amount charged
         const paymentResult = await paymentResponse.json();
         if (!paymentResponse.ok) {
             alert(paymentResult.message || "Failed to make payment.");
@@ -196,7 +230,6 @@ document.getElementById("bookingForm")?.addEventListener("submit", async functio
         console.log("Retrieved Vehicle Model:", modelData.vehicle_model);
         console.log(typeof(modelData.vehicle_model));
         console.log({
-            user_id: parseInt(userIdData.user_id),
             vehicle_model: modelData.vehicle_model, // Assuming this is fetched correctly
             start_time: toSQLFormat(startTime),
             end_time: toSQLFormat(endTime),
@@ -212,11 +245,10 @@ document.getElementById("bookingForm")?.addEventListener("submit", async functio
                 Authorization: `Bearer ${token}`,
             },
             body: JSON.stringify({
-                user_id: parseInt(userIdData.user_id),
                 vehicle_id: parseInt(vehicleID),
                 start_time: toSQLFormat(startTime),
                 end_time: toSQLFormat(endTime),
-                total_cost: Amount2,
+                total_cost: Amount2 + bookingResult.one_way_fee,
             }),
         });
         console.log(historyResponse);
@@ -266,5 +298,49 @@ function generateInvoiceID(reservationID) {
 }
 
 
+// Show available vehicles near the user's current position, nearest first
+document.getElementById("nearbyBtn").addEventListener("click", () => {
+    if (!navigator.geolocation) {
+        alert("Your browser cannot share your location.");
+        return;
+    }
+
+    navigator.geolocation.getCurrentPosition(async (position) => {
+        try {
+            const params = new URLSearchParams({
+                lat: position.coords.latitude,
+                lng: position.coords.longitude,
+                radius: 10,
+                availability: true,
+            });
+            const response = await fetch(`http://localhost:8080/api/vehicle/vehicles/nearby?${params}`, {
+                method: "GET",
+            });
+
+            if (!response.ok) {
+                alert("Failed to find nearby vehicles.");
+                return;
+            }
+
+            const vehicles = await response.json();
+            const vehicleList = document.getElementById("vehicleList");
+            if (vehicles.length === 0) {
+                vehicleList.innerHTML = "<p>No vehicles available within 10 km</p>";
+                return;
+            }
+            vehicleList.innerHTML = vehicles
+                .map(
+                    (vehicle) =>
+                        `<p><strong>${vehicle.model}</strong> - ${vehicle.distance_km.toFixed(1)} km away, License: ${vehicle.license_plate}, Location: ${vehicle.location}, Charge Level: ${vehicle.charge_level}%, ${vehicle.cleanliness}</p>`
+                )
+                .join("");
+        } catch (error) {
+            console.error("Error loading nearby vehicles:", error);
+            alert("An error occurred while finding nearby vehicles.");
+        }
+    }, () => alert("Unable to get your location."));
+});
+
 // Load vehicles on page load
 window.addEventListener("load", loadVehicles);
+window.addEventListener("load", loadStations);
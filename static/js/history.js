@@ -2,9 +2,13 @@ const API_USER = "/api/user";
 const API_VEHICLE = "/api/vehicle";
 
 let modifyReservationId = null; // Store the reservation ID being modified
+let reportReservationId = null; // Store the reservation ID being reported on
 
-// Fetch and display rental history
-async function loadRentalHistory() {
+let nextCursor = null; // Cursor for the next page of rental history
+
+// Fetch and display rental history. With append set, the next page is added
+// below the rows already shown.
+async function loadRentalHistory(append = false) {
     try {
         const token = localStorage.getItem("token");
         if (!token) {
@@ -13,7 +17,18 @@ async function loadRentalHistory() {
             return;
         }
 
-        const response = await fetch(`http://localhost:8080/api/user/rental-history`, {
+        // Filtering, sorting and paging are done by the server
+        const params = new URLSearchParams();
+        new FormData(document.getElementById("historyFilters")).forEach((value, key) => {
+            if (value !== "") {
+                params.append(key, value);
+            }
+        });
+        if (append && nextCursor) {
+            params.append("cursor", nextCursor);
+        }
+
+        const response = await fetch(`http://localhost:8080/api/user/rental-history?${params}`, {
             method: "GET",
             headers: {
                 Authorization: `Bearer ${token}`,
@@ -25,17 +40,22 @@ async function loadRentalHistory() {
             return;
         }
 
-        const history = await response.json();
-        console.log(history);
-        if (history === null || history.length === 0) {
+        const result = await response.json();
+        const history = result.rentals;
+        nextCursor = result.next_cursor;
+        document.getElementById("loadMore").style.display = nextCursor ? "inline-block" : "none";
+        renderSummary(result.summary);
+
+        const historyTable = document.getElementById("historyTable").querySelector("tbody");
+        if (!append) {
+            historyTable.innerHTML = "";
+        }
+        if (history.length === 0 && !append) {
             alert("You have no rental history.");
             return;
         }
 
-        const historyTable = document.getElementById("historyTable").querySelector("tbody");
-
         // Populate the rental history table
-        historyTable.innerHTML = "";
         history.forEach((entry) => {
             const row = document.createElement("tr");
 
@@ -48,7 +68,7 @@ async function loadRentalHistory() {
                     <button class="btn modify-btn" data-id="${entry.reservation_id}">Modify</button>
                     <button 
                         class="btn cancel-btn" 
-                        data-vehicle-id="${entry.vehicle_id}" 
+                        data-vehicle-model="${entry.vehicle_model}" 
                         data-start-time="${entry.start_time}" 
                         data-end-time="${entry.end_time}">
                         Cancel
@@ -56,31 +76,206 @@ async function loadRentalHistory() {
                 </td>
             `;
 
+            // The car can be controlled remotely while the booking is in progress
+            const now = new Date();
+            if (new Date(entry.start_time) <= now && now < new Date(entry.end_time)) {
+                const actions = row.lastElementChild;
+                ["unlock", "lock", "honk"].forEach((command) => {
+                    const button = document.createElement("button");
+                    button.className = "btn";
+                    button.textContent = command.charAt(0).toUpperCase() + command.slice(1);
+                    button.addEventListener("click", () => sendVehicleCommand(entry.vehicle_id, command));
+                    actions.appendChild(button);
+                });
+            }
+
+            // Problems can be reported once the trip starts and for two days after it ends
+            const reportUntil = new Date(entry.end_time);
+            reportUntil.setHours(reportUntil.getHours() + 48);
+            if (new Date(entry.start_time) <= now && now < reportUntil) {
+                const button = document.createElement("button");
+                button.className = "btn";
+                button.textContent = "Report a problem";
+                button.addEventListener("click", () => openReportModal(entry.reservation_id));
+                row.lastElementChild.appendChild(button);
+            }
+
+            row.querySelector(".modify-btn").addEventListener("click", (e) => openModifyModal(e.target.dataset.id));
+            row.querySelector(".cancel-btn").addEventListener("click", (e) => {
+                const button = e.target;
+                cancelReservation(button.dataset.vehicleModel, button.dataset.startTime, button.dataset.endTime);
+            });
+
             historyTable.appendChild(row);
         });
+    } catch (error) {
+        console.error("Error fetching rental history:", error);
+        alert("An error occurred while loading your rental history.");
+    }
+}
 
-        // Attach event listeners for Modify and Cancel buttons
-        document.querySelectorAll(".modify-btn").forEach((button) => {
-            button.addEventListener("click", () => openModifyModal(button.dataset.id));
+// Send unlock, lock or honk to the vehicle of a booking in progress
+async function sendVehicleCommand(vehicleId, command) {
+    try {
+        const token = localStorage.getItem("token");
+        const response = await fetch(`http://localhost:8080/api/vehicle/vehicles/${vehicleId}/commands`, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+                Authorization: `Bearer ${token}`,
+            },
+            body: JSON.stringify({ command }),
         });
 
-        document.querySelectorAll(".cancel-btn").forEach((button) => {
-            button.addEventListener("click", () => {
-                const vehicleModel = history[0].vehicle_model;
-                console.log(vehicleModel);
-                const startTime = button.dataset.startTime;
-                console.log(startTime);
-                const endTime = button.dataset.endTime;
-                console.log(endTime); 
-                cancelReservation(vehicleModel, startTime, endTime);
-            });
+        const text = await response.text();
+        if (!response.ok) {
+            let message = text;
+            try {
+                message = JSON.parse(text).detail || text;
+            } catch (e) {
+                // Plain-text error
+            }
+            alert(`Command failed: ${message}`);
+            return;
+        }
+        alert(JSON.parse(text).detail);
+    } catch (error) {
+        console.error("Error sending vehicle command:", error);
+        alert("An error occurred. Please try again.");
+    }
+}
+
+// Show totals for every rental matching the filters
+function renderSummary(summary) {
+    document.getElementById("historySummary").innerHTML = `
+        <p>Trips: ${summary.total_trips}</p>
+        <p>Hours: ${summary.total_hours.toFixed(1)}</p>
+        <p>Total spend: $${summary.total_spend.toFixed(2)}</p>
+        <p>Favourite model: ${summary.favourite_model || "-"}</p>
+    `;
+}
+
+// Re-run the query when the filters change
+document.getElementById("historyFilters").addEventListener("submit", function (e) {
+    e.preventDefault();
+    loadRentalHistory();
+});
+
+document.getElementById("loadMore").addEventListener("click", () => loadRentalHistory(true));
+
+// Download every rental matching the current filters as CSV
+document.getElementById("downloadCsv").addEventListener("click", async () => {
+    const params = new URLSearchParams({ format: "csv" });
+    new FormData(document.getElementById("historyFilters")).forEach((value, key) => {
+        if (value !== "") {
+            params.append(key, value);
+        }
+    });
+    await downloadFile(`http://localhost:8080/api/user/rental-history?${params}`, "rental-history.csv");
+});
+
+// Create (or replace) the secret calendar feed URL for upcoming bookings
+document.getElementById("calendarFeed").addEventListener("click", async () => {
+    if (!confirm("This creates a new calendar link and disables any previous one. Continue?")) {
+        return;
+    }
+
+    try {
+        const response = await fetch(`http://localhost:8080/api/vehicle/calendar-feed`, {
+            method: "POST",
+            headers: {
+                Authorization: `Bearer ${localStorage.getItem("token")}`,
+            },
         });
+
+        if (!response.ok) {
+            alert("Failed to create calendar feed.");
+            return;
+        }
+
+        const result = await response.json();
+        document.getElementById("calendarUrl").textContent = `${result.message} ${result.url}`;
     } catch (error) {
-        console.error("Error fetching rental history:", error);
-        alert("An error occurred while loading your rental history.");
+        console.error("Error creating calendar feed:", error);
+        alert("An error occurred. Please try again.");
+    }
+});
+
+// Fetch a file with the auth header and save it
+async function downloadFile(url, filename) {
+    try {
+        const response = await fetch(url, {
+            method: "GET",
+            headers: {
+                Authorization: `Bearer ${localStorage.getItem("token")}`,
+            },
+        });
+
+        if (!response.ok) {
+            alert("Failed to download file.");
+            return;
+        }
+
+        const link = document.createElement("a");
+        link.href = URL.createObjectURL(await response.blob());
+        link.download = filename;
+        link.click();
+        URL.revokeObjectURL(link.href);
+    } catch (error) {
+        console.error("Error downloading file:", error);
+        alert("An error occurred while downloading.");
     }
 }
 
+// Open the modal for reporting a problem with a trip
+function openReportModal(reservationId) {
+    reportReservationId = reservationId;
+    document.getElementById("reportForm").reset();
+    document.getElementById("reportModal").style.display = "block";
+}
+
+// Close the report modal
+function closeReportModal() {
+    document.getElementById("reportModal").style.display = "none";
+    reportReservationId = null;
+}
+
+// Send a damage, cleanliness or low charge report with its photos
+document.getElementById("reportForm").addEventListener("submit", async function (e) {
+    e.preventDefault();
+
+    const formData = new FormData(this);
+    formData.append("reservation_id", reportReservationId);
+    if (document.getElementById("reportPhotos").files.length > 5) {
+        alert("Please attach at most 5 photos.");
+        return;
+    }
+
+    try {
+        const token = localStorage.getItem("token");
+        // The browser sets the multipart Content-Type itself
+        const response = await fetch(`http://localhost:8080/api/vehicle/damage-reports`, {
+            method: "POST",
+            headers: {
+                Authorization: `Bearer ${token}`,
+            },
+            body: formData,
+        });
+
+        const text = await response.text();
+        if (!response.ok) {
+            alert(text || "Failed to send the report.");
+            return;
+        }
+
+        alert(JSON.parse(text).message);
+        closeReportModal();
+    } catch (error) {
+        console.error("Error sending report:", error);
+        alert("An error occurred. Please try again.");
+    }
+});
+
 // Open the modal for modifying a reservation
 function openModifyModal(reservationId) {
     modifyReservationId = reservationId; // Set the reservation ID
@@ -156,21 +351,6 @@ async function cancelReservation(vehicleModel, startTime, endTime) {
             return;
         }
 
-        // Fetch user ID
-        const userIdResponse = await fetch("http://localhost:8080/api/user/user-id", {
-            method: "GET",
-            headers: {
-                Authorization: `Bearer ${token}`,
-            },
-        });
-
-        const userIdData = await userIdResponse.json();
-        if (!userIdResponse.ok) {
-            alert("Failed to fetch user ID.");
-            return;
-        }
-
-
         // Retrieve the reservation ID from the booking result
         const vehIDResponse = await fetch(`http://localhost:8080/api/vehicle/retrieve-vehid`, {
             method: "POST",
@@ -194,7 +374,6 @@ async function cancelReservation(vehicleModel, startTime, endTime) {
                 Authorization: `Bearer ${token}`,
             },
             body: JSON.stringify({
-                user_id: parseInt(userIdData.user_id),
                 vehicle_id: parseInt(vehIDData.vehicle_id),
                 start_time: toSQLFormat(startTime),
                 end_time: toSQLFormat(endTime),     
@@ -241,4 +420,4 @@ function toSQLFormat(isoString) {
 }
 
 // Load rental history on page load
-window.addEventListener("load", loadRentalHistory);
+window.addEventListener("load", () => loadRentalHistory());
@@ -12,34 +12,21 @@ async function loadInvoices() {
             return;
         }
 
-        // Fetch user ID using the /user-id endpoint
-        const userIdResponse = await fetch("http://localhost:8080/api/user/user-id", {
+        // Fetch invoices for the logged-in user
+        const response = await fetch(`http://localhost:8080/api/billing/invoices/user`, {
             method: "GET",
             headers: {
-                Authorization: `Bearer ${token}`,
+                Authorization: `Bearer ${token}`,   
             },
         });
 
-        if (!userIdResponse.ok) {
-            alert("Failed to retrieve user information. Please log in again.");
+        if (response.status === 401) {
+            alert("Your session has expired. Please log in again.");
             localStorage.removeItem("token");
             window.location.href = "../index.html";
             return;
         }
 
-        const userIdData = await userIdResponse.json();
-        const userID = userIdData.user_id; // Extract the user_id from the response
-        console.log(userID)
-        const userID2 = parseInt(userID);  // Convert the user_id to an integer
-
-        // Fetch invoices for the user using the user ID
-        const response = await fetch(`http://localhost:8080/api/billing/invoices/user/${userID}`, {
-            method: "GET",
-            headers: {
-                Authorization: `Bearer ${token}`,   
-            },
-        });
-
         if (!response.ok) {
             alert("Failed to fetch invoices. Please try again later.");
             return;
@@ -69,5 +56,31 @@ async function loadInvoices() {
     }
 }
 
+// Download all invoices as CSV
+document.getElementById("downloadCsv").addEventListener("click", async () => {
+    try {
+        const response = await fetch(`http://localhost:8080/api/billing/invoices/user?format=csv`, {
+            method: "GET",
+            headers: {
+                Authorization: `Bearer ${localStorage.getItem("token")}`,
+            },
+        });
+
+        if (!response.ok) {
+            alert("Failed to download invoices.");
+            return;
+        }
+
+        const link = document.createElement("a");
+        link.href = URL.createObjectURL(await response.blob());
+        link.download = "invoices.csv";
+        link.click();
+        URL.revokeObjectURL(link.href);
+    } catch (error) {
+        console.error("Error downloading invoices:", error);
+        alert("An error occurred while downloading invoices.");
+    }
+});
+
 // Load invoices on page load
 window.addEventListener("load", loadInvoices);
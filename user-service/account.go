@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"auth"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Account self-service settings
+const (
+	minPasswordLength = 8
+	emailChangeTTL    = 24 * time.Hour
+)
+
+// ChangePasswordHandler changes the user's password after re-checking the current one
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	currentPassword := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+	if len(newPassword) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("New password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	if !checkPassword(w, db, authUser.ID, currentPassword) {
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	// A new password signs out every existing session, including this one
+	_, err = db.Exec(`UPDATE users SET password_hash = ?, token_version = token_version + 1 WHERE user_id = ?`, hashedPassword, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password updated successfully. Please log in again."})
+}
+
+// RequestEmailChangeHandler starts an email change. The new address only
+// takes effect once the code sent to it is confirmed with VerifyEmailChangeHandler.
+func RequestEmailChangeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	newEmail := strings.TrimSpace(r.FormValue("new_email"))
+	if _, err := mail.ParseAddress(newEmail); err != nil || strings.ContainsAny(newEmail, "<> ") {
+		http.Error(w, "A valid email address is required", http.StatusBadRequest)
+		return
+	}
+
+	if !checkPassword(w, db, authUser.ID, r.FormValue("password")) {
+		return
+	}
+
+	var taken bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)`, newEmail).Scan(&taken)
+	if err != nil {
+		http.Error(w, "Failed to check email", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Email address is already in use", http.StatusConflict)
+		return
+	}
+
+	code, err := newVerificationCode()
+	if err != nil {
+		http.Error(w, "Failed to generate verification code", http.StatusInternalServerError)
+		return
+	}
+
+	// Only the latest request per user is kept
+	_, err = db.Exec(`
+		INSERT INTO email_changes (user_id, new_email, code_hash, expires_at) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE new_email = VALUES(new_email), code_hash = VALUES(code_hash), expires_at = VALUES(expires_at)`,
+		authUser.ID, newEmail, hashVerificationCode(code), time.Now().Add(emailChangeTTL))
+	if err != nil {
+		http.Error(w, "Failed to start email change", http.StatusInternalServerError)
+		return
+	}
+
+	// The code only goes to the new address; the old one is told of the change
+	go sendNotification(newEmail, "Confirm your new email address",
+		fmt.Sprintf("Your email verification code is %s. It expires in %d hours.", code, int(emailChangeTTL.Hours())))
+	go sendNotification(authUser.Email, "Your account email is being changed",
+		fmt.Sprintf("A change of your account email to %s was requested. If this was not you, change your password and contact support.", newEmail))
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification code sent to the new email address"})
+}
+
+// VerifyEmailChangeHandler completes a pending email change
+func VerifyEmailChangeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	code := strings.TrimSpace(r.FormValue("code"))
+	if code == "" {
+		http.Error(w, "Verification code is required", http.StatusBadRequest)
+		return
+	}
+
+	var newEmail, codeHash string
+	var expiresAt time.Time
+	err := db.QueryRow(`SELECT new_email, code_hash, expires_at FROM email_changes WHERE user_id = ?`, authUser.ID).
+		Scan(&newEmail, &codeHash, &expiresAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No email change is pending", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch email change", http.StatusInternalServerError)
+		return
+	}
+	if time.Now().After(expiresAt) || hashVerificationCode(code) != codeHash {
+		http.Error(w, "Invalid or expired verification code", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update email", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Tokens carry the email, so existing sessions are ended along with it
+	if _, err := tx.Exec(`UPDATE users SET email = ?, token_version = token_version + 1 WHERE user_id = ?`, newEmail, authUser.ID); err != nil {
+		// The unique index rejects addresses claimed since the request was made
+		http.Error(w, "Failed to update email", http.StatusConflict)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM email_changes WHERE user_id = ?`, authUser.ID); err != nil {
+		http.Error(w, "Failed to update email", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email updated successfully. Please log in again."})
+}
+
+// DeleteAccountHandler deletes the user's account. The users row is kept but
+// anonymised so billing and rental_history remain intact for accounting.
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	if authUser.ImpersonatorID != 0 {
+		http.Error(w, "Accounts cannot be deleted while impersonating", http.StatusForbidden)
+		return
+	}
+
+	if !checkPassword(w, db, authUser.ID, r.FormValue("password")) {
+		return
+	}
+
+	if err := anonymiseUser(db, authUser.ID); err != nil {
+		log.Printf("Failed to delete account %d: %v", authUser.ID, err)
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+
+	accountLimiter.Reset(strings.ToLower(authUser.Email))
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted successfully"})
+}
+
+// anonymiseUser strips personal data from a user, including their licence
+// image, data exports and damage report photos, cancels their upcoming
+// reservations and disables the account
+func anonymiseUser(db *sql.DB, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Free vehicles held by upcoming bookings before cancelling them
+	_, err = tx.Exec(`
+		UPDATE vehicles
+		JOIN reservations ON reservations.vehicle_id = vehicles.vehicle_id
+		SET vehicles.availability = TRUE
+		WHERE reservations.user_id = ? AND reservations.status = 'Booked' AND reservations.start_time > NOW()`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE reservations SET status = 'Cancelled' WHERE user_id = ? AND status = 'Booked' AND start_time > NOW()`, userID)
+	if err != nil {
+		return err
+	}
+
+	// An empty password hash never matches, so the account cannot log in
+	_, err = tx.Exec(`
+		UPDATE users SET
+			email = CONCAT('deleted-', user_id, '@deleted.invalid'),
+			password_hash = '',
+			phone_number = '',
+			country_code = '',
+			phone_verified = FALSE,
+			totp_secret = NULL,
+			totp_enabled = FALSE,
+			disabled = TRUE,
+			token_version = token_version + 1,
+			deleted_at = NOW()
+		WHERE user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
+
+	// Licence images and export archives are personal data and are removed
+	// with their records
+	files, err := queryPaths(tx, `
+		SELECT image_path FROM driver_licences WHERE user_id = ? AND image_path IS NOT NULL
+		UNION ALL
+		SELECT file_path FROM data_exports WHERE user_id = ? AND file_path IS NOT NULL`, userID, userID)
+	if err != nil {
+		return err
+	}
+
+	var orgID int
+	var orgRole string
+	err = tx.QueryRow(`SELECT org_id, role FROM organisation_members WHERE user_id = ?`, userID).Scan(&orgID, &orgRole)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM organisation_members WHERE user_id = ?`,
+		`DELETE FROM driver_licences WHERE user_id = ?`,
+		`DELETE FROM user_roles WHERE user_id = ?`,
+		`DELETE FROM user_identities WHERE user_id = ?`,
+		`DELETE FROM api_keys WHERE user_id = ?`,
+		`DELETE FROM calendar_feeds WHERE user_id = ?`,
+		`DELETE FROM recovery_codes WHERE user_id = ?`,
+		`DELETE FROM email_changes WHERE user_id = ?`,
+		`DELETE FROM data_exports WHERE user_id = ?`,
+	} {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+
+	// An organisation left without an admin passes to its longest-standing member
+	if orgRole == "admin" {
+		var admins int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM organisation_members WHERE org_id = ? AND role = 'admin'`, orgID).Scan(&admins); err != nil {
+			return err
+		}
+		if admins == 0 {
+			if _, err := tx.Exec(`UPDATE organisation_members SET role = 'admin' WHERE org_id = ? ORDER BY joined_at LIMIT 1`, orgID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s for user %d: %v", path, userID, err)
+		}
+	}
+
+	// Damage report photos are stored by the vehicle service, which removes
+	// them once the account is deleted. The reports are kept with the
+	// vehicle's history.
+	photosURL := serviceURL("VEHICLE_SERVICE_URL", "http://localhost:8083") + "/damage-reports/photos"
+	if err := deleteAsUser(photosURL, auth.User{ID: userID}); err != nil {
+		log.Printf("Failed to remove damage report photos for user %d: %v", userID, err)
+	}
+	return nil
+}
+
+// deleteAsUser sends a DELETE to another service on behalf of the user using
+// signed identity headers, like fetchAsUser
+func deleteAsUser(url string, user auth.User) error {
+	if len(gatewayKey) == 0 {
+		return errors.New("GATEWAY_SECRET is not configured")
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	auth.SetIdentityHeaders(req.Header, gatewayKey, user)
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// queryPaths returns the file paths selected by query
+func queryPaths(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// checkPassword verifies the user's current password, writing a 401 when it
+// does not match
+func checkPassword(w http.ResponseWriter, db *sql.DB, userID int, password string) bool {
+	var hashedPassword string
+	err := db.QueryRow(`SELECT password_hash FROM users WHERE user_id = ?`, userID).Scan(&hashedPassword)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// newVerificationCode returns a random code for confirming an email address
+func newVerificationCode() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashVerificationCode hashes a verification code for storage
+func hashVerificationCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
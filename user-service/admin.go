@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// ImpersonationTTL is how long an impersonation token stays valid
+const ImpersonationTTL = time.Hour
+
+// maxImpersonationReason is the longest reason, in characters, that fits in
+// audit_log.details after its "reason=" prefix
+const maxImpersonationReason = 248
+
+// AdminUser struct for the admin user listing
+type AdminUser struct {
+	UserID         int      `json:"user_id"`
+	Email          string   `json:"email"`
+	PhoneNumber    string   `json:"phone_number"`
+	MembershipTier string   `json:"membership_tier"`
+	Roles          []string `json:"roles"`
+	Disabled       bool     `json:"disabled"`
+	CreatedAt      string   `json:"created_at"`
+}
+
+// AuditEntry struct for audit log records
+type AuditEntry struct {
+	ID           int    `json:"id"`
+	ActorID      int    `json:"actor_id"`
+	Action       string `json:"action"`
+	TargetUserID *int   `json:"target_user_id"`
+	Details      string `json:"details"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// ListUsersHandler lists all users with their roles
+func ListUsersHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT users.user_id, users.email, users.phone_number, users.membership_tier, users.disabled,
+			DATE_FORMAT(users.created_at, '%Y-%m-%d %H:%i:%s'), COALESCE(GROUP_CONCAT(user_roles.role ORDER BY user_roles.role), '')
+		FROM users
+		LEFT JOIN user_roles ON user_roles.user_id = users.user_id
+		GROUP BY users.user_id
+		ORDER BY users.user_id`)
+	if err != nil {
+		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var user AdminUser
+		var roles string
+		if err := rows.Scan(&user.UserID, &user.Email, &user.PhoneNumber, &user.MembershipTier, &user.Disabled, &user.CreatedAt, &roles); err != nil {
+			http.Error(w, "Error scanning user data", http.StatusInternalServerError)
+			return
+		}
+		user.Roles = []string{}
+		if roles != "" {
+			user.Roles = strings.Split(roles, ",")
+		}
+		users = append(users, user)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(users)
+}
+
+// ChangeTierHandler changes a user's membership tier
+func ChangeTierHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	targetID, ok := targetUserID(w, r, db)
+	if !ok {
+		return
+	}
+
+	tier := r.FormValue("membership_tier")
+	if tier != "Basic" && tier != "Premium" && tier != "VIP" {
+		http.Error(w, "Invalid membership tier", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`UPDATE users SET membership_tier = ? WHERE user_id = ?`, tier, targetID)
+	if err != nil {
+		http.Error(w, "Failed to update membership tier", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(db, authUser.ID, "change_tier", targetID, "membership_tier="+tier)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Membership tier updated successfully"})
+}
+
+// SetRolesHandler replaces a user's roles with a comma-separated list
+func SetRolesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	targetID, ok := targetUserID(w, r, db)
+	if !ok {
+		return
+	}
+
+	var roles []string
+	for _, role := range strings.Split(r.FormValue("roles"), ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		if !auth.ValidRole(role) {
+			http.Error(w, fmt.Sprintf("Invalid role: %s", role), http.StatusBadRequest)
+			return
+		}
+		roles = append(roles, role)
+	}
+	if len(roles) == 0 {
+		http.Error(w, "At least one role is required", http.StatusBadRequest)
+		return
+	}
+
+	// Admins cannot lock themselves out
+	if targetID == authUser.ID && !(auth.User{Roles: roles}).HasRole(auth.RoleAdmin) {
+		http.Error(w, "You cannot remove your own admin role", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE user_id = ?`, targetID); err != nil {
+		http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+		return
+	}
+	for _, role := range roles {
+		if _, err := tx.Exec(`INSERT IGNORE INTO user_roles (user_id, role) VALUES (?, ?)`, targetID, role); err != nil {
+			http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Tokens carry roles, so sign the user out everywhere
+	if _, err := tx.Exec(`UPDATE users SET token_version = token_version + 1 WHERE user_id = ?`, targetID); err != nil {
+		http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(db, authUser.ID, "set_roles", targetID, "roles="+strings.Join(roles, ","))
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Roles updated successfully. The user has been signed out and gets them at their next login."})
+}
+
+// SetDisabledHandler disables or re-enables a user account
+func SetDisabledHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, disabled bool) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	targetID, ok := targetUserID(w, r, db)
+	if !ok {
+		return
+	}
+
+	if targetID == authUser.ID {
+		http.Error(w, "You cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	// Disabling also revokes every session the user has open
+	_, err := db.Exec(`UPDATE users SET disabled = ?, token_version = token_version + IF(?, 1, 0) WHERE user_id = ?`, disabled, disabled, targetID)
+	if err != nil {
+		http.Error(w, "Failed to update account status", http.StatusInternalServerError)
+		return
+	}
+
+	action := "enable_account"
+	message := "Account enabled successfully"
+	if disabled {
+		action = "disable_account"
+		message = "Account disabled successfully"
+	}
+	recordAudit(db, authUser.ID, action, targetID, "")
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// UnlockAccountHandler clears a login lockout on a user's account
+func UnlockAccountHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	targetID, ok := targetUserID(w, r, db)
+	if !ok {
+		return
+	}
+
+	var email string
+	if err := db.QueryRow(`SELECT email FROM users WHERE user_id = ?`, targetID).Scan(&email); err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	accountLimiter.Reset(strings.ToLower(email))
+	recordAudit(db, authUser.ID, "unlock_account", targetID, "")
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account unlocked successfully"})
+}
+
+// UnlockIPHandler clears a login lockout on a client IP address
+func UnlockIPHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	ip := strings.TrimSpace(r.FormValue("ip"))
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "A valid IP address is required", http.StatusBadRequest)
+		return
+	}
+
+	ipLimiter.Reset(ip)
+	recordAudit(db, authUser.ID, "unlock_ip", 0, "ip="+ip)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "IP address unlocked successfully"})
+}
+
+// ImpersonateHandler issues a short-lived token that lets an admin act as
+// another user for support purposes
+func ImpersonateHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	targetID, ok := targetUserID(w, r, db)
+	if !ok {
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		http.Error(w, "A reason is required to impersonate a user", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(reason) > maxImpersonationReason {
+		http.Error(w, fmt.Sprintf("reason must be at most %d characters", maxImpersonationReason), http.StatusBadRequest)
+		return
+	}
+
+	target := auth.User{ID: targetID, ImpersonatorID: authUser.ID}
+	var disabled bool
+	err := db.QueryRow(`SELECT email, membership_tier, token_version, disabled FROM users WHERE user_id = ?`, targetID).
+		Scan(&target.Email, &target.Tier, &target.TokenVersion, &disabled)
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if disabled {
+		http.Error(w, "Cannot impersonate a disabled account", http.StatusBadRequest)
+		return
+	}
+
+	target.Roles, err = loadUserRoles(db, targetID)
+	if err != nil {
+		http.Error(w, "Failed to load user roles", http.StatusInternalServerError)
+		return
+	}
+	if target.HasRole(auth.RoleAdmin) {
+		http.Error(w, "Cannot impersonate another admin", http.StatusForbidden)
+		return
+	}
+
+	token, err := auth.GenerateTokenWithTTL(jwtKey, target, ImpersonationTTL)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	// The token is only handed out once the impersonation is on record
+	if err := recordAudit(db, authUser.ID, "impersonate", targetID, "reason="+reason); err != nil {
+		http.Error(w, "Failed to record impersonation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":      token,
+		"expires_at": time.Now().Add(ImpersonationTTL).Format(time.RFC3339),
+	})
+}
+
+// AuditLogHandler returns the most recent audit log entries
+func AuditLogHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	limit := 100
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	rows, err := db.Query(`
+		SELECT id, actor_id, action, target_user_id, COALESCE(details, ''), DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT ?`, limit)
+	if err != nil {
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var target sql.NullInt64
+		if err := rows.Scan(&entry.ID, &entry.ActorID, &entry.Action, &target, &entry.Details, &entry.CreatedAt); err != nil {
+			http.Error(w, "Error scanning audit log", http.StatusInternalServerError)
+			return
+		}
+		if target.Valid {
+			id := int(target.Int64)
+			entry.TargetUserID = &id
+		}
+		entries = append(entries, entry)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
+
+// targetUserID parses the user_id path variable and checks the user exists
+func targetUserID(w http.ResponseWriter, r *http.Request, db *sql.DB) (int, bool) {
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE user_id = ?)`, userID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, false
+	}
+	return userID, true
+}
+
+// loadUserRoles returns the roles granted to a user, defaulting to customer
+func loadUserRoles(db *sql.DB, userID int) ([]string, error) {
+	rows, err := db.Query(`SELECT role FROM user_roles WHERE user_id = ? ORDER BY role`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(roles) == 0 {
+		roles = []string{auth.RoleCustomer}
+	}
+	return roles, nil
+}
+
+// recordAudit writes an entry to the audit log. Failures are logged and
+// returned; callers whose action has already happened may ignore them.
+func recordAudit(db *sql.DB, actorID int, action string, targetUserID int, details string) error {
+	var target interface{}
+	if targetUserID != 0 {
+		target = targetUserID
+	}
+
+	_, err := db.Exec(`INSERT INTO audit_log (actor_id, action, target_user_id, details) VALUES (?, ?, ?, NULLIF(?, ''))`,
+		actorID, action, target, details)
+	if err != nil {
+		log.Printf("Failed to record audit entry %s by %d: %v", action, actorID, err)
+		return err
+	}
+	log.Printf("Audit: user %d performed %s on user %d %s", actorID, action, targetUserID, details)
+	return nil
+}
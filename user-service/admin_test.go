@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// impersonate asks, as admin 1, to impersonate customer 7 for reason, with
+// audit entries written by insertAudit
+func impersonate(t *testing.T, reason string, insertAudit func(details string) error) *httptest.ResponseRecorder {
+	t.Helper()
+	savedKey := jwtKey
+	jwtKey = []byte("admin-test-key")
+	t.Cleanup(func() { jwtKey = savedKey })
+
+	db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT EXISTS(SELECT 1 FROM users WHERE user_id = ?)"):
+			return fakeResult{columns: []string{"exists"}, rows: [][]driver.Value{{true}}}, nil
+		case strings.HasPrefix(query, "SELECT email, membership_tier, token_version, disabled FROM users"):
+			return fakeResult{
+				columns: []string{"email", "membership_tier", "token_version", "disabled"},
+				rows:    [][]driver.Value{{"driver@example.com", "Basic", int64(0), false}},
+			}, nil
+		case strings.HasPrefix(query, "SELECT role FROM user_roles"):
+			return fakeResult{columns: []string{"role"}, rows: [][]driver.Value{{auth.RoleCustomer}}}, nil
+		case strings.HasPrefix(query, "INSERT INTO audit_log"):
+			if err := insertAudit(args[3].(string)); err != nil {
+				return fakeResult{}, err
+			}
+			return fakeResult{affected: 1}, nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+	})
+
+	form := url.Values{"reason": {reason}}
+	r := httptest.NewRequest("POST", "/admin/users/7/impersonate", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = mux.SetURLVars(r, map[string]string{"user_id": "7"})
+	r = r.WithContext(auth.WithUser(r.Context(), auth.User{ID: 1, Roles: []string{auth.RoleAdmin}}))
+	w := httptest.NewRecorder()
+	ImpersonateHandler(w, r, db)
+	return w
+}
+
+func TestImpersonateIsAudited(t *testing.T) {
+	var recorded string
+	w := impersonate(t, "Support ticket 42", func(details string) error {
+		recorded = details
+		return nil
+	})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"token"`) {
+		t.Fatalf("impersonate: %d %s", w.Code, w.Body)
+	}
+	if recorded != "reason=Support ticket 42" {
+		t.Errorf("audit details %q", recorded)
+	}
+}
+
+func TestImpersonateWithoutAuditGivesNoToken(t *testing.T) {
+	w := impersonate(t, "Support ticket 42", func(string) error { return errors.New("audit_log is unavailable") })
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "token") {
+		t.Errorf("impersonate with a failed audit: %d %s, want 500 without a token", w.Code, w.Body)
+	}
+}
+
+func TestImpersonateReasonFitsAuditLog(t *testing.T) {
+	audited := false
+	w := impersonate(t, strings.Repeat("é", maxImpersonationReason+1), func(string) error {
+		audited = true
+		return nil
+	})
+	if w.Code != http.StatusBadRequest || audited {
+		t.Errorf("over-long reason: %d %s, audited %v, want 400", w.Code, w.Body, audited)
+	}
+
+	w = impersonate(t, strings.Repeat("é", maxImpersonationReason), func(details string) error {
+		if n := len([]rune(details)); n > 255 {
+			return fmt.Errorf("details of %d characters overflow VARCHAR(255)", n)
+		}
+		return nil
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("longest reason: %d %s, want 200", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAPIKeysPerUser limits how many active keys one user can hold
+const maxAPIKeysPerUser = 10
+
+// APIKey struct for listing a user's API keys. The key itself is never stored.
+type APIKey struct {
+	KeyID      int      `json:"key_id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  *string  `json:"expires_at"`
+	LastUsedAt *string  `json:"last_used_at"`
+	RevokedAt  *string  `json:"revoked_at"`
+}
+
+// CreateAPIKeyHandler creates a scoped API key and returns it once
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	if authUser.ImpersonatorID != 0 {
+		http.Error(w, "API keys cannot be created while impersonating", http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 100 {
+		http.Error(w, "A name of up to 100 characters is required", http.StatusBadRequest)
+		return
+	}
+
+	var scopes []string
+	for _, scope := range strings.Split(r.FormValue("scopes"), ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !auth.ValidScope(scope) {
+			http.Error(w, "Invalid scope: "+scope, http.StatusBadRequest)
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt sql.NullTime
+	if days := r.FormValue("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 || n > 365 {
+			http.Error(w, "expires_in_days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		expiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, n), Valid: true}
+	}
+
+	var active int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM api_keys
+		WHERE user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())`, authUser.ID).Scan(&active)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	if active >= maxAPIKeysPerUser {
+		http.Error(w, "Too many active API keys. Revoke one first.", http.StatusConflict)
+		return
+	}
+
+	key, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO api_keys (user_id, name, key_prefix, key_hash, scopes, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		authUser.ID, name, prefix, hash, strings.Join(scopes, ","), expiresAt)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	keyID, _ := result.LastInsertId()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key_id":  keyID,
+		"api_key": key,
+		"scopes":  scopes,
+		"message": "Store this key now; it will not be shown again",
+	})
+}
+
+// ListAPIKeysHandler lists the user's API keys without the secret part
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	rows, err := db.Query(`
+		SELECT key_id, name, key_prefix, scopes, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s'),
+			DATE_FORMAT(expires_at, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(last_used_at, '%Y-%m-%d %H:%i:%s'),
+			DATE_FORMAT(revoked_at, '%Y-%m-%d %H:%i:%s')
+		FROM api_keys
+		WHERE user_id = ?
+		ORDER BY created_at DESC`, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch API keys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		var expiresAt, lastUsedAt, revokedAt sql.NullString
+		if err := rows.Scan(&key.KeyID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+			http.Error(w, "Error scanning API key data", http.StatusInternalServerError)
+			return
+		}
+		key.Prefix = auth.APIKeyPrefix + key.Prefix
+		key.Scopes = strings.Split(scopes, ",")
+		key.ExpiresAt = nullableString(expiresAt)
+		key.LastUsedAt = nullableString(lastUsedAt)
+		key.RevokedAt = nullableString(revokedAt)
+		keys = append(keys, key)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RevokeAPIKeyHandler revokes one of the user's API keys
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	keyID, err := strconv.Atoi(mux.Vars(r)["key_id"])
+	if err != nil {
+		http.Error(w, "Invalid key ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE api_keys SET revoked_at = NOW() WHERE key_id = ? AND user_id = ? AND revoked_at IS NULL`, keyID, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+}
+
+// nullableString converts a nullable column to a JSON null or string
+func nullableString(value sql.NullString) *string {
+	if !value.Valid {
+		return nil
+	}
+	return &value.String
+}
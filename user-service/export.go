@@ -0,0 +1,494 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// Export job statuses
+const (
+	exportPending    = "pending"
+	exportProcessing = "processing"
+	exportCompleted  = "completed"
+	exportFailed     = "failed"
+	exportExpired    = "expired"
+)
+
+// Export housekeeping: a job still unfinished after exportTimeout was
+// interrupted, and completed archives are deleted after exportRetention
+const (
+	exportTimeout         = 15 * time.Minute
+	exportRetention       = 7 * 24 * time.Hour
+	exportJanitorInterval = 5 * time.Minute
+)
+
+// serviceClient is used for calls to the other services
+var serviceClient = &http.Client{Timeout: 15 * time.Second}
+
+// DataExport struct for export job status
+type DataExport struct {
+	ExportID    int     `json:"export_id"`
+	Status      string  `json:"status"`
+	Error       string  `json:"error,omitempty"`
+	CreatedAt   string  `json:"created_at"`
+	CompletedAt *string `json:"completed_at"`
+	DownloadURL string  `json:"download_url,omitempty"`
+}
+
+// exportArchive is the document handed to the user
+type exportArchive struct {
+	GeneratedAt   string          `json:"generated_at"`
+	Profile       json.RawMessage `json:"profile"`
+	DriverLicence *DriverLicence  `json:"driver_licence"`
+	Reservations  json.RawMessage `json:"reservations"`
+	RentalHistory json.RawMessage `json:"rental_history"`
+	Invoices      json.RawMessage `json:"invoices"`
+}
+
+// RequestExportHandler starts generating a personal data export in the background
+func RequestExportHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	if authUser.ImpersonatorID != 0 {
+		http.Error(w, "Data exports cannot be requested while impersonating", http.StatusForbidden)
+		return
+	}
+
+	// Only one export may be in progress at a time. A job older than
+	// exportTimeout was interrupted and no longer counts.
+	var running bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM data_exports
+			WHERE user_id = ? AND status IN (?, ?) AND created_at >= NOW() - INTERVAL ? SECOND)`,
+		authUser.ID, exportPending, exportProcessing, int(exportTimeout/time.Second)).Scan(&running)
+	if err != nil {
+		http.Error(w, "Failed to check existing exports", http.StatusInternalServerError)
+		return
+	}
+	if running {
+		http.Error(w, "An export is already being generated", http.StatusConflict)
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO data_exports (user_id, status) VALUES (?, ?)`, authUser.ID, exportPending)
+	if err != nil {
+		http.Error(w, "Failed to create export", http.StatusInternalServerError)
+		return
+	}
+	exportID, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, "Failed to create export", http.StatusInternalServerError)
+		return
+	}
+
+	go runExport(db, int(exportID), authUser)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"export_id":  exportID,
+		"status":     exportPending,
+		"status_url": fmt.Sprintf("/api/user/export/%d", exportID),
+	})
+}
+
+// ListExportsHandler lists the authenticated user's exports
+func ListExportsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	rows, err := db.Query(`
+		SELECT export_id, status, COALESCE(error, ''), DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s'),
+			DATE_FORMAT(completed_at, '%Y-%m-%d %H:%i:%s')
+		FROM data_exports
+		WHERE user_id = ?
+		ORDER BY export_id DESC`, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch exports", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	exports := []DataExport{}
+	for rows.Next() {
+		export, err := scanExport(rows)
+		if err != nil {
+			http.Error(w, "Error scanning export data", http.StatusInternalServerError)
+			return
+		}
+		exports = append(exports, export)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(exports)
+}
+
+// ExportStatusHandler reports the status of one export
+func ExportStatusHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	exportID, err := strconv.Atoi(mux.Vars(r)["export_id"])
+	if err != nil {
+		http.Error(w, "Invalid export ID", http.StatusBadRequest)
+		return
+	}
+
+	row := db.QueryRow(`
+		SELECT export_id, status, COALESCE(error, ''), DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s'),
+			DATE_FORMAT(completed_at, '%Y-%m-%d %H:%i:%s')
+		FROM data_exports
+		WHERE export_id = ? AND user_id = ?`, exportID, authUser.ID)
+	export, err := scanExport(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch export", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(export)
+}
+
+// DownloadExportHandler serves a completed export as JSON, or as a ZIP with
+// one file per section when format=zip
+func DownloadExportHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	exportID, err := strconv.Atoi(mux.Vars(r)["export_id"])
+	if err != nil {
+		http.Error(w, "Invalid export ID", http.StatusBadRequest)
+		return
+	}
+
+	var status string
+	var filePath sql.NullString
+	err = db.QueryRow(`SELECT status, file_path FROM data_exports WHERE export_id = ? AND user_id = ?`, exportID, authUser.ID).
+		Scan(&status, &filePath)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch export", http.StatusInternalServerError)
+		return
+	}
+	if status == exportExpired {
+		http.Error(w, "Export has expired; request a new one", http.StatusGone)
+		return
+	}
+	if status != exportCompleted || !filePath.Valid {
+		http.Error(w, "Export is not ready yet", http.StatusConflict)
+		return
+	}
+
+	data, err := os.ReadFile(filePath.String)
+	if err != nil {
+		http.Error(w, "Export file is no longer available", http.StatusGone)
+		return
+	}
+
+	name := fmt.Sprintf("ecs-export-%d", exportID)
+	if r.URL.Query().Get("format") != "zip" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, name))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+
+	var archive exportArchive
+	if err := json.Unmarshal(data, &archive); err != nil {
+		http.Error(w, "Export file is corrupt", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+	w.WriteHeader(http.StatusOK)
+	if err := writeExportZip(w, archive); err != nil {
+		log.Printf("Failed to write export %d: %v", exportID, err)
+	}
+}
+
+// runExport gathers the user's data from every service and stores it on disk.
+// The results are only recorded while the job is still processing, as the
+// janitor fails jobs that run past exportTimeout.
+func runExport(db *sql.DB, exportID int, user auth.User) {
+	db.Exec(`UPDATE data_exports SET status = ? WHERE export_id = ? AND status = ?`, exportProcessing, exportID, exportPending)
+
+	filePath, err := buildExport(db, exportID, user)
+	if err != nil {
+		log.Printf("Export %d for user %d failed: %v", exportID, user.ID, err)
+		message := err.Error()
+		if len(message) > 255 {
+			message = message[:255]
+		}
+		db.Exec(`UPDATE data_exports SET status = ?, error = ?, completed_at = NOW() WHERE export_id = ? AND status = ?`,
+			exportFailed, message, exportID, exportProcessing)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE data_exports SET status = ?, file_path = ?, completed_at = NOW() WHERE export_id = ? AND status = ?`,
+		exportCompleted, filePath, exportID, exportProcessing)
+	if err != nil {
+		log.Printf("Failed to mark export %d completed: %v", exportID, err)
+		os.Remove(filePath)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		log.Printf("Export %d finished after it was abandoned; discarding it", exportID)
+		os.Remove(filePath)
+	}
+}
+
+// startExportJanitor fails export jobs that were interrupted, for example by
+// a restart, so the user can request another, and deletes expired archives
+func startExportJanitor(db *sql.DB) {
+	go func() {
+		for {
+			runExportJanitor(db)
+			time.Sleep(exportJanitorInterval)
+		}
+	}()
+}
+
+// runExportJanitor runs one pass of the export janitor
+func runExportJanitor(db *sql.DB) {
+	_, err := db.Exec(`
+		UPDATE data_exports SET status = ?, error = 'Export was interrupted; please request a new one', completed_at = NOW()
+		WHERE status IN (?, ?) AND created_at < NOW() - INTERVAL ? SECOND`,
+		exportFailed, exportPending, exportProcessing, int(exportTimeout/time.Second))
+	if err != nil {
+		log.Printf("Failed to fail interrupted exports: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT export_id, file_path FROM data_exports
+		WHERE status = ? AND completed_at < NOW() - INTERVAL ? SECOND`,
+		exportCompleted, int(exportRetention/time.Second))
+	if err != nil {
+		log.Printf("Failed to find expired exports: %v", err)
+		return
+	}
+	expired := map[int]sql.NullString{}
+	for rows.Next() {
+		var exportID int
+		var filePath sql.NullString
+		if err := rows.Scan(&exportID, &filePath); err != nil {
+			rows.Close()
+			log.Printf("Failed to read expired exports: %v", err)
+			return
+		}
+		expired[exportID] = filePath
+	}
+	rows.Close()
+
+	for exportID, filePath := range expired {
+		if filePath.Valid {
+			if err := os.Remove(filePath.String); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Failed to delete export %d: %v", exportID, err)
+				continue
+			}
+		}
+		if _, err := db.Exec(`UPDATE data_exports SET status = ?, file_path = NULL WHERE export_id = ?`, exportExpired, exportID); err != nil {
+			log.Printf("Failed to mark export %d expired: %v", exportID, err)
+		}
+	}
+}
+
+// buildExport collects every section of the export and writes it to a file
+func buildExport(db *sql.DB, exportID int, user auth.User) (string, error) {
+	archive := exportArchive{GeneratedAt: time.Now().UTC().Format(time.RFC3339)}
+
+	profile, err := exportProfile(db, user.ID)
+	if err != nil {
+		return "", fmt.Errorf("profile: %w", err)
+	}
+	archive.Profile = profile
+
+	licence, err := loadLicence(db, user.ID)
+	if err == nil {
+		archive.DriverLicence = &licence
+	} else if err != sql.ErrNoRows {
+		return "", fmt.Errorf("driver licence: %w", err)
+	}
+
+	vehicleURL := serviceURL("VEHICLE_SERVICE_URL", "http://localhost:8083")
+	billingURL := serviceURL("BILLING_SERVICE_URL", "http://localhost:8082")
+
+	if archive.Reservations, err = fetchAsUser(vehicleURL+"/reservations", user); err != nil {
+		return "", fmt.Errorf("reservations: %w", err)
+	}
+	if archive.RentalHistory, err = fetchAsUser(vehicleURL+"/rental-history", user); err != nil {
+		return "", fmt.Errorf("rental history: %w", err)
+	}
+	if archive.Invoices, err = fetchAsUser(billingURL+"/invoices/user", user); err != nil {
+		return "", fmt.Errorf("invoices: %w", err)
+	}
+
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	dir := os.Getenv("EXPORT_DIR")
+	if dir == "" {
+		dir = "exports"
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	// A random suffix keeps file names unguessable
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	filePath := filepath.Join(dir, fmt.Sprintf("export-%d-%s.json", exportID, hex.EncodeToString(suffix)))
+	if err := os.WriteFile(filePath, data, 0o600); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// exportProfile returns the user's own record and roles
+func exportProfile(db *sql.DB, userID int) (json.RawMessage, error) {
+	var profile struct {
+		UserID         int      `json:"user_id"`
+		Email          string   `json:"email"`
+		PhoneNumber    string   `json:"phone_number"`
+		CountryCode    string   `json:"country_code"`
+		MembershipTier string   `json:"membership_tier"`
+		PhoneVerified  bool     `json:"phone_verified"`
+		TOTPEnabled    bool     `json:"two_factor_enabled"`
+		Roles          []string `json:"roles"`
+		CreatedAt      string   `json:"created_at"`
+		UpdatedAt      string   `json:"updated_at"`
+	}
+
+	err := db.QueryRow(`
+		SELECT user_id, email, phone_number, country_code, membership_tier, phone_verified, totp_enabled,
+			DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(updated_at, '%Y-%m-%d %H:%i:%s')
+		FROM users WHERE user_id = ?`, userID).
+		Scan(&profile.UserID, &profile.Email, &profile.PhoneNumber, &profile.CountryCode, &profile.MembershipTier,
+			&profile.PhoneVerified, &profile.TOTPEnabled, &profile.CreatedAt, &profile.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if profile.Roles, err = loadUserRoles(db, userID); err != nil {
+		return nil, err
+	}
+	return json.Marshal(profile)
+}
+
+// fetchAsUser calls another service on behalf of the user using signed
+// identity headers, the same way the gateway does
+func fetchAsUser(url string, user auth.User) (json.RawMessage, error) {
+	if len(gatewayKey) == 0 {
+		return nil, errors.New("GATEWAY_SECRET is not configured")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.SetIdentityHeaders(req.Header, gatewayKey, user)
+
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("%s returned invalid JSON", url)
+	}
+	return body, nil
+}
+
+// writeExportZip writes one JSON file per export section
+func writeExportZip(w io.Writer, archive exportArchive) error {
+	licenceJSON, err := json.Marshal(archive.DriverLicence)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	files := []struct {
+		Name string
+		Data json.RawMessage
+	}{
+		{"profile.json", archive.Profile},
+		{"driver_licence.json", licenceJSON},
+		{"reservations.json", archive.Reservations},
+		{"rental_history.json", archive.RentalHistory},
+		{"invoices.json", archive.Invoices},
+	}
+
+	for _, file := range files {
+		f, err := zw.Create(file.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(file.Data); err != nil {
+			return err
+		}
+	}
+
+	readme, err := zw.Create("README.txt")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(readme, "Personal data export generated at %s.\n", archive.GeneratedAt)
+	return zw.Close()
+}
+
+// scanExport reads a data_exports row selected by the export handlers
+func scanExport(row interface{ Scan(...interface{}) error }) (DataExport, error) {
+	var export DataExport
+	var completedAt sql.NullString
+	err := row.Scan(&export.ExportID, &export.Status, &export.Error, &export.CreatedAt, &completedAt)
+	if err != nil {
+		return export, err
+	}
+	if completedAt.Valid {
+		export.CompletedAt = &completedAt.String
+	}
+	if export.Status == exportCompleted {
+		export.DownloadURL = fmt.Sprintf("/api/user/export/%d/download", export.ExportID)
+	}
+	return export, nil
+}
+
+// serviceURL returns the base URL of another service from the environment
+func serviceURL(env, fallback string) string {
+	if url := os.Getenv(env); url != "" {
+		return url
+	}
+	return fallback
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+)
+
+// fakeResult is what a fakeDB query returns: rows for SELECTs, affected for
+// everything else
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// fakeQueryFunc answers one statement. Unexpected statements should return an
+// error so the handler under test fails loudly.
+type fakeQueryFunc func(query string, args []driver.Value) (fakeResult, error)
+
+// newFakeDB returns a *sql.DB whose statements are answered by query, so
+// handlers can run without MySQL
+func newFakeDB(query fakeQueryFunc) *sql.DB {
+	return sql.OpenDB(fakeConnector{query})
+}
+
+type fakeConnector struct{ query fakeQueryFunc }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("fakeDB is opened with newFakeDB")
+}
+
+type fakeConn struct{ query fakeQueryFunc }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	conn  fakeConn
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result, err := s.conn.query(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result, err := s.conn.query(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: result.columns, rows: result.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -3,11 +3,17 @@ module user-service
 go 1.23.3
 
 require (
+	auth v0.0.0
 	github.com/go-sql-driver/mysql v1.8.1 // direct
 	github.com/golang-jwt/jwt/v4 v4.5.1 // direct
 	github.com/gorilla/mux v1.8.1 // direct
 	github.com/joho/godotenv v1.5.1 // direct
 	golang.org/x/crypto v0.30.0 // direct
+	mock-oidc v0.0.0
 )
 
 require filippo.io/edwards25519 v1.1.0 // indirect
+
+replace auth => ../auth
+
+replace mock-oidc => ../mock-oidc
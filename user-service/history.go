@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+)
+
+// Page sizes for rental history
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// historySorts maps the sort parameter to the expression rentals are ordered by
+var historySorts = map[string]string{
+	"start_time": "rental_history.start_time",
+	"total_cost": "rental_history.total_cost",
+	"duration":   "TIMESTAMPDIFF(MINUTE, rental_history.start_time, rental_history.end_time)",
+}
+
+// RentalHistory struct
+type RentalHistory struct {
+	ID           int     `json:"id"`
+	VehicleID    int     `json:"vehicle_id"`
+	VehicleModel string  `json:"vehicle_model"`
+	StartTime    string  `json:"start_time"`
+	EndTime      string  `json:"end_time"`
+	TotalCost    float64 `json:"total_cost"`
+}
+
+// RentalSummary struct for totals over every rental matching the filters
+type RentalSummary struct {
+	TotalTrips     int     `json:"total_trips"`
+	TotalHours     float64 `json:"total_hours"`
+	TotalSpend     float64 `json:"total_spend"`
+	FavouriteModel *string `json:"favourite_model"`
+}
+
+// historyCursor marks the last rental of a page. It records the sort it was
+// issued for so it cannot be replayed against a different ordering.
+type historyCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int    `json:"id"`
+}
+
+// RentalHistoryHandler retrieves a page of the user's rental history with a
+// summary. Supported query parameters: from and to (YYYY-MM-DD), model,
+// min_cost, max_cost, sort (start_time, total_cost or duration), order
+// (asc or desc), limit and cursor. format=csv downloads every matching rental.
+func RentalHistoryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	// Authenticated user injected by the auth middleware
+	authUser, _ := auth.UserFromContext(r.Context())
+	query := r.URL.Query()
+
+	where, args, err := historyFilter(query, authUser.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sortName := query.Get("sort")
+	if sortName == "" {
+		sortName = "start_time"
+	}
+	column, ok := historySorts[sortName]
+	if !ok {
+		http.Error(w, "sort must be start_time, total_cost or duration", http.StatusBadRequest)
+		return
+	}
+	order := strings.ToLower(query.Get("order"))
+	if order == "" {
+		order = "desc"
+	}
+	if order != "asc" && order != "desc" {
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	sortKey := sortName + ":" + order
+
+	// CSV downloads contain every matching rental, for expense claims
+	if query.Get("format") == "csv" {
+		writeRentalHistoryCSV(w, db, where, args, column+" "+order)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Keyset pagination: continue strictly after the cursor row, using the row
+	// ID to break ties between equal sort values
+	pageWhere := where
+	pageArgs := append([]interface{}{}, args...)
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeHistoryCursor(value)
+		if err != nil || cursor.Sort != sortKey {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		cmp := "<"
+		if order == "asc" {
+			cmp = ">"
+		}
+		pageWhere += fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND rental_history.id %s ?))", column, cmp, column, cmp)
+		pageArgs = append(pageArgs, cursor.Key, cursor.Key, cursor.ID)
+	}
+
+	// One extra row tells us whether another page follows
+	rows, err := db.Query(`
+		SELECT rental_history.id, rental_history.vehicle_id, vehicles.model,
+			rental_history.start_time, rental_history.end_time, rental_history.total_cost, CAST(`+column+` AS CHAR)
+		FROM rental_history
+		JOIN vehicles ON vehicles.vehicle_id = rental_history.vehicle_id
+		WHERE `+pageWhere+`
+		ORDER BY `+column+` `+order+`, rental_history.id `+order+`
+		LIMIT ?`, append(pageArgs, limit+1)...)
+	if err != nil {
+		http.Error(w, "Failed to fetch rental history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rentals := []RentalHistory{}
+	var lastKey string
+	var nextCursor *string
+	for rows.Next() {
+		if len(rentals) == limit {
+			last := rentals[len(rentals)-1]
+			cursor := encodeHistoryCursor(historyCursor{Sort: sortKey, Key: lastKey, ID: last.ID})
+			nextCursor = &cursor
+			break
+		}
+
+		var rental RentalHistory
+		if err := rows.Scan(&rental.ID, &rental.VehicleID, &rental.VehicleModel, &rental.StartTime, &rental.EndTime, &rental.TotalCost, &lastKey); err != nil {
+			http.Error(w, "Error scanning rental history", http.StatusInternalServerError)
+			return
+		}
+		rentals = append(rentals, rental)
+	}
+
+	summary, err := rentalSummary(db, where, args)
+	if err != nil {
+		http.Error(w, "Failed to summarise rental history", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rentals":     rentals,
+		"next_cursor": nextCursor,
+		"summary":     summary,
+	})
+}
+
+// writeRentalHistoryCSV writes every rental matching the filter as a CSV download
+func writeRentalHistoryCSV(w http.ResponseWriter, db *sql.DB, where string, args []interface{}, orderBy string) {
+	rows, err := db.Query(`
+		SELECT rental_history.id, vehicles.model, vehicles.license_plate,
+			DATE_FORMAT(rental_history.start_time, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(rental_history.end_time, '%Y-%m-%d %H:%i:%s'),
+			TIMESTAMPDIFF(MINUTE, rental_history.start_time, rental_history.end_time), rental_history.total_cost
+		FROM rental_history
+		JOIN vehicles ON vehicles.vehicle_id = rental_history.vehicle_id
+		WHERE `+where+`
+		ORDER BY `+orderBy+`, rental_history.id`, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch rental history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="rental-history.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"rental_id", "vehicle_model", "license_plate", "start_time", "end_time", "duration_minutes", "total_cost"})
+	for rows.Next() {
+		var id, minutes int
+		var model, plate, start, end string
+		var cost float64
+		if err := rows.Scan(&id, &model, &plate, &start, &end, &minutes, &cost); err != nil {
+			// Headers are already sent, so the truncated file is all we can do
+			log.Printf("Error scanning rental history for CSV: %v", err)
+			break
+		}
+		out.Write([]string{strconv.Itoa(id), model, plate, start, end, strconv.Itoa(minutes), strconv.FormatFloat(cost, 'f', 2, 64)})
+	}
+	out.Flush()
+}
+
+// historyFilter builds the WHERE clause and arguments for the history filters
+func historyFilter(query url.Values, userID int) (string, []interface{}, error) {
+	conditions := []string{"rental_history.user_id = ?"}
+	args := []interface{}{userID}
+
+	if value := query.Get("from"); value != "" {
+		from, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return "", nil, errors.New("from must be a date (YYYY-MM-DD)")
+		}
+		conditions = append(conditions, "rental_history.start_time >= ?")
+		args = append(args, from.Format("2006-01-02"))
+	}
+	if value := query.Get("to"); value != "" {
+		to, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return "", nil, errors.New("to must be a date (YYYY-MM-DD)")
+		}
+		// The to date is inclusive
+		conditions = append(conditions, "rental_history.start_time < ?")
+		args = append(args, to.AddDate(0, 0, 1).Format("2006-01-02"))
+	}
+	if model := strings.TrimSpace(query.Get("model")); model != "" {
+		conditions = append(conditions, "vehicles.model = ?")
+		args = append(args, model)
+	}
+	for _, bound := range []struct{ param, op string }{{"min_cost", ">="}, {"max_cost", "<="}} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		cost, err := strconv.ParseFloat(value, 64)
+		if err != nil || cost < 0 {
+			return "", nil, fmt.Errorf("%s must be a non-negative number", bound.param)
+		}
+		conditions = append(conditions, "rental_history.total_cost "+bound.op+" ?")
+		args = append(args, cost)
+	}
+
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// rentalSummary totals every rental matching the filter. The favourite model
+// is the most rented one, with ties going to the most recently rented.
+func rentalSummary(db *sql.DB, where string, args []interface{}) (RentalSummary, error) {
+	var summary RentalSummary
+	var favourite sql.NullString
+	err := db.QueryRow(`
+		SELECT COUNT(*),
+			COALESCE(SUM(TIMESTAMPDIFF(MINUTE, rental_history.start_time, rental_history.end_time)), 0) / 60,
+			COALESCE(SUM(rental_history.total_cost), 0),
+			(SELECT vehicles.model
+				FROM rental_history
+				JOIN vehicles ON vehicles.vehicle_id = rental_history.vehicle_id
+				WHERE `+where+`
+				GROUP BY vehicles.model
+				ORDER BY COUNT(*) DESC, MAX(rental_history.start_time) DESC
+				LIMIT 1)
+		FROM rental_history
+		JOIN vehicles ON vehicles.vehicle_id = rental_history.vehicle_id
+		WHERE `+where, append(append([]interface{}{}, args...), args...)...).
+		Scan(&summary.TotalTrips, &summary.TotalHours, &summary.TotalSpend, &favourite)
+	if err != nil {
+		return summary, err
+	}
+	if favourite.Valid {
+		summary.FavouriteModel = &favourite.String
+	}
+	return summary, nil
+}
+
+// encodeHistoryCursor serialises a cursor for the next_cursor field
+func encodeHistoryCursor(cursor historyCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeHistoryCursor parses a cursor sent back by the client
+func decodeHistoryCursor(value string) (historyCursor, error) {
+	var cursor historyCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// Licence review statuses
+const (
+	licencePending  = "pending"
+	licenceApproved = "approved"
+	licenceRejected = "rejected"
+)
+
+// maxLicenceImageSize limits uploaded licence images
+const maxLicenceImageSize = 5 << 20
+
+// allowedLicenceImageTypes maps accepted upload content types to file extensions
+var allowedLicenceImageTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"application/pdf": ".pdf",
+}
+
+// DriverLicence struct for licence details
+type DriverLicence struct {
+	UserID          int     `json:"user_id"`
+	LicenceNumber   string  `json:"licence_number"`
+	Country         string  `json:"country"`
+	ExpiryDate      string  `json:"expiry_date"`
+	HasImage        bool    `json:"has_image"`
+	Status          string  `json:"status"`
+	RejectionReason *string `json:"rejection_reason"`
+	SubmittedAt     string  `json:"submitted_at"`
+	ReviewedAt      *string `json:"reviewed_at"`
+}
+
+// SubmitLicenceHandler stores or replaces the user's driver's licence. Any
+// change sends the licence back for review.
+func SubmitLicenceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxLicenceImageSize+1<<20)
+
+	licenceNumber := strings.TrimSpace(r.FormValue("licence_number"))
+	country := strings.ToUpper(strings.TrimSpace(r.FormValue("country")))
+	expiry, err := time.Parse("2006-01-02", r.FormValue("expiry_date"))
+	if licenceNumber == "" || len(licenceNumber) > 50 || len(country) != 2 || err != nil {
+		http.Error(w, "licence_number, a two-letter country code and expiry_date (YYYY-MM-DD) are required", http.StatusBadRequest)
+		return
+	}
+	if expiry.Before(time.Now().Truncate(24 * time.Hour)) {
+		http.Error(w, "Licence has already expired", http.StatusBadRequest)
+		return
+	}
+
+	var imagePath sql.NullString
+	file, _, err := r.FormFile("image")
+	if err == nil {
+		defer file.Close()
+		path, status, err := saveLicenceImage(file, authUser.ID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		imagePath = sql.NullString{String: path, Valid: true}
+	} else if err != http.ErrMissingFile {
+		http.Error(w, "Invalid image upload", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		removeUnsavedImage(imagePath)
+		http.Error(w, "Failed to save licence", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// A new image replaces the previous one, whose file is removed once the
+	// replacement is saved
+	var oldPath sql.NullString
+	err = tx.QueryRow(`SELECT image_path FROM driver_licences WHERE user_id = ? FOR UPDATE`, authUser.ID).Scan(&oldPath)
+	if err != nil && err != sql.ErrNoRows {
+		removeUnsavedImage(imagePath)
+		http.Error(w, "Failed to save licence", http.StatusInternalServerError)
+		return
+	}
+
+	// Keep the previous image when no new one is uploaded
+	_, err = tx.Exec(`
+		INSERT INTO driver_licences (user_id, licence_number, country, expiry_date, image_path, status)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			licence_number = VALUES(licence_number),
+			country = VALUES(country),
+			expiry_date = VALUES(expiry_date),
+			image_path = COALESCE(VALUES(image_path), image_path),
+			status = VALUES(status),
+			rejection_reason = NULL,
+			reviewed_by = NULL,
+			reviewed_at = NULL,
+			submitted_at = NOW()`,
+		authUser.ID, licenceNumber, country, expiry.Format("2006-01-02"), imagePath, licencePending)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		removeUnsavedImage(imagePath)
+		http.Error(w, "Failed to save licence", http.StatusInternalServerError)
+		return
+	}
+	if imagePath.Valid && oldPath.Valid && oldPath.String != imagePath.String {
+		if err := os.Remove(oldPath.String); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove replaced licence image %s: %v", oldPath.String, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Licence submitted for review", "status": licencePending})
+}
+
+// GetLicenceHandler returns the user's own licence and review status
+func GetLicenceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	licence, err := loadLicence(db, authUser.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No licence on file", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch licence", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(licence)
+}
+
+// ListLicencesHandler lists licences for operators, filtered by status
+// (pending by default)
+func ListLicencesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = licencePending
+	}
+	if status != licencePending && status != licenceApproved && status != licenceRejected {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(licenceSelect+` WHERE status = ? ORDER BY submitted_at`, status)
+	if err != nil {
+		http.Error(w, "Failed to fetch licences", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	licences := []DriverLicence{}
+	for rows.Next() {
+		licence, err := scanLicence(rows)
+		if err != nil {
+			http.Error(w, "Error scanning licence data", http.StatusInternalServerError)
+			return
+		}
+		licences = append(licences, licence)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(licences)
+}
+
+// ReviewLicenceHandler lets an operator approve or reject a licence
+func ReviewLicenceHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	status := r.FormValue("status")
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if status != licenceApproved && status != licenceRejected {
+		http.Error(w, "Status must be approved or rejected", http.StatusBadRequest)
+		return
+	}
+	if status == licenceRejected && reason == "" {
+		http.Error(w, "A reason is required when rejecting a licence", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE driver_licences
+		SET status = ?, rejection_reason = NULLIF(?, ''), reviewed_by = ?, reviewed_at = NOW()
+		WHERE user_id = ?`, status, reason, authUser.ID, userID)
+	if err != nil {
+		http.Error(w, "Failed to update licence", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Licence not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(db, authUser.ID, "review_licence", userID, "status="+status)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Licence " + status})
+}
+
+// LicenceImageHandler serves a licence image to operators
+func LicenceImageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var imagePath sql.NullString
+	err = db.QueryRow(`SELECT image_path FROM driver_licences WHERE user_id = ?`, userID).Scan(&imagePath)
+	if err != nil || !imagePath.Valid {
+		http.Error(w, "Licence image not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "inline")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, imagePath.String)
+}
+
+// licenceSelect selects the columns read by scanLicence
+const licenceSelect = `
+	SELECT user_id, licence_number, country, DATE_FORMAT(expiry_date, '%Y-%m-%d'), image_path IS NOT NULL, status,
+		rejection_reason, DATE_FORMAT(submitted_at, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(reviewed_at, '%Y-%m-%d %H:%i:%s')
+	FROM driver_licences`
+
+// loadLicence fetches one user's licence
+func loadLicence(db *sql.DB, userID int) (DriverLicence, error) {
+	return scanLicence(db.QueryRow(licenceSelect+` WHERE user_id = ?`, userID))
+}
+
+// scanLicence reads a row selected with licenceSelect
+func scanLicence(row interface{ Scan(...interface{}) error }) (DriverLicence, error) {
+	var licence DriverLicence
+	var reason, reviewedAt sql.NullString
+	err := row.Scan(&licence.UserID, &licence.LicenceNumber, &licence.Country, &licence.ExpiryDate, &licence.HasImage,
+		&licence.Status, &reason, &licence.SubmittedAt, &reviewedAt)
+	if err != nil {
+		return licence, err
+	}
+	if reason.Valid {
+		licence.RejectionReason = &reason.String
+	}
+	if reviewedAt.Valid {
+		licence.ReviewedAt = &reviewedAt.String
+	}
+	return licence, nil
+}
+
+// saveLicenceImage writes an uploaded image to local storage, returning the
+// path or an error message and status code
+func saveLicenceImage(file io.Reader, userID int) (string, int, error) {
+	data, err := io.ReadAll(io.LimitReader(file, maxLicenceImageSize+1))
+	if err != nil {
+		return "", http.StatusBadRequest, errors.New("Invalid image upload")
+	}
+	if len(data) > maxLicenceImageSize {
+		return "", http.StatusRequestEntityTooLarge, fmt.Errorf("Image must be at most %d MB", maxLicenceImageSize>>20)
+	}
+
+	// Trust the file contents rather than the client-supplied type or name
+	ext, ok := allowedLicenceImageTypes[http.DetectContentType(data)]
+	if !ok {
+		return "", http.StatusUnsupportedMediaType, errors.New("Image must be a JPEG, PNG or PDF")
+	}
+
+	dir := filepath.Join(uploadDir(), "licences")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", http.StatusInternalServerError, errors.New("Failed to store image")
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", http.StatusInternalServerError, errors.New("Failed to store image")
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s%s", userID, hex.EncodeToString(suffix), ext))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", http.StatusInternalServerError, errors.New("Failed to store image")
+	}
+	return path, http.StatusOK, nil
+}
+
+// uploadDir returns the local directory for uploaded files
+func uploadDir() string {
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return "uploads"
+}
+
+// removeUnsavedImage deletes an uploaded licence image whose licence could not
+// be saved
+func removeUnsavedImage(path sql.NullString) {
+	if path.Valid {
+		os.Remove(path.String)
+	}
+}
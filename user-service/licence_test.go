@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"auth"
+)
+
+// submitLicence uploads a new licence image for user 7, whose stored licence
+// has oldPath as its image, and returns the response and the image path saved
+func submitLicence(t *testing.T, oldPath string, upsertErr error) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	var saved string
+	db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.HasPrefix(query, "SELECT image_path FROM driver_licences"):
+			return fakeResult{columns: []string{"image_path"}, rows: [][]driver.Value{{oldPath}}}, nil
+		case strings.Contains(query, "INSERT INTO driver_licences"):
+			saved, _ = args[4].(string)
+			return fakeResult{affected: 2}, upsertErr
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+	})
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("licence_number", "S1234567A")
+	form.WriteField("country", "sg")
+	form.WriteField("expiry_date", "2099-01-01")
+	part, _ := form.CreateFormFile("image", "licence.png")
+	png.Encode(part, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/licence", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = r.WithContext(auth.WithUser(r.Context(), auth.User{ID: 7}))
+	w := httptest.NewRecorder()
+	SubmitLicenceHandler(w, r, db)
+	return w, saved
+}
+
+func TestSubmitLicenceReplacesImage(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	oldPath := filepath.Join(os.Getenv("UPLOAD_DIR"), "old.png")
+	if err := os.WriteFile(oldPath, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, saved := submitLicence(t, oldPath, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("submit: %d %s", w.Code, w.Body)
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("replaced image is still on disk: %v", err)
+	}
+	if _, err := os.Stat(saved); err != nil {
+		t.Errorf("new image is missing: %v", err)
+	}
+}
+
+func TestSubmitLicenceKeepsImageWhenSaveFails(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	oldPath := filepath.Join(os.Getenv("UPLOAD_DIR"), "old.png")
+	if err := os.WriteFile(oldPath, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, saved := submitLicence(t, oldPath, fmt.Errorf("database is unavailable"))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("submit: %d %s, want 500", w.Code, w.Body)
+	}
+	if _, err := os.Stat(oldPath); err != nil {
+		t.Errorf("image still on file was removed: %v", err)
+	}
+	if _, err := os.Stat(saved); !os.IsNotExist(err) {
+		t.Errorf("image of the unsaved licence was left on disk: %v", err)
+	}
+}
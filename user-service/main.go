@@ -8,9 +8,10 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
-	"time"
+	"strings"
+
+	"auth"
 
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"golang.org/x/crypto/bcrypt"
@@ -21,15 +22,12 @@ import (
 // JWT secret key
 var jwtKey []byte
 
+// Shared secret for verifying identity headers signed by the gateway
+var gatewayKey []byte
+
 // Temporary OTP storage
 var otpStore = make(map[string]string)
 
-// Claims structure for JWT
-type Claims struct {
-	Email string `json:"email"`
-	jwt.RegisteredClaims
-}
-
 // User struct for profile data
 type User struct {
 	Email          string `json:"email"`
@@ -39,14 +37,6 @@ type User struct {
 	PhoneVerified  bool   `json:"phone_verified"`
 }
 
-// RentalHistory struct
-type RentalHistory struct {
-	VehicleModel string  `json:"vehicle_model"`
-	StartTime    string  `json:"start_time"`
-	EndTime      string  `json:"end_time"`
-	TotalCost    float64 `json:"total_cost"`
-}
-
 func main() {
 	// Load environment variables
 	err := godotenv.Load(".env")
@@ -56,6 +46,8 @@ func main() {
 
 	dbDSN := os.Getenv("DB_DSN")
 	jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
+	gatewayKey = []byte(os.Getenv("GATEWAY_SECRET"))
+	oidcProviders = loadOIDCProviders()
 
 	// Connect to the database
 	db, err := sql.Open("mysql", dbDSN)
@@ -74,14 +66,93 @@ func main() {
 	// User management endpoints
 	r.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) { RegisterHandler(w, r, db) }).Methods("POST")
 	r.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) { LoginHandler(w, r, db) }).Methods("POST")
-	r.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) { ProfileHandler(w, r, db) }).Methods("GET")
-	r.HandleFunc("/user-id", func(w http.ResponseWriter, r *http.Request) { GetUserIDHandler(w, r, db) }).Methods("GET")
+	r.HandleFunc("/login/2fa", func(w http.ResponseWriter, r *http.Request) { LoginTOTPHandler(w, r, db) }).Methods("POST")
+
+	// External OpenID Connect login
+	r.HandleFunc("/oauth/providers", ListOIDCProvidersHandler).Methods("GET")
+	r.HandleFunc("/oauth/callback", func(w http.ResponseWriter, r *http.Request) { OIDCCallbackHandler(w, r, db) }).Methods("GET")
+	r.HandleFunc("/oauth/{provider}/start", func(w http.ResponseWriter, r *http.Request) { StartOIDCLoginHandler(w, r, db) }).Methods("GET")
+
+	authenticator := auth.New(jwtKey, gatewayKey).WithSessions(auth.NewSessionStore(db)).WithAudit(auth.NewAuditStore(db))
+
+	// Profile reads also accept API keys with read:profile
+	readProfile := r.NewRoute().Subrouter()
+	readProfile.Use(authenticator.WithAPIKeys(auth.NewAPIKeyStore(db)).Middleware, auth.RequireScope(auth.ScopeReadProfile))
+	readProfile.HandleFunc("/profile", func(w http.ResponseWriter, r *http.Request) { ProfileHandler(w, r, db) }).Methods("GET")
+
+	// Routes below require a valid JWT
+	protected := r.NewRoute().Subrouter()
+	protected.Use(authenticator.Middleware)
+	protected.HandleFunc("/user-id", func(w http.ResponseWriter, r *http.Request) { GetUserIDHandler(w, r, db) }).Methods("GET")
 
 	// Route to update profile - phone number only
-	r.HandleFunc("/update-profile", func(w http.ResponseWriter, r *http.Request) { UpdateProfileHandler(w, r, db) }).Methods("PATCH")
+	protected.HandleFunc("/update-profile", func(w http.ResponseWriter, r *http.Request) { UpdateProfileHandler(w, r, db) }).Methods("PATCH")
+
+	// Account self-service
+	protected.HandleFunc("/account/password", func(w http.ResponseWriter, r *http.Request) { ChangePasswordHandler(w, r, db) }).Methods("PATCH")
+	protected.HandleFunc("/account/email", func(w http.ResponseWriter, r *http.Request) { RequestEmailChangeHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/account/email/verify", func(w http.ResponseWriter, r *http.Request) { VerifyEmailChangeHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) { DeleteAccountHandler(w, r, db) }).Methods("DELETE")
+
+	// Driver's licence
+	protected.HandleFunc("/licence", func(w http.ResponseWriter, r *http.Request) { SubmitLicenceHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/licence", func(w http.ResponseWriter, r *http.Request) { GetLicenceHandler(w, r, db) }).Methods("GET")
+
+	// Licence review for fleet operators
+	licences := protected.PathPrefix("/licences").Subrouter()
+	licences.Use(auth.RequireRole(auth.RoleFleetOperator))
+	licences.HandleFunc("", func(w http.ResponseWriter, r *http.Request) { ListLicencesHandler(w, r, db) }).Methods("GET")
+	licences.HandleFunc("/{user_id}/review", func(w http.ResponseWriter, r *http.Request) { ReviewLicenceHandler(w, r, db) }).Methods("PATCH")
+	licences.HandleFunc("/{user_id}/image", func(w http.ResponseWriter, r *http.Request) { LicenceImageHandler(w, r, db) }).Methods("GET")
+
+	// Personal data export
+	protected.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) { RequestExportHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) { ListExportsHandler(w, r, db) }).Methods("GET")
+	protected.HandleFunc("/export/{export_id}", func(w http.ResponseWriter, r *http.Request) { ExportStatusHandler(w, r, db) }).Methods("GET")
+	protected.HandleFunc("/export/{export_id}/download", func(w http.ResponseWriter, r *http.Request) { DownloadExportHandler(w, r, db) }).Methods("GET")
+
+	// Two-factor authentication enrolment
+	protected.HandleFunc("/2fa/enroll", func(w http.ResponseWriter, r *http.Request) { EnrollTOTPHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/2fa/confirm", func(w http.ResponseWriter, r *http.Request) { ConfirmTOTPHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/2fa/disable", func(w http.ResponseWriter, r *http.Request) { DisableTOTPHandler(w, r, db) }).Methods("POST")
+
+	// Personal API keys
+	protected.HandleFunc("/api-keys", func(w http.ResponseWriter, r *http.Request) { CreateAPIKeyHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/api-keys", func(w http.ResponseWriter, r *http.Request) { ListAPIKeysHandler(w, r, db) }).Methods("GET")
+	protected.HandleFunc("/api-keys/{key_id}", func(w http.ResponseWriter, r *http.Request) { RevokeAPIKeyHandler(w, r, db) }).Methods("DELETE")
+
+	// Corporate accounts
+	protected.HandleFunc("/organisations", func(w http.ResponseWriter, r *http.Request) { CreateOrganisationHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/organisation", func(w http.ResponseWriter, r *http.Request) { GetOrganisationHandler(w, r, db) }).Methods("GET")
+	protected.HandleFunc("/organisation", func(w http.ResponseWriter, r *http.Request) { UpdateOrganisationHandler(w, r, db) }).Methods("PATCH")
+	protected.HandleFunc("/organisation/invitations", func(w http.ResponseWriter, r *http.Request) { InviteMemberHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/organisation/invitations/{invitation_id}", func(w http.ResponseWriter, r *http.Request) { RevokeInvitationHandler(w, r, db) }).Methods("DELETE")
+	protected.HandleFunc("/organisation/join", func(w http.ResponseWriter, r *http.Request) { AcceptInvitationHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/organisation/members/{user_id}", func(w http.ResponseWriter, r *http.Request) { RemoveMemberHandler(w, r, db) }).Methods("DELETE")
 
 	// Rental history endpoint
-	r.HandleFunc("/rental-history", func(w http.ResponseWriter, r *http.Request) { RentalHistoryHandler(w, r, db) }).Methods("GET")
+	protected.HandleFunc("/rental-history", func(w http.ResponseWriter, r *http.Request) { RentalHistoryHandler(w, r, db) }).Methods("GET")
+
+	// Admin endpoints
+	admin := protected.PathPrefix("/admin").Subrouter()
+	admin.Use(auth.RequireRole(auth.RoleAdmin))
+	admin.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) { ListUsersHandler(w, r, db) }).Methods("GET")
+	admin.HandleFunc("/users/{user_id}/tier", func(w http.ResponseWriter, r *http.Request) { ChangeTierHandler(w, r, db) }).Methods("PATCH")
+	admin.HandleFunc("/users/{user_id}/roles", func(w http.ResponseWriter, r *http.Request) { SetRolesHandler(w, r, db) }).Methods("PATCH")
+	admin.HandleFunc("/users/{user_id}/disable", func(w http.ResponseWriter, r *http.Request) { SetDisabledHandler(w, r, db, true) }).Methods("POST")
+	admin.HandleFunc("/users/{user_id}/enable", func(w http.ResponseWriter, r *http.Request) { SetDisabledHandler(w, r, db, false) }).Methods("POST")
+	admin.HandleFunc("/users/{user_id}/unlock", func(w http.ResponseWriter, r *http.Request) { UnlockAccountHandler(w, r, db) }).Methods("POST")
+	admin.HandleFunc("/unlock-ip", func(w http.ResponseWriter, r *http.Request) { UnlockIPHandler(w, r, db) }).Methods("POST")
+	admin.HandleFunc("/users/{user_id}/impersonate", func(w http.ResponseWriter, r *http.Request) { ImpersonateHandler(w, r, db) }).Methods("POST")
+	admin.HandleFunc("/audit-log", func(w http.ResponseWriter, r *http.Request) { AuditLogHandler(w, r, db) }).Methods("GET")
+
+	// Forget login throttling for keys that are never retried, and tell
+	// account owners about lockouts
+	notifyAccountLockouts(db)
+	startLoginLimiterSweep()
+
+	// Fail interrupted exports and delete expired archives
+	startExportJanitor(db)
 
 	// Start server
 	log.Println("User service running on port 8081")
@@ -137,140 +208,173 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	_, err = db.Exec(`INSERT INTO users (email, password_hash, phone_number, country_code, phone_verified) VALUES (?, ?, ?, ?, TRUE)`,
+	result, err := db.Exec(`INSERT INTO users (email, password_hash, phone_number, country_code, phone_verified) VALUES (?, ?, ?, ?, TRUE)`,
 		email, hashedPassword, phone, countryCode)
 	if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
 
+	// New users start as customers
+	userID, err := result.LastInsertId()
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO user_roles (user_id, role) VALUES (?, ?)`, userID, auth.RoleCustomer)
+	}
+	if err != nil {
+		http.Error(w, "Failed to assign user role", http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
 }
 
-// LoginHandler handles user login
+// LoginHandler handles user login. Users with 2FA enabled receive a
+// short-lived mfa_token that must be exchanged at /login/2fa.
 func LoginHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	email := r.FormValue("email")
 	password := r.FormValue("password")
 
+	// Throttle before running bcrypt so repeated guesses stay cheap to reject
+	account := strings.ToLower(strings.TrimSpace(email))
+	attempt, ok := checkLoginAllowed(w, r, account)
+	if !ok {
+		return
+	}
+	defer attempt.Release()
+
+	var user auth.User
 	var hashedPassword string
-	err := db.QueryRow(`SELECT password_hash FROM users WHERE email = ?`, email).Scan(&hashedPassword)
+	var disabled, totpEnabled bool
+	err := db.QueryRow(`SELECT user_id, email, password_hash, disabled, totp_enabled FROM users WHERE email = ?`, email).
+		Scan(&user.ID, &user.Email, &hashedPassword, &disabled, &totpEnabled)
 	if err != nil {
+		attempt.Fail()
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)); err != nil {
+		attempt.Fail()
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
+	attempt.Succeed()
 
-	token, err := generateJWT(email)
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+	if disabled {
+		http.Error(w, "Account has been disabled", http.StatusForbidden)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	beginLoginSession(w, db, user, totpEnabled)
 }
 
-// ProfileHandler fetches the user profile
-func ProfileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	authHeader := r.Header.Get("Authorization")
-	tokenString := authHeader[len("Bearer "):]
+// beginLoginSession follows a successful first login step. Users with 2FA get
+// a short-lived mfa_token for LoginTOTPHandler; everyone else gets a full token.
+func beginLoginSession(w http.ResponseWriter, db *sql.DB, user auth.User, totpEnabled bool) {
+	if totpEnabled {
+		mfaToken, err := auth.GeneratePurposeToken(jwtKey, user, mfaPurpose, mfaTTL)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
 
-	claims, err := validateJWT(tokenString)
-	if err != nil {
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"mfa_required": true, "mfa_token": mfaToken})
 		return
 	}
 
-	var user User
-	err = db.QueryRow(`SELECT email, phone_number, country_code, membership_tier, phone_verified FROM users WHERE email = ?`, claims.Email).
-		Scan(&user.Email, &user.PhoneNumber, &user.CountryCode, &user.MembershipTier, &user.PhoneVerified)
-	fmt.Println(err)
+	issueLoginToken(w, db, user.ID)
+}
+
+// issueLoginToken writes a full access token for a user who has passed every
+// login step. Admins without 2FA get a token without the admin role until
+// they enrol.
+func issueLoginToken(w http.ResponseWriter, db *sql.DB, userID int) {
+	user := auth.User{ID: userID}
+	var disabled, totpEnabled bool
+	err := db.QueryRow(`SELECT email, membership_tier, token_version, disabled, totp_enabled FROM users WHERE user_id = ?`, userID).
+		Scan(&user.Email, &user.Tier, &user.TokenVersion, &disabled, &totpEnabled)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if disabled {
+		http.Error(w, "Account has been disabled", http.StatusForbidden)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(user)
-}
-
-// GetUserIDHandler retrieves the user_id of the logged-in user
-func GetUserIDHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	authHeader := r.Header.Get("Authorization")
-	tokenString := authHeader[len("Bearer "):]
-
-	claims, err := validateJWT(tokenString)
+	user.Roles, err = loadUserRoles(db, user.ID)
 	if err != nil {
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		http.Error(w, "Failed to load user roles", http.StatusInternalServerError)
 		return
 	}
 
-	var userID int
-	err = db.QueryRow(`SELECT user_id FROM users WHERE email = ?`, claims.Email).Scan(&userID)
-	log.Println(claims)
-	log.Println(claims.Email)
-	log.Println(userID)
+	enrollmentRequired := false
+	if user.HasRole(auth.RoleAdmin) && !totpEnabled {
+		enrollmentRequired = true
+		var roles []string
+		for _, role := range user.Roles {
+			if role != auth.RoleAdmin {
+				roles = append(roles, role)
+			}
+		}
+		user.Roles = roles
+	}
+
+	token, err := auth.GenerateToken(jwtKey, user)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
+	response := map[string]interface{}{"token": token}
+	if enrollmentRequired {
+		response["mfa_enrollment_required"] = true
+		response["message"] = "Admin accounts must enable two-factor authentication before admin access is granted"
+	}
+
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]int{"user_id": userID})
+	json.NewEncoder(w).Encode(response)
 }
 
-// RentalHistoryHandler retrieves rental history
-func RentalHistoryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	authHeader := r.Header.Get("Authorization")
-	tokenString := authHeader[len("Bearer "):]
-	claims, err := validateJWT(tokenString)
+// ProfileHandler fetches the user profile
+func ProfileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	// Authenticated user injected by the auth middleware
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	var user User
+	err := db.QueryRow(`SELECT email, phone_number, country_code, membership_tier, phone_verified FROM users WHERE user_id = ?`, authUser.ID).
+		Scan(&user.Email, &user.PhoneNumber, &user.CountryCode, &user.MembershipTier, &user.PhoneVerified)
 	if err != nil {
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	rows, err := db.Query(`SELECT vehicles.model, rental_history.start_time, rental_history.end_time, rental_history.total_cost
-		FROM rental_history
-		JOIN users ON users.user_id = rental_history.user_id
-		JOIN vehicles ON vehicles.vehicle_id = rental_history.vehicle_id
-		WHERE users.email = ?`, claims.Email)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+// GetUserIDHandler retrieves the user_id of the logged-in user
+func GetUserIDHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	// Authenticated user injected by the auth middleware
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	var userID int
+	err := db.QueryRow(`SELECT user_id FROM users WHERE user_id = ?`, authUser.ID).Scan(&userID)
 	if err != nil {
-		http.Error(w, "Failed to fetch rental history", http.StatusInternalServerError)
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
-	defer rows.Close()
-
-	var rentals []RentalHistory
-	for rows.Next() {
-		var rental RentalHistory
-		if err := rows.Scan(&rental.VehicleModel, &rental.StartTime, &rental.EndTime, &rental.TotalCost); err != nil {
-			http.Error(w, "Error scanning rental history", http.StatusInternalServerError)
-			return
-		}
-		rentals = append(rentals, rental)
-	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(rentals)
+	json.NewEncoder(w).Encode(map[string]int{"user_id": userID})
 }
 
 // UpdateProfileHandler allows the user to update their phone number only
 func UpdateProfileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	// Get the JWT token from the Authorization header
-	authHeader := r.Header.Get("Authorization")
-	tokenString := authHeader[len("Bearer "):]
-
-	// Validate JWT token
-	claims, err := validateJWT(tokenString)
-	if err != nil {
-		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
-		return
-	}
+	// Authenticated user injected by the auth middleware
+	authUser, _ := auth.UserFromContext(r.Context())
 
 	// Get the new phone number from the request body
 	phoneNumber := r.FormValue("phone_number")
@@ -280,7 +384,7 @@ func UpdateProfileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	}
 
 	// Update the user's phone number in the database
-	_, err = db.Exec(`UPDATE users SET phone_number = ? WHERE email = ?`, phoneNumber, claims.Email)
+	_, err := db.Exec(`UPDATE users SET phone_number = ? WHERE user_id = ?`, phoneNumber, authUser.ID)
 	if err != nil {
 		http.Error(w, "Failed to update phone number", http.StatusInternalServerError)
 		return
@@ -290,27 +394,3 @@ func UpdateProfileHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Phone number updated successfully. Please verify your new phone number with OTP."})
 }
-
-// JWT utilities
-func generateJWT(email string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		Email: email,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
-}
-
-func validateJWT(tokenString string) (*Claims, error) {
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-	if err != nil || !token.Valid {
-		return nil, err
-	}
-	return claims, nil
-}
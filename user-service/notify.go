@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// sendNotification emails a user through the SMTP server in SMTP_ADDR
+// (host:port), sending from SMTP_FROM and logging in with SMTP_USERNAME and
+// SMTP_PASSWORD when set. Without SMTP_ADDR nothing is sent and only the
+// subject is logged, as bodies can carry verification codes.
+func sendNotification(to, subject, body string) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		log.Printf("Notification to %s not sent, SMTP_ADDR is not set: %s", to, subject)
+		return
+	}
+
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "no-reply@ecs.local"
+	}
+	var smtpAuth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		smtpAuth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	// Header values come from our own text and stored addresses; strip line
+	// breaks so nothing can be injected into the headers
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		clean.Replace(from), clean.Replace(to), clean.Replace(subject), time.Now().Format(time.RFC1123Z), body)
+	if err := smtp.SendMail(addr, smtpAuth, from, []string{to}, []byte(message)); err != nil {
+		log.Printf("Failed to send notification to %s: %v", to, err)
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"auth"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+)
+
+// oidcStateTTL is how long a user has to complete a login at the provider
+const oidcStateTTL = 10 * time.Minute
+
+// oidcStateCookie binds a login to the browser that started it, so a callback
+// carrying someone else's state cannot log the victim into their account
+const oidcStateCookie = "oidc_state"
+
+// oidcClient is used for all calls to identity providers
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProviders holds the providers configured in .env, keyed by name
+var oidcProviders = map[string]*OIDCProvider{}
+
+// OIDCProvider struct for an external OpenID Connect identity provider
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+
+	mu            sync.Mutex
+	authURL       string
+	tokenURL      string
+	jwksURL       string
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// idTokenClaims struct for the ID token claims we rely on
+type idTokenClaims struct {
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Nonce         string      `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// loadOIDCProviders reads provider settings from the environment. OIDC_PROVIDERS
+// lists provider names; each name needs OIDC_<NAME>_ISSUER, _CLIENT_ID,
+// _CLIENT_SECRET and _REDIRECT_URL.
+func loadOIDCProviders() map[string]*OIDCProvider {
+	providers := map[string]*OIDCProvider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := &OIDCProvider{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       os.Getenv(prefix + "SCOPES"),
+		}
+		if provider.Scopes == "" {
+			provider.Scopes = "openid email profile"
+		}
+		if provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURL == "" {
+			log.Printf("Skipping OIDC provider %s: issuer, client ID and redirect URL are required", name)
+			continue
+		}
+		providers[name] = provider
+	}
+	return providers
+}
+
+// ListOIDCProvidersHandler lists the names of the configured providers
+func ListOIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(names)
+}
+
+// StartOIDCLoginHandler starts an authorization code flow with PKCE and returns
+// the provider URL the browser should be sent to
+func StartOIDCLoginHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	provider, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	if err := provider.discover(); err != nil {
+		log.Printf("OIDC discovery for %s failed: %v", provider.Name, err)
+		http.Error(w, "Login provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, err1 := randomURLString(32)
+	nonce, err2 := randomURLString(32)
+	verifier, err3 := randomURLString(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	// Drop abandoned logins while we are here
+	db.Exec(`DELETE FROM oauth_states WHERE expires_at < NOW()`)
+
+	_, err := db.Exec(`INSERT INTO oauth_states (state, provider, code_verifier, nonce, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		state, provider.Name, verifier, nonce, time.Now().Add(oidcStateTTL))
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.ClientID)
+	query.Set("redirect_uri", provider.RedirectURL)
+	query.Set("scope", provider.Scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"authorization_url": provider.authURL + "?" + query.Encode()})
+}
+
+// OIDCCallbackHandler completes an external login. The identity is matched to
+// a linked account, or linked to the account with the same verified email.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	attempt, ok := checkLoginAllowed(w, r, "")
+	if !ok {
+		return
+	}
+	defer attempt.Release()
+
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		http.Error(w, "Login was not completed at the provider: "+providerError, http.StatusUnauthorized)
+		return
+	}
+
+	state, code := query.Get("state"), query.Get("code")
+	if state == "" || code == "" {
+		http.Error(w, "state and code are required", http.StatusBadRequest)
+		return
+	}
+
+	// The state must come back to the browser that started the login
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		attempt.Fail()
+		http.Error(w, "Login was started in another browser", http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+
+	var providerName, verifier, nonce string
+	var expiresAt time.Time
+	err = db.QueryRow(`SELECT provider, code_verifier, nonce, expires_at FROM oauth_states WHERE state = ?`, state).
+		Scan(&providerName, &verifier, &nonce, &expiresAt)
+	if err == sql.ErrNoRows {
+		attempt.Fail()
+		http.Error(w, "Invalid or expired login session", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch login session", http.StatusInternalServerError)
+		return
+	}
+
+	// Each state is single use, so a replayed callback finds nothing to delete
+	result, err := db.Exec(`DELETE FROM oauth_states WHERE state = ?`, state)
+	if err != nil {
+		http.Error(w, "Failed to fetch login session", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 || time.Now().After(expiresAt) {
+		attempt.Fail()
+		http.Error(w, "Invalid or expired login session", http.StatusUnauthorized)
+		return
+	}
+
+	provider, ok := oidcProviders[providerName]
+	if !ok {
+		http.Error(w, "Unknown login provider", http.StatusNotFound)
+		return
+	}
+
+	claims, err := provider.exchange(code, verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC login with %s failed: %v", provider.Name, err)
+		attempt.Fail()
+		http.Error(w, "Could not verify login with provider", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := linkedUser(db, provider.Name, claims)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No account is registered for this email. Please register first.", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errEmailNotVerified) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to link account", http.StatusInternalServerError)
+		return
+	}
+
+	var user auth.User
+	var disabled, totpEnabled bool
+	err = db.QueryRow(`SELECT user_id, email, disabled, totp_enabled FROM users WHERE user_id = ?`, userID).
+		Scan(&user.ID, &user.Email, &disabled, &totpEnabled)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+	if disabled {
+		http.Error(w, "Account has been disabled", http.StatusForbidden)
+		return
+	}
+
+	// The provider replaces the password, not the second factor
+	beginLoginSession(w, db, user, totpEnabled)
+}
+
+// errEmailNotVerified is returned when an unlinked identity has no verified email
+var errEmailNotVerified = errors.New("The provider has not verified this email address")
+
+// linkedUser returns the user linked to the identity, linking it by verified
+// email on first use
+func linkedUser(db *sql.DB, provider string, claims *idTokenClaims) (int, error) {
+	var userID int
+	err := db.QueryRow(`SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?`, provider, claims.Subject).Scan(&userID)
+	if err != sql.ErrNoRows {
+		return userID, err
+	}
+
+	// Only a verified email proves the identity owns the account
+	if claims.Email == "" || !(claims.EmailVerified == true || claims.EmailVerified == "true") {
+		return 0, errEmailNotVerified
+	}
+
+	err = db.QueryRow(`SELECT user_id FROM users WHERE email = ? AND deleted_at IS NULL`, claims.Email).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.Exec(`INSERT INTO user_identities (user_id, provider, subject, email) VALUES (?, ?, ?, ?)`,
+		userID, provider, claims.Subject, claims.Email)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Linked %s identity %s to user %d", provider, claims.Subject, userID)
+	return userID, nil
+}
+
+// discover loads the provider endpoints from its discovery document
+func (p *OIDCProvider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.authURL != "" {
+		return nil
+	}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return err
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer {
+		return fmt.Errorf("discovery issuer %q does not match %q", doc.Issuer, p.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return errors.New("discovery document is missing endpoints")
+	}
+
+	p.authURL, p.tokenURL, p.jwksURL = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI
+	return nil
+}
+
+// exchange redeems an authorization code and returns the verified ID token claims
+func (p *OIDCProvider) exchange(code, verifier, nonce string) (*idTokenClaims, error) {
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	resp, err := oidcClient.PostForm(p.tokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, p.verificationKey, jwt.WithValidMethods([]string{"RS256"}))
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(p.Issuer, true) || !claims.VerifyAudience(p.ClientID, true) {
+		return nil, errors.New("id_token was not issued for this client")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+	return claims, nil
+}
+
+// verificationKey finds the provider key that signed token, refreshing the key
+// set when the key ID is unknown because providers rotate keys
+func (p *OIDCProvider) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[kid]
+	if !ok && time.Since(p.keysFetchedAt) > time.Minute {
+		keys, err := fetchJWKS(p.jwksURL)
+		if err != nil {
+			return nil, err
+		}
+		p.keys, p.keysFetchedAt = keys, time.Now()
+		key, ok = p.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchJWKS loads the RSA signing keys published by a provider
+func fetchJWKS(jwksURL string) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(jwksURL, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// getJSON fetches url and decodes the JSON response into v
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// randomURLString returns n random bytes encoded for use in URLs
+func randomURLString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
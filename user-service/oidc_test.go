@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mock-oidc/issuer"
+
+	"github.com/gorilla/mux"
+)
+
+// oidcTestIP is the client address of every test request
+const oidcTestIP = "192.0.2.10"
+
+// oidcStore is the slice of the database the OIDC handlers use
+type oidcStore struct {
+	mu         sync.Mutex
+	states     map[string][]driver.Value // state -> provider, code_verifier, nonce, expires_at
+	users      map[string]int64          // email -> user_id
+	identities map[string]int64          // provider/subject -> user_id
+}
+
+// query answers the statements issued by StartOIDCLoginHandler and
+// OIDCCallbackHandler
+func (s *oidcStore) query(query string, args []driver.Value) (fakeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query = strings.Join(strings.Fields(query), " ")
+
+	switch {
+	case strings.HasPrefix(query, "DELETE FROM oauth_states WHERE expires_at < NOW()"):
+		return fakeResult{}, nil
+	case strings.HasPrefix(query, "INSERT INTO oauth_states"):
+		s.states[args[0].(string)] = args[1:]
+		return fakeResult{affected: 1}, nil
+	case strings.HasPrefix(query, "SELECT provider, code_verifier, nonce, expires_at FROM oauth_states"):
+		state, ok := s.states[args[0].(string)]
+		if !ok {
+			return fakeResult{}, nil
+		}
+		return fakeResult{columns: []string{"provider", "code_verifier", "nonce", "expires_at"}, rows: [][]driver.Value{state}}, nil
+	case strings.HasPrefix(query, "DELETE FROM oauth_states WHERE state = ?"):
+		if _, ok := s.states[args[0].(string)]; !ok {
+			return fakeResult{}, nil
+		}
+		delete(s.states, args[0].(string))
+		return fakeResult{affected: 1}, nil
+	case strings.HasPrefix(query, "SELECT user_id FROM user_identities"):
+		userID, ok := s.identities[args[0].(string)+"/"+args[1].(string)]
+		if !ok {
+			return fakeResult{}, nil
+		}
+		return fakeResult{columns: []string{"user_id"}, rows: [][]driver.Value{{userID}}}, nil
+	case strings.HasPrefix(query, "SELECT user_id FROM users WHERE email = ?"):
+		userID, ok := s.users[args[0].(string)]
+		if !ok {
+			return fakeResult{}, nil
+		}
+		return fakeResult{columns: []string{"user_id"}, rows: [][]driver.Value{{userID}}}, nil
+	case strings.HasPrefix(query, "INSERT INTO user_identities"):
+		s.identities[args[1].(string)+"/"+args[2].(string)] = args[0].(int64)
+		return fakeResult{affected: 1}, nil
+	case strings.HasPrefix(query, "SELECT user_id, email, disabled, totp_enabled FROM users WHERE user_id = ?"):
+		for email, userID := range s.users {
+			if userID == args[0].(int64) {
+				// Two-factor accounts stop at the MFA token, before any other query
+				return fakeResult{
+					columns: []string{"user_id", "email", "disabled", "totp_enabled"},
+					rows:    [][]driver.Value{{userID, email, false, true}},
+				}, nil
+			}
+		}
+		return fakeResult{}, nil
+	}
+	return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+}
+
+// oidcTest is a user service configured with the mock issuer as provider "mock"
+type oidcTest struct {
+	t      *testing.T
+	store  *oidcStore
+	issuer *httptest.Server
+	client *http.Client
+	// cookies holds the state cookie each started login set, by state
+	cookies map[string]*http.Cookie
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	mock, err := issuer.New("", "mock-client", "mock-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mock.Handler())
+	mock.URL = server.URL
+
+	savedProviders, savedKey := oidcProviders, jwtKey
+	oidcProviders = map[string]*OIDCProvider{"mock": {
+		Name:         "mock",
+		Issuer:       server.URL,
+		ClientID:     "mock-client",
+		ClientSecret: "mock-secret",
+		RedirectURL:  "http://localhost:8080/html/oauth-callback.html",
+		Scopes:       "openid email",
+	}}
+	jwtKey = []byte("oidc-test-key")
+	t.Cleanup(func() {
+		server.Close()
+		oidcProviders, jwtKey = savedProviders, savedKey
+		ipLimiter.Reset(oidcTestIP)
+	})
+
+	return &oidcTest{
+		t: t,
+		store: &oidcStore{
+			states:     map[string][]driver.Value{},
+			users:      map[string]int64{"driver@example.com": 7},
+			identities: map[string]int64{},
+		},
+		issuer: server,
+		// The provider's redirect back to us is read, not followed
+		client:  &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		cookies: map[string]*http.Cookie{},
+	}
+}
+
+// start begins a login and returns the provider URL the browser is sent to
+func (o *oidcTest) start() *url.URL {
+	o.t.Helper()
+	r := mux.SetURLVars(httptest.NewRequest("POST", "/auth/oidc/mock/start", nil), map[string]string{"provider": "mock"})
+	w := httptest.NewRecorder()
+	StartOIDCLoginHandler(w, r, newFakeDB(o.store.query))
+	if w.Code != http.StatusOK {
+		o.t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+	var body struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	authURL, err := url.Parse(body.AuthorizationURL)
+	if err != nil || !strings.HasPrefix(body.AuthorizationURL, o.issuer.URL+"/authorize?") {
+		o.t.Fatalf("start returned authorization URL %q", body.AuthorizationURL)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie && cookie.HttpOnly {
+			o.cookies[cookie.Value] = cookie
+		}
+	}
+	if o.cookies[authURL.Query().Get("state")] == nil {
+		o.t.Fatal("start did not set an HttpOnly state cookie")
+	}
+	return authURL
+}
+
+// authorize logs in at the mock issuer and returns the callback query it
+// redirects the browser to
+func (o *oidcTest) authorize(authURL *url.URL, email string, verified bool) url.Values {
+	o.t.Helper()
+	form := url.Values{"email": {email}}
+	if verified {
+		form.Set("email_verified", "true")
+	}
+	resp, err := o.client.PostForm(authURL.String(), form)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil {
+		o.t.Fatalf("authorize: %s, redirected to %q", resp.Status, resp.Header.Get("Location"))
+	}
+	return location.Query()
+}
+
+// callback completes the login in the browser that started it
+func (o *oidcTest) callback(query url.Values) *httptest.ResponseRecorder {
+	return o.callbackWithCookie(query, o.cookies[query.Get("state")])
+}
+
+// callbackWithCookie completes the login in a browser holding cookie, which
+// may be nil
+func (o *oidcTest) callbackWithCookie(query url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/auth/oidc/callback?"+query.Encode(), nil)
+	r.RemoteAddr = oidcTestIP + ":50000"
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	OIDCCallbackHandler(w, r, newFakeDB(o.store.query))
+	return w
+}
+
+func TestOIDCLoginWithPKCE(t *testing.T) {
+	o := newOIDCTest(t)
+	authURL := o.start()
+
+	params := authURL.Query()
+	if params.Get("code_challenge_method") != "S256" || params.Get("code_challenge") == "" || params.Get("nonce") == "" {
+		t.Fatalf("authorization request is missing PKCE or nonce: %v", params)
+	}
+
+	w := o.callback(o.authorize(authURL, "driver@example.com", true))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"mfa_token"`) {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	if len(o.store.identities) != 1 {
+		t.Errorf("identity was not linked: %v", o.store.identities)
+	}
+}
+
+func TestOIDCCodeNeedsItsOwnVerifier(t *testing.T) {
+	o := newOIDCTest(t)
+	victim := o.start()
+	attacker := o.start()
+
+	// A code issued for one login, redeemed with another login's state and
+	// therefore its verifier, fails the PKCE check
+	code := o.authorize(attacker, "driver@example.com", true).Get("code")
+	w := o.callback(url.Values{"state": {victim.Query().Get("state")}, "code": {code}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("callback: %d %s, want 401", w.Code, w.Body)
+	}
+	if len(o.store.identities) != 0 {
+		t.Errorf("identity linked despite the failed exchange: %v", o.store.identities)
+	}
+}
+
+func TestOIDCStateCookie(t *testing.T) {
+	o := newOIDCTest(t)
+	victim := o.start()
+	attacker := o.start()
+
+	// An attacker's callback link opened in the victim's browser, which holds
+	// the cookie for its own login, must not log the victim in
+	callback := o.authorize(attacker, "driver@example.com", true)
+	if w := o.callbackWithCookie(callback, o.cookies[victim.Query().Get("state")]); w.Code != http.StatusUnauthorized {
+		t.Errorf("callback with another login's cookie: %d %s, want 401", w.Code, w.Body)
+	}
+	if w := o.callbackWithCookie(callback, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("callback without a cookie: %d %s, want 401", w.Code, w.Body)
+	}
+	if len(o.store.identities) != 0 {
+		t.Errorf("identity linked without the state cookie: %v", o.store.identities)
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	o := newOIDCTest(t)
+	authURL := o.start()
+
+	// The ID token carries a nonce other than the one stored for this login
+	tampered := authURL.Query()
+	tampered.Set("nonce", "attacker-nonce")
+	authURL.RawQuery = tampered.Encode()
+
+	w := o.callback(o.authorize(authURL, "driver@example.com", true))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("callback: %d %s, want 401", w.Code, w.Body)
+	}
+	if len(o.store.identities) != 0 {
+		t.Errorf("identity linked despite the nonce mismatch: %v", o.store.identities)
+	}
+}
+
+func TestOIDCUnverifiedEmail(t *testing.T) {
+	o := newOIDCTest(t)
+
+	w := o.callback(o.authorize(o.start(), "driver@example.com", false))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("callback: %d %s, want 403", w.Code, w.Body)
+	}
+	if len(o.store.identities) != 0 {
+		t.Errorf("unverified identity was linked: %v", o.store.identities)
+	}
+}
+
+func TestOIDCStateReplay(t *testing.T) {
+	o := newOIDCTest(t)
+	callback := o.authorize(o.start(), "driver@example.com", true)
+
+	if w := o.callback(callback); w.Code != http.StatusOK {
+		t.Fatalf("first callback: %d %s", w.Code, w.Body)
+	}
+	if w := o.callback(callback); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed callback: %d %s, want 401", w.Code, w.Body)
+	}
+}
+
+func TestOIDCExpiredState(t *testing.T) {
+	o := newOIDCTest(t)
+	authURL := o.start()
+	state := authURL.Query().Get("state")
+	o.store.states[state][3] = time.Now().Add(-time.Minute)
+
+	if w := o.callback(o.authorize(authURL, "driver@example.com", true)); w.Code != http.StatusUnauthorized {
+		t.Errorf("callback: %d %s, want 401", w.Code, w.Body)
+	}
+	if _, ok := o.store.states[state]; ok {
+		t.Error("expired state was not deleted")
+	}
+}
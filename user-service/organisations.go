@@ -0,0 +1,481 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// invitationTTL is how long an organisation invitation can be accepted
+const invitationTTL = 7 * 24 * time.Hour
+
+// Organisation struct for an organisation and its members
+type Organisation struct {
+	OrgID          int                  `json:"org_id"`
+	Name           string               `json:"name"`
+	SpendingLimit  *float64             `json:"monthly_spending_limit"`
+	SpentThisMonth float64              `json:"spent_this_month"`
+	Role           string               `json:"role"`
+	Members        []OrganisationMember `json:"members"`
+	Invitations    []OrgInvitation      `json:"invitations,omitempty"`
+}
+
+// OrganisationMember struct for a member listing
+type OrganisationMember struct {
+	UserID   int    `json:"user_id"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	JoinedAt string `json:"joined_at"`
+}
+
+// OrgInvitation struct for a pending invitation
+type OrgInvitation struct {
+	InvitationID int    `json:"invitation_id"`
+	Email        string `json:"email"`
+	ExpiresAt    string `json:"expires_at"`
+}
+
+// CreateOrganisationHandler creates an organisation with the caller as its admin
+func CreateOrganisationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || len(name) > 255 {
+		http.Error(w, "A name of up to 255 characters is required", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseSpendingLimit(r.FormValue("monthly_spending_limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to create organisation", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var memberships int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM organisation_members WHERE user_id = ? FOR UPDATE`, authUser.ID).Scan(&memberships); err != nil {
+		http.Error(w, "Failed to create organisation", http.StatusInternalServerError)
+		return
+	}
+	if memberships > 0 {
+		http.Error(w, "You already belong to an organisation", http.StatusConflict)
+		return
+	}
+
+	result, err := tx.Exec(`INSERT INTO organisations (name, monthly_spending_limit, created_by) VALUES (?, ?, ?)`, name, limit, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to create organisation", http.StatusInternalServerError)
+		return
+	}
+	orgID, _ := result.LastInsertId()
+
+	if _, err := tx.Exec(`INSERT INTO organisation_members (user_id, org_id, role) VALUES (?, ?, 'admin')`, authUser.ID, orgID); err != nil {
+		http.Error(w, "Failed to create organisation", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create organisation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"org_id": orgID, "message": "Organisation created successfully"})
+}
+
+// GetOrganisationHandler returns the caller's organisation, its members and
+// this month's spending. Admins also see pending invitations.
+func GetOrganisationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	var org Organisation
+	var limit sql.NullFloat64
+	err := db.QueryRow(`
+		SELECT organisations.org_id, organisations.name, organisations.monthly_spending_limit, organisation_members.role
+		FROM organisation_members
+		JOIN organisations ON organisations.org_id = organisation_members.org_id
+		WHERE organisation_members.user_id = ?`, authUser.ID).Scan(&org.OrgID, &org.Name, &limit, &org.Role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You do not belong to an organisation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation", http.StatusInternalServerError)
+		return
+	}
+	if limit.Valid {
+		org.SpendingLimit = &limit.Float64
+	}
+
+	// Spending counts bookings starting this calendar month, as the limit does
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(billing.amount), 0)
+		FROM billing
+		JOIN reservations ON reservations.reservation_id = billing.reservation_id
+		WHERE reservations.org_id = ?
+			AND reservations.start_time >= DATE_FORMAT(NOW(), '%Y-%m-01')
+			AND reservations.start_time < DATE_FORMAT(NOW(), '%Y-%m-01') + INTERVAL 1 MONTH`, org.OrgID).Scan(&org.SpentThisMonth)
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation spending", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT users.user_id, users.email, organisation_members.role, DATE_FORMAT(organisation_members.joined_at, '%Y-%m-%d %H:%i:%s')
+		FROM organisation_members
+		JOIN users ON users.user_id = organisation_members.user_id
+		WHERE organisation_members.org_id = ?
+		ORDER BY organisation_members.joined_at`, org.OrgID)
+	if err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	org.Members = []OrganisationMember{}
+	for rows.Next() {
+		var member OrganisationMember
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Role, &member.JoinedAt); err != nil {
+			http.Error(w, "Error scanning member data", http.StatusInternalServerError)
+			return
+		}
+		org.Members = append(org.Members, member)
+	}
+
+	if org.Role == "admin" {
+		invitations, err := db.Query(`
+			SELECT invitation_id, email, DATE_FORMAT(expires_at, '%Y-%m-%d %H:%i:%s')
+			FROM organisation_invitations
+			WHERE org_id = ? AND accepted_at IS NULL AND expires_at > NOW()
+			ORDER BY created_at`, org.OrgID)
+		if err != nil {
+			http.Error(w, "Failed to fetch invitations", http.StatusInternalServerError)
+			return
+		}
+		defer invitations.Close()
+
+		for invitations.Next() {
+			var invitation OrgInvitation
+			if err := invitations.Scan(&invitation.InvitationID, &invitation.Email, &invitation.ExpiresAt); err != nil {
+				http.Error(w, "Error scanning invitation data", http.StatusInternalServerError)
+				return
+			}
+			org.Invitations = append(org.Invitations, invitation)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(org)
+}
+
+// UpdateOrganisationHandler lets an organisation admin rename the organisation
+// or change its monthly spending limit. An empty limit removes it.
+func UpdateOrganisationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	orgID, ok := requireOrgAdmin(w, db, authUser.ID)
+	if !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := r.Form["name"]; ok {
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" || len(name) > 255 {
+			http.Error(w, "A name of up to 255 characters is required", http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec(`UPDATE organisations SET name = ? WHERE org_id = ?`, name, orgID); err != nil {
+			http.Error(w, "Failed to update organisation", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, ok := r.Form["monthly_spending_limit"]; ok {
+		limit, err := parseSpendingLimit(r.FormValue("monthly_spending_limit"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec(`UPDATE organisations SET monthly_spending_limit = ? WHERE org_id = ?`, limit, orgID); err != nil {
+			http.Error(w, "Failed to update organisation", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Organisation updated successfully"})
+}
+
+// InviteMemberHandler lets an organisation admin invite a user by email
+func InviteMemberHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	orgID, ok := requireOrgAdmin(w, db, authUser.ID)
+	if !ok {
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if _, err := mail.ParseAddress(email); err != nil || strings.ContainsAny(email, "<> ") {
+		http.Error(w, "A valid email address is required", http.StatusBadRequest)
+		return
+	}
+
+	token, err := newVerificationCode()
+	if err != nil {
+		http.Error(w, "Failed to generate invitation", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO organisation_invitations (org_id, email, token_hash, invited_by, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		orgID, email, hashVerificationCode(token), authUser.ID, time.Now().Add(invitationTTL))
+	if err != nil {
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+	invitationID, _ := result.LastInsertId()
+
+	// No mail provider yet, so the invitation token is printed like verification codes
+	fmt.Printf("Organisation invitation token for %s: %s\n", email, token)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"invitation_id": invitationID, "message": "Invitation sent"})
+}
+
+// RevokeInvitationHandler lets an organisation admin withdraw a pending invitation
+func RevokeInvitationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	orgID, ok := requireOrgAdmin(w, db, authUser.ID)
+	if !ok {
+		return
+	}
+
+	invitationID, err := strconv.Atoi(mux.Vars(r)["invitation_id"])
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`DELETE FROM organisation_invitations WHERE invitation_id = ? AND org_id = ? AND accepted_at IS NULL`, invitationID, orgID)
+	if err != nil {
+		http.Error(w, "Failed to revoke invitation", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Invitation revoked"})
+}
+
+// AcceptInvitationHandler adds the caller to the organisation they were
+// invited to. The invitation must be addressed to the caller's email.
+func AcceptInvitationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	token := strings.TrimSpace(r.FormValue("token"))
+	if token == "" {
+		http.Error(w, "Invitation token is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var invitationID, orgID int
+	var email string
+	err = tx.QueryRow(`
+		SELECT invitation_id, org_id, email FROM organisation_invitations
+		WHERE token_hash = ? AND accepted_at IS NULL AND expires_at > NOW()
+		FOR UPDATE`, hashVerificationCode(token)).Scan(&invitationID, &orgID, &email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired invitation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+	if !strings.EqualFold(email, authUser.Email) {
+		http.Error(w, "This invitation is for a different email address", http.StatusForbidden)
+		return
+	}
+
+	var memberships int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM organisation_members WHERE user_id = ? FOR UPDATE`, authUser.ID).Scan(&memberships); err != nil {
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+	if memberships > 0 {
+		http.Error(w, "You already belong to an organisation. Leave it first.", http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.Exec(`INSERT INTO organisation_members (user_id, org_id, role) VALUES (?, ?, 'member')`, authUser.ID, orgID); err != nil {
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE organisation_invitations SET accepted_at = NOW() WHERE invitation_id = ?`, invitationID); err != nil {
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "You have joined the organisation"})
+}
+
+// RemoveMemberHandler removes a member from the organisation. Admins can
+// remove anyone and members can remove themselves, but the last admin cannot
+// leave while others remain.
+func RemoveMemberHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	memberID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var orgID int
+	var callerRole string
+	err = tx.QueryRow(`SELECT org_id, role FROM organisation_members WHERE user_id = ?`, authUser.ID).Scan(&orgID, &callerRole)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You do not belong to an organisation", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+	if memberID != authUser.ID && callerRole != "admin" {
+		http.Error(w, "Only organisation admins can remove other members", http.StatusForbidden)
+		return
+	}
+
+	var memberRole string
+	err = tx.QueryRow(`SELECT role FROM organisation_members WHERE user_id = ? AND org_id = ?`, memberID, orgID).Scan(&memberRole)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	if memberRole == "admin" {
+		// Lock the organisation's rows so two admins cannot both leave at once
+		roles, err := tx.Query(`SELECT role FROM organisation_members WHERE org_id = ? FOR UPDATE`, orgID)
+		if err != nil {
+			http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+			return
+		}
+		var admins, members int
+		for roles.Next() {
+			var role string
+			if err := roles.Scan(&role); err != nil {
+				roles.Close()
+				http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+				return
+			}
+			if role == "admin" {
+				admins++
+			}
+			members++
+		}
+		roles.Close()
+		if admins == 1 && members > 1 {
+			http.Error(w, "The last admin cannot leave while other members remain", http.StatusConflict)
+			return
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM organisation_members WHERE user_id = ?`, memberID); err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %d removed user %d from organisation %d", authUser.ID, memberID, orgID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Member removed from the organisation"})
+}
+
+// requireOrgAdmin returns the organisation the user administers, writing a
+// 404 or 403 response and returning false when there is none
+func requireOrgAdmin(w http.ResponseWriter, db *sql.DB, userID int) (int, bool) {
+	var orgID int
+	var role string
+	err := db.QueryRow(`SELECT org_id, role FROM organisation_members WHERE user_id = ?`, userID).Scan(&orgID, &role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You do not belong to an organisation", http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation", http.StatusInternalServerError)
+		return 0, false
+	}
+	if role != "admin" {
+		http.Error(w, "Only organisation admins can do this", http.StatusForbidden)
+		return 0, false
+	}
+	return orgID, true
+}
+
+// parseSpendingLimit parses an optional monthly spending limit. An empty
+// value means no limit.
+func parseSpendingLimit(value string) (sql.NullFloat64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return sql.NullFloat64{}, nil
+	}
+	limit, err := strconv.ParseFloat(value, 64)
+	// The column is DECIMAL(10, 2); NaN and infinities parse but cannot be stored
+	if err != nil || math.IsNaN(limit) || limit < 0 || limit >= 1e8 {
+		return sql.NullFloat64{}, errors.New("monthly_spending_limit must be a non-negative number below 100000000")
+	}
+	return sql.NullFloat64{Float64: limit, Valid: true}, nil
+}
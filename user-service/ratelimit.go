@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LimitPolicy controls how failed attempts for one kind of key are throttled
+type LimitPolicy struct {
+	// FreeAttempts failures are allowed before any backoff applies
+	FreeAttempts int
+	// BaseDelay is the backoff after the first throttled failure; it doubles
+	// with every further failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAttempts failures lock the key for LockoutDuration
+	LockoutAttempts int
+	LockoutDuration time.Duration
+	// ResetAfter forgets a key that has had no failures for this long
+	ResetAfter time.Duration
+}
+
+// Default policies for login throttling. IPs get more headroom because many
+// users can share one address.
+var (
+	accountLimitPolicy = LimitPolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAttempts: 10,
+		LockoutDuration: 30 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+	ipLimitPolicy = LimitPolicy{
+		FreeAttempts:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAttempts: 50,
+		LockoutDuration: time.Hour,
+		ResetAfter:      time.Hour,
+	}
+)
+
+// Limits on the records a LoginLimiter keeps. Keys are only dropped when they
+// are looked up again, so a sweep clears out the ones that are never retried.
+const (
+	maxLimiterRecords    = 100000
+	limiterSweepInterval = 5 * time.Minute
+)
+
+// attemptRecord tracks failures for a single account or IP
+type attemptRecord struct {
+	failures    int
+	pending     int // attempts allowed by Allow that have not finished yet
+	lastFailure time.Time
+	blockedTill time.Time
+	locked      bool
+}
+
+// LoginLimiter tracks failed login attempts per key and decides when a key
+// must wait before trying again
+type LoginLimiter struct {
+	mu         sync.Mutex
+	policy     LimitPolicy
+	records    map[string]*attemptRecord
+	maxRecords int
+	now        func() time.Time
+	onLocked   func(key string, until time.Time)
+}
+
+// NewLoginLimiter creates a limiter using the given policy. onLocked is
+// called whenever a key becomes locked out.
+func NewLoginLimiter(policy LimitPolicy, onLocked func(key string, until time.Time)) *LoginLimiter {
+	return &LoginLimiter{
+		policy:     policy,
+		records:    make(map[string]*attemptRecord),
+		maxRecords: maxLimiterRecords,
+		now:        time.Now,
+		onLocked:   onLocked,
+	}
+}
+
+// Allow reports whether key may attempt a login now, and if not, how long
+// it must wait. An allowed attempt is reserved until it is finished with
+// Fail, Reset or Release, so concurrent guesses cannot all slip through
+// before their failures are counted: only the remaining free attempts may
+// run at once, and once those are used up one attempt runs at a time.
+func (l *LoginLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	record := l.record(key)
+	if record != nil && now.Before(record.blockedTill) {
+		return false, record.blockedTill.Sub(now)
+	}
+	if record == nil {
+		record = l.add(key)
+	}
+
+	attempts := record.failures + record.pending
+	if attempts >= l.policy.LockoutAttempts || (attempts >= l.policy.FreeAttempts && record.pending > 0) {
+		return false, l.policy.BaseDelay
+	}
+	record.pending++
+	return true, 0
+}
+
+// Fail records a failed attempt and applies backoff or lockout
+func (l *LoginLimiter) Fail(key string) {
+	l.mu.Lock()
+
+	now := l.now()
+	record := l.record(key)
+	if record == nil {
+		record = l.add(key)
+	}
+	if record.pending > 0 {
+		record.pending--
+	}
+	record.failures++
+	record.lastFailure = now
+
+	var lockedUntil time.Time
+	switch {
+	case record.failures >= l.policy.LockoutAttempts:
+		record.blockedTill = now.Add(l.policy.LockoutDuration)
+		if !record.locked {
+			record.locked = true
+			lockedUntil = record.blockedTill
+		}
+	case record.failures > l.policy.FreeAttempts:
+		delay := l.policy.BaseDelay << (record.failures - l.policy.FreeAttempts - 1)
+		if delay <= 0 || delay > l.policy.MaxDelay {
+			delay = l.policy.MaxDelay
+		}
+		record.blockedTill = now.Add(delay)
+	}
+	l.mu.Unlock()
+
+	// Notify outside the lock so a slow notifier cannot stall logins
+	if !lockedUntil.IsZero() && l.onLocked != nil {
+		l.onLocked(key, lockedUntil)
+	}
+}
+
+// Release finishes an attempt reserved by Allow without counting a failure
+func (l *LoginLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if record := l.record(key); record != nil && record.pending > 0 {
+		record.pending--
+	}
+}
+
+// Reset clears all failures for key, for example after a successful login
+// or when an admin unlocks it
+func (l *LoginLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.records, key)
+}
+
+// Locked reports whether key is currently locked out
+func (l *LoginLimiter) Locked(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record := l.record(key)
+	return record != nil && record.locked && l.now().Before(record.blockedTill)
+}
+
+// Sweep drops every record that has expired
+func (l *LoginLimiter) Sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key := range l.records {
+		l.record(key)
+	}
+}
+
+// record returns the live record for key, dropping it if it has expired.
+// The caller must hold l.mu.
+func (l *LoginLimiter) record(key string) *attemptRecord {
+	record, ok := l.records[key]
+	if !ok {
+		return nil
+	}
+
+	now := l.now()
+	expired := now.After(record.blockedTill) && now.Sub(record.lastFailure) > l.policy.ResetAfter
+	// A lockout that has served its time starts counting afresh
+	if expired || (record.locked && now.After(record.blockedTill)) {
+		if record.pending == 0 {
+			delete(l.records, key)
+			return nil
+		}
+		*record = attemptRecord{pending: record.pending}
+	}
+	return record
+}
+
+// add creates a record for key. When the limiter is full, expired records are
+// swept and, failing that, a record that is not blocking anything is evicted,
+// so keys under backoff or lockout are kept. The caller must hold l.mu.
+func (l *LoginLimiter) add(key string) *attemptRecord {
+	if len(l.records) >= l.maxRecords {
+		for other := range l.records {
+			l.record(other)
+		}
+	}
+	if len(l.records) >= l.maxRecords {
+		now := l.now()
+		victim := ""
+		for other, record := range l.records {
+			victim = other
+			if record.pending == 0 && !now.Before(record.blockedTill) {
+				break
+			}
+		}
+		delete(l.records, victim)
+	}
+
+	record := &attemptRecord{}
+	l.records[key] = record
+	return record
+}
+
+// Login limiters shared by the login endpoints. Account lockouts are
+// notified once main has set up the database with notifyAccountLockouts.
+var (
+	accountLimiter = NewLoginLimiter(accountLimitPolicy, nil)
+	ipLimiter      = NewLoginLimiter(ipLimitPolicy, func(ip string, until time.Time) {
+		log.Printf("Login lockout: IP %s blocked until %s", ip, until.Format(time.RFC3339))
+	})
+)
+
+// startLoginLimiterSweep periodically drops expired login limiter records in
+// the background
+func startLoginLimiterSweep() {
+	go func() {
+		for {
+			time.Sleep(limiterSweepInterval)
+			accountLimiter.Sweep()
+			ipLimiter.Sweep()
+		}
+	}()
+}
+
+// notifyAccountLockouts makes accountLimiter tell account owners when their
+// account is locked. It must be called before the limiter is in use.
+func notifyAccountLockouts(db *sql.DB) {
+	accountLimiter.onLocked = func(account string, until time.Time) {
+		// The email is sent in the background so the failed login is not held up
+		go notifyAccountLockout(db, account, until)
+	}
+}
+
+// notifyAccountLockout emails the owner of the locked account at the address
+// stored for it. The account key is whatever was typed at login, so nothing
+// is sent when no account has that email.
+func notifyAccountLockout(db *sql.DB, account string, until time.Time) {
+	email, err := lockoutRecipient(db, account)
+	if err != nil {
+		log.Printf("Failed to look up locked account for notification: %v", err)
+		return
+	}
+	if email == "" {
+		return
+	}
+	sendNotification(email, "Your account has been locked",
+		fmt.Sprintf("Your account has been locked after repeated failed logins until %s. If this was not you, contact support.",
+			until.Format(time.RFC3339)))
+}
+
+// lockoutRecipient returns the email stored for the account matching the
+// login email, or "" when there is none
+func lockoutRecipient(db *sql.DB, account string) (string, error) {
+	var userID int
+	var email string
+	err := db.QueryRow(`SELECT user_id, email FROM users WHERE email = ?`, account).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return email, err
+}
+
+// loginAttempt is a login attempt reserved against an account and client IP.
+// Handlers finish it with Fail or Succeed and defer Release for every other
+// outcome.
+type loginAttempt struct {
+	account string
+	ip      string
+	done    bool
+}
+
+// checkLoginAllowed reserves a login attempt, or rejects the request with 429
+// when either the account or the client IP is currently throttled
+func checkLoginAllowed(w http.ResponseWriter, r *http.Request, account string) (*loginAttempt, bool) {
+	attempt := &loginAttempt{account: account, ip: clientIP(r)}
+
+	allowedAccount, waitAccount := true, time.Duration(0)
+	if account != "" {
+		allowedAccount, waitAccount = accountLimiter.Allow(account)
+	}
+	allowedIP, waitIP := ipLimiter.Allow(attempt.ip)
+	if allowedAccount && allowedIP {
+		return attempt, true
+	}
+
+	// Give back whichever half of the reservation was granted
+	if allowedAccount && account != "" {
+		accountLimiter.Release(account)
+	}
+	if allowedIP {
+		ipLimiter.Release(attempt.ip)
+	}
+
+	seconds := int(max(waitAccount, waitIP).Round(time.Second).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	if accountLimiter.Locked(account) || ipLimiter.Locked(attempt.ip) {
+		http.Error(w, "Too many failed login attempts. Try again later.", http.StatusTooManyRequests)
+	} else {
+		http.Error(w, "Too many failed login attempts. Please wait before retrying.", http.StatusTooManyRequests)
+	}
+	return nil, false
+}
+
+// Fail counts the attempt as failed against the account and IP
+func (a *loginAttempt) Fail() {
+	if a.done {
+		return
+	}
+	a.done = true
+	if a.account != "" {
+		accountLimiter.Fail(a.account)
+	}
+	ipLimiter.Fail(a.ip)
+}
+
+// Succeed clears the account's failures and releases the IP's reservation
+func (a *loginAttempt) Succeed() {
+	if a.done {
+		return
+	}
+	a.done = true
+	if a.account != "" {
+		accountLimiter.Reset(a.account)
+	}
+	ipLimiter.Release(a.ip)
+}
+
+// Release gives the reservation back without counting the attempt, for
+// requests that end before the credentials are judged
+func (a *loginAttempt) Release() {
+	if a.done {
+		return
+	}
+	a.done = true
+	if a.account != "" {
+		accountLimiter.Release(a.account)
+	}
+	ipLimiter.Release(a.ip)
+}
+
+// clientIP returns the caller's address. Requests proxied by the gateway come
+// from loopback, in which case the last X-Forwarded-For hop (added by the
+// gateway itself) is the real client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	return host
+}
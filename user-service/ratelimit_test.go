@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPolicy = LimitPolicy{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        8 * time.Second,
+	LockoutAttempts: 8,
+	LockoutDuration: time.Hour,
+	ResetAfter:      10 * time.Minute,
+}
+
+// testClock is a settable clock for LoginLimiter.now
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// newTestLimiter returns a limiter on a fake clock that records lockouts
+func newTestLimiter() (*LoginLimiter, *testClock, *[]string) {
+	clock := &testClock{t: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)}
+	var locked []string
+	limiter := NewLoginLimiter(testPolicy, func(key string, until time.Time) { locked = append(locked, key) })
+	limiter.now = clock.now
+	return limiter, clock, &locked
+}
+
+// failTimes makes n allowed attempts on key, failing each, and stops at the
+// first refusal, returning how many were allowed
+func failTimes(l *LoginLimiter, key string, n int) int {
+	for i := 0; i < n; i++ {
+		if ok, _ := l.Allow(key); !ok {
+			return i
+		}
+		l.Fail(key)
+	}
+	return n
+}
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+	}
+	for _, tt := range tests {
+		limiter, clock, _ := newTestLimiter()
+		for i := 0; i < tt.failures; i++ {
+			if ok, wait := limiter.Allow("a@example.com"); !ok {
+				clock.advance(wait)
+				limiter.Allow("a@example.com")
+			}
+			limiter.Fail("a@example.com")
+		}
+
+		ok, wait := limiter.Allow("a@example.com")
+		if ok != (tt.wait == 0) || wait != tt.wait {
+			t.Errorf("after %d failures: Allow = %v, %v; want %v, %v", tt.failures, ok, wait, tt.wait == 0, tt.wait)
+		}
+		if tt.wait > 0 {
+			clock.advance(tt.wait)
+			if ok, _ := limiter.Allow("a@example.com"); !ok {
+				t.Errorf("after %d failures: still refused once the backoff has passed", tt.failures)
+			}
+		}
+	}
+}
+
+func TestLoginLimiterLockout(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		after      time.Duration
+		wantLocked bool
+		wantAllow  bool
+	}{
+		{"below threshold", testPolicy.LockoutAttempts - 1, 0, false, false},
+		{"at threshold", testPolicy.LockoutAttempts, 0, true, false},
+		{"during lockout", testPolicy.LockoutAttempts, 30 * time.Minute, true, false},
+		{"lockout served", testPolicy.LockoutAttempts, time.Hour + time.Second, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, clock, locked := newTestLimiter()
+			for i := 0; i < tt.failures; i++ {
+				if ok, wait := limiter.Allow("a@example.com"); !ok {
+					clock.advance(wait)
+				}
+				limiter.Fail("a@example.com")
+			}
+			clock.advance(tt.after)
+
+			if got := limiter.Locked("a@example.com"); got != tt.wantLocked {
+				t.Errorf("Locked = %v, want %v", got, tt.wantLocked)
+			}
+			wantNotified := 0
+			if tt.failures >= testPolicy.LockoutAttempts {
+				wantNotified = 1
+			}
+			if len(*locked) != wantNotified {
+				t.Errorf("lockout notified %d times, want %d", len(*locked), wantNotified)
+			}
+			if ok, _ := limiter.Allow("a@example.com"); ok != tt.wantAllow {
+				t.Errorf("Allow = %v, want %v", ok, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestLoginLimiterReset(t *testing.T) {
+	tests := []struct {
+		name  string
+		reset func(l *LoginLimiter, clock *testClock)
+	}{
+		{"admin unlock", func(l *LoginLimiter, clock *testClock) { l.Reset("a@example.com") }},
+		{"quiet period", func(l *LoginLimiter, clock *testClock) { clock.advance(testPolicy.ResetAfter + time.Second) }},
+		{"sweep", func(l *LoginLimiter, clock *testClock) {
+			clock.advance(testPolicy.ResetAfter + time.Second)
+			l.Sweep()
+			if len(l.records) != 0 {
+				t.Errorf("sweep kept %d records", len(l.records))
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, clock, _ := newTestLimiter()
+			failTimes(limiter, "a@example.com", testPolicy.FreeAttempts+1)
+			if ok, _ := limiter.Allow("a@example.com"); ok {
+				t.Fatal("expected backoff before reset")
+			}
+
+			tt.reset(limiter, clock)
+
+			// A fresh record has every free attempt available again
+			if got := failTimes(limiter, "a@example.com", testPolicy.FreeAttempts+1); got != testPolicy.FreeAttempts+1 {
+				t.Errorf("allowed %d attempts after reset, want %d", got, testPolicy.FreeAttempts+1)
+			}
+		})
+	}
+}
+
+func TestLoginLimiterRelease(t *testing.T) {
+	limiter, _, _ := newTestLimiter()
+	for i := 0; i < 20; i++ {
+		if ok, _ := limiter.Allow("a@example.com"); !ok {
+			t.Fatalf("attempt %d refused although every earlier attempt was released", i)
+		}
+		limiter.Release("a@example.com")
+	}
+}
+
+func TestLoginLimiterConcurrentAttempts(t *testing.T) {
+	limiter, _, _ := newTestLimiter()
+
+	// Every guess is in flight at once, so none has failed yet
+	const guesses = 100
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := limiter.Allow("a@example.com"); ok {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != testPolicy.FreeAttempts {
+		t.Fatalf("%d concurrent guesses allowed, want %d", allowed, testPolicy.FreeAttempts)
+	}
+
+	for i := 0; i < allowed; i++ {
+		limiter.Fail("a@example.com")
+	}
+	// Beyond the free attempts, guesses run one at a time
+	if ok, _ := limiter.Allow("a@example.com"); !ok {
+		t.Fatal("next guess refused")
+	}
+	if ok, _ := limiter.Allow("a@example.com"); ok {
+		t.Fatal("second guess allowed while the first is in flight")
+	}
+}
+
+func TestLoginLimiterCap(t *testing.T) {
+	limiter, _, _ := newTestLimiter()
+	limiter.maxRecords = 10
+
+	failTimes(limiter, "victim@example.com", testPolicy.FreeAttempts+1)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("stuffed%d@example.com", i)
+		limiter.Allow(key)
+		limiter.Fail(key)
+	}
+
+	if len(limiter.records) > limiter.maxRecords {
+		t.Errorf("limiter holds %d records, want at most %d", len(limiter.records), limiter.maxRecords)
+	}
+	if ok, _ := limiter.Allow("victim@example.com"); ok {
+		t.Error("blocked account was evicted")
+	}
+}
+
+func TestCheckLoginAllowedCredentialStuffing(t *testing.T) {
+	const account = "stuffing-target@example.com"
+	defer accountLimiter.Reset(account)
+	defer ipLimiter.Reset("203.0.113.7")
+
+	// Parallel guesses against one account from one address, each failing
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("POST", "/login", nil)
+			r.RemoteAddr = "203.0.113.7:40000"
+			attempt, ok := checkLoginAllowed(httptest.NewRecorder(), r, account)
+			if !ok {
+				return
+			}
+			defer attempt.Release()
+			mu.Lock()
+			granted++
+			mu.Unlock()
+			attempt.Fail()
+		}()
+	}
+	wg.Wait()
+
+	// The free attempts, plus at most the first throttled one if it started
+	// after they had all failed
+	if granted > accountLimitPolicy.FreeAttempts+1 {
+		t.Errorf("%d guesses reached the password check, want at most %d", granted, accountLimitPolicy.FreeAttempts+1)
+	}
+
+	r := httptest.NewRequest("POST", "/login", nil)
+	r.RemoteAddr = "203.0.113.7:40000"
+	w := httptest.NewRecorder()
+	if _, ok := checkLoginAllowed(w, r, account); ok {
+		t.Fatal("guess allowed during backoff")
+	}
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d with Retry-After %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestLockoutRecipient(t *testing.T) {
+	db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		if !strings.HasPrefix(query, "SELECT user_id, email FROM users WHERE email = ?") {
+			return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+		}
+		// Emails compare case-insensitively, as with MySQL's default collation
+		if strings.EqualFold(args[0].(string), "Driver@Example.com") {
+			return fakeResult{columns: []string{"user_id", "email"}, rows: [][]driver.Value{{int64(7), "Driver@Example.com"}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+
+	tests := []struct{ account, want string }{
+		{"driver@example.com", "Driver@Example.com"},
+		{"nobody@example.com", ""},
+		{"attacker@example.com\r\nBcc: victim@example.com", ""},
+	}
+	for _, tt := range tests {
+		got, err := lockoutRecipient(db, tt.account)
+		if err != nil || got != tt.want {
+			t.Errorf("lockoutRecipient(%q) = %q, %v, want %q", tt.account, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"auth"
+)
+
+// TOTP parameters (RFC 6238 defaults understood by authenticator apps)
+const (
+	totpIssuer    = "ECS Car Sharing"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkewSteps = 1
+
+	recoveryCodeCount = 10
+
+	// mfaPurpose marks the short-lived token issued between the password and TOTP steps
+	mfaPurpose = "mfa_login"
+	mfaTTL     = 5 * time.Minute
+)
+
+// EnrollTOTPHandler generates a new TOTP secret and recovery codes. 2FA is
+// not active until the user confirms a code with ConfirmTOTPHandler.
+func EnrollTOTPHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	var enabled bool
+	err := db.QueryRow(`SELECT totp_enabled FROM users WHERE user_id = ?`, authUser.ID).Scan(&enabled)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := newRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start enrolment", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE user_id = ?`, secret, authUser.ID); err != nil {
+		http.Error(w, "Failed to store secret", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, authUser.ID); err != nil {
+		http.Error(w, "Failed to store recovery codes", http.StatusInternalServerError)
+		return
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, authUser.ID, hashRecoveryCode(code)); err != nil {
+			http.Error(w, "Failed to store recovery codes", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to start enrolment", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"otpauth_uri":    totpURI(secret, authUser.Email),
+		"secret":         secret,
+		"recovery_codes": codes,
+	})
+}
+
+// ConfirmTOTPHandler activates 2FA once the user proves their app is set up
+func ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	code := r.FormValue("code")
+	if code == "" {
+		http.Error(w, "Code is required", http.StatusBadRequest)
+		return
+	}
+
+	var secret sql.NullString
+	var lastStep int64
+	err := db.QueryRow(`SELECT totp_secret, totp_last_step FROM users WHERE user_id = ?`, authUser.ID).Scan(&secret, &lastStep)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if !secret.Valid {
+		http.Error(w, "Start enrolment before confirming", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := verifyTOTP(secret.String, code, time.Now(), lastStep)
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE users SET totp_enabled = TRUE, totp_last_step = ? WHERE user_id = ?`, step, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication enabled. Log in again to refresh your session."})
+}
+
+// DisableTOTPHandler turns off 2FA after re-checking the password and a code.
+// Admins cannot disable 2FA because it is mandatory for them.
+func DisableTOTPHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	if authUser.HasRole(auth.RoleAdmin) {
+		http.Error(w, "Two-factor authentication is required for admin accounts", http.StatusForbidden)
+		return
+	}
+
+	if !checkPassword(w, db, authUser.ID, r.FormValue("password")) {
+		return
+	}
+
+	if ok, err := checkSecondFactor(db, authUser.ID, r.FormValue("code")); err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	_, err := db.Exec(`UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_step = 0 WHERE user_id = ?`, authUser.ID)
+	if err == nil {
+		_, err = db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, authUser.ID)
+	}
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// LoginTOTPHandler completes a login started by LoginHandler by checking a
+// TOTP or recovery code against the pending mfa_token
+func LoginTOTPHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	claims, err := auth.ValidatePurposeToken(jwtKey, r.FormValue("mfa_token"), mfaPurpose)
+	if err != nil {
+		http.Error(w, "Invalid or expired login session", http.StatusUnauthorized)
+		return
+	}
+
+	// Code guesses share the account's login throttle
+	account := strings.ToLower(claims.Email)
+	attempt, allowed := checkLoginAllowed(w, r, account)
+	if !allowed {
+		return
+	}
+	defer attempt.Release()
+
+	ok, err := checkSecondFactor(db, claims.UserID, r.FormValue("code"))
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		attempt.Fail()
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	attempt.Succeed()
+
+	issueLoginToken(w, db, claims.UserID)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery code
+func checkSecondFactor(db *sql.DB, userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	var secret sql.NullString
+	var enabled bool
+	var lastStep int64
+	err := db.QueryRow(`SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE user_id = ?`, userID).
+		Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		return false, err
+	}
+	if !enabled || !secret.Valid {
+		return false, nil
+	}
+
+	if step, ok := verifyTOTP(secret.String, code, time.Now(), lastStep); ok {
+		// Remember the step so the same code cannot be replayed. A concurrent
+		// login that used this step or a later one first leaves nothing to
+		// update, and this one is a replay.
+		result, err := db.Exec(`UPDATE users SET totp_last_step = ? WHERE user_id = ? AND totp_last_step < ?`, step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		affected, err := result.RowsAffected()
+		return affected > 0, err
+	}
+
+	result, err := db.Exec(`UPDATE recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// newTOTPSecret returns a random 160-bit base32 secret
+func newTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf), nil
+}
+
+// totpURI builds the otpauth:// URI that authenticator apps scan
+func totpURI(secret, email string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// totpCode computes the code for a single time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits))), nil
+}
+
+// verifyTOTP checks code against the steps around now, rejecting any step at
+// or before lastStep. It returns the matched step.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkewSteps; step <= current+totpSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes returns n random single-use codes formatted as xxxxx-xxxxx
+func newRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := hex.EncodeToString(buf)
+		codes[i] = raw[:5] + "-" + raw[5:]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code for storage. The codes carry 40 bits
+// of randomness and are single use, so a fast hash is sufficient.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
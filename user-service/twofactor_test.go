@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckSecondFactorRejectsConcurrentReplay(t *testing.T) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both logins read the account before either records the step
+	var mu sync.Mutex
+	var lastStep int64
+	db := newFakeDB(func(query string, args []driver.Value) (fakeResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(query, "SELECT totp_secret, totp_enabled, totp_last_step FROM users"):
+			return fakeResult{
+				columns: []string{"totp_secret", "totp_enabled", "totp_last_step"},
+				rows:    [][]driver.Value{{secret, true, int64(0)}},
+			}, nil
+		case strings.HasPrefix(query, "UPDATE users SET totp_last_step = ? WHERE user_id = ? AND totp_last_step < ?"):
+			if lastStep >= args[2].(int64) {
+				return fakeResult{}, nil
+			}
+			lastStep = args[0].(int64)
+			return fakeResult{affected: 1}, nil
+		}
+		return fakeResult{}, fmt.Errorf("unexpected query %q", query)
+	})
+
+	first, err := checkSecondFactor(db, 7, code)
+	if err != nil || !first {
+		t.Fatalf("first use: %v, %v", first, err)
+	}
+	replay, err := checkSecondFactor(db, 7, code)
+	if err != nil || replay {
+		t.Errorf("replayed code was accepted: %v, %v", replay, err)
+	}
+}
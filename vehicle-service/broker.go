@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// brokerQueueSize is how many messages a connected client may fall behind by
+// before further QoS 0 messages to it are dropped
+const brokerQueueSize = 256
+
+// BrokerAuthenticator checks a connecting client's credentials and returns the
+// topic prefix it may publish and subscribe under, or false to refuse it
+type BrokerAuthenticator func(username, password string) (prefix string, ok bool)
+
+// memoryBroker is an in-process message broker. Subscribers in the same
+// process receive messages directly, which keeps tests and local development
+// free of external services; Listen also lets MQTT clients such as vehicles
+// connect over TCP.
+type memoryBroker struct {
+	mu           sync.Mutex
+	subs         []brokerSubscription
+	authenticate BrokerAuthenticator
+}
+
+// brokerSubscription is a filter and where to deliver matching messages.
+// client is nil for in-process subscribers.
+type brokerSubscription struct {
+	filter  string
+	client  *brokerClient
+	handler MessageHandler
+}
+
+// brokerClient is an MQTT client connected to the broker over TCP
+type brokerClient struct {
+	conn   net.Conn
+	prefix string
+	queue  chan []byte
+}
+
+// newMemoryBroker creates a broker. authenticate vets TCP clients; it may be
+// nil when Listen is not used.
+func newMemoryBroker(authenticate BrokerAuthenticator) *memoryBroker {
+	return &memoryBroker{authenticate: authenticate}
+}
+
+// Subscribe registers an in-process handler for topics matching filter
+func (b *memoryBroker) Subscribe(filter string, handler MessageHandler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, brokerSubscription{filter: filter, handler: handler})
+	return nil
+}
+
+// Publish delivers payload to every subscriber whose filter matches topic.
+// In-process handlers run before Publish returns.
+func (b *memoryBroker) Publish(topic string, payload []byte) error {
+	b.mu.Lock()
+	var matched []brokerSubscription
+	for _, sub := range b.subs {
+		if topicMatches(sub.filter, topic) {
+			matched = append(matched, sub)
+		}
+	}
+	b.mu.Unlock()
+
+	// A client with overlapping subscriptions receives the message once
+	sent := map[*brokerClient]bool{}
+	for _, sub := range matched {
+		if sub.client == nil {
+			sub.handler(topic, payload)
+			continue
+		}
+		if sent[sub.client] {
+			continue
+		}
+		sent[sub.client] = true
+		select {
+		case sub.client.queue <- append(appendString(nil, topic), payload...):
+		default:
+			log.Printf("MQTT client %s is not keeping up; dropped a message on %s", sub.client.conn.RemoteAddr(), topic)
+		}
+	}
+	return nil
+}
+
+// Close drops every subscription and disconnects TCP clients. Close the
+// listener returned by Listen to stop new clients connecting.
+func (b *memoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subs {
+		if sub.client != nil {
+			sub.client.conn.Close()
+		}
+	}
+	b.subs = nil
+	return nil
+}
+
+// Listen accepts MQTT clients on addr until the listener fails. It returns
+// once the listener is open.
+func (b *memoryBroker) Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("MQTT broker stopped accepting connections: %v", err)
+				}
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return listener, nil
+}
+
+// serve handles one TCP client from CONNECT to disconnect
+func (b *memoryBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	p, err := readPacket(reader)
+	if err != nil || p.kind != mqttConnect {
+		return
+	}
+	keepAlive, username, password, err := parseConnect(p.body)
+	if err != nil {
+		writePacket(conn, mqttConnAck, 0, []byte{0, 1}) // unacceptable protocol version
+		return
+	}
+	prefix, ok := "", b.authenticate != nil
+	if ok {
+		prefix, ok = b.authenticate(username, password)
+	}
+	if !ok {
+		writePacket(conn, mqttConnAck, 0, []byte{0, 5}) // not authorised
+		return
+	}
+
+	client := &brokerClient{conn: conn, prefix: prefix, queue: make(chan []byte, brokerQueueSize)}
+	defer b.drop(client)
+
+	// Only the writer goroutine writes to the connection once it starts
+	done := make(chan struct{})
+	defer close(done)
+	replies := make(chan mqttPacket, 16)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case body := <-client.queue:
+				if writeConn(conn, mqttPublish, 0, body) != nil {
+					return
+				}
+			case reply := <-replies:
+				if writeConn(conn, reply.kind, reply.flags, reply.body) != nil {
+					return
+				}
+			}
+		}
+	}()
+	reply := func(kind byte, body []byte) {
+		select {
+		case replies <- mqttPacket{kind: kind, body: body}:
+		case <-done:
+		}
+	}
+	reply(mqttConnAck, []byte{0, 0})
+
+	for {
+		conn.SetReadDeadline(time.Time{})
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		}
+		p, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch p.kind {
+		case mqttPublish:
+			topic, packetID, payload, err := parsePublish(p)
+			if err != nil || !strings.HasPrefix(topic, prefix) || strings.ContainsAny(topic, "+#") {
+				return
+			}
+			if packetID != 0 {
+				reply(mqttPubAck, binary.BigEndian.AppendUint16(nil, packetID))
+			}
+			b.Publish(topic, payload)
+		case mqttSubscribe:
+			packetID, filters, err := parseSubscribe(p.body, true)
+			if err != nil {
+				return
+			}
+			body := binary.BigEndian.AppendUint16(nil, packetID)
+			for _, filter := range filters {
+				if !strings.HasPrefix(filter, prefix) {
+					body = append(body, 0x80) // failure
+					continue
+				}
+				b.mu.Lock()
+				b.subs = append(b.subs, brokerSubscription{filter: filter, client: client})
+				b.mu.Unlock()
+				body = append(body, 0) // granted at QoS 0
+			}
+			reply(mqttSubAck, body)
+		case mqttUnsubscribe:
+			packetID, filters, err := parseSubscribe(p.body, false)
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			for _, filter := range filters {
+				b.removeLocked(func(sub brokerSubscription) bool { return sub.client == client && sub.filter == filter })
+			}
+			b.mu.Unlock()
+			reply(mqttUnsubAck, binary.BigEndian.AppendUint16(nil, packetID))
+		case mqttPingReq:
+			reply(mqttPingResp, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// drop removes a disconnected client's subscriptions
+func (b *memoryBroker) drop(client *brokerClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(func(sub brokerSubscription) bool { return sub.client == client })
+}
+
+// removeLocked deletes the subscriptions matching remove. The caller holds b.mu.
+func (b *memoryBroker) removeLocked(remove func(brokerSubscription) bool) {
+	kept := b.subs[:0]
+	for _, sub := range b.subs {
+		if !remove(sub) {
+			kept = append(kept, sub)
+		}
+	}
+	b.subs = kept
+}
+
+// parseConnect reads the keep-alive interval and credentials from a CONNECT
+// packet, accepting only MQTT 3.1.1
+func parseConnect(body []byte) (time.Duration, string, string, error) {
+	protocol, rest, err := readString(body)
+	if err != nil || protocol != "MQTT" || len(rest) < 4 || rest[0] != 4 {
+		return 0, "", "", errors.New("mqtt: unsupported protocol")
+	}
+	flags := rest[1]
+	keepAlive := time.Duration(binary.BigEndian.Uint16(rest[2:])) * time.Second
+	rest = rest[4:]
+
+	if _, rest, err = readString(rest); err != nil { // client ID
+		return 0, "", "", err
+	}
+	if flags&0x04 != 0 { // will topic and message
+		if _, rest, err = readString(rest); err != nil {
+			return 0, "", "", err
+		}
+		if _, rest, err = readString(rest); err != nil {
+			return 0, "", "", err
+		}
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		if username, rest, err = readString(rest); err != nil {
+			return 0, "", "", err
+		}
+	}
+	if flags&0x40 != 0 {
+		if password, _, err = readString(rest); err != nil {
+			return 0, "", "", err
+		}
+	}
+	return keepAlive, username, password, nil
+}
+
+// parseSubscribe reads the packet ID and topic filters of a SUBSCRIBE packet,
+// whose filters are each followed by a QoS byte, or an UNSUBSCRIBE packet.
+// Requested QoS levels are ignored.
+func parseSubscribe(body []byte, withQoS bool) (uint16, []string, error) {
+	if len(body) < 2 {
+		return 0, nil, errors.New("mqtt: truncated subscribe")
+	}
+	packetID := binary.BigEndian.Uint16(body)
+	rest := body[2:]
+	var filters []string
+	for len(rest) > 0 {
+		filter, next, err := readString(rest)
+		if err != nil {
+			return 0, nil, err
+		}
+		rest = next
+		if withQoS {
+			if len(rest) == 0 {
+				return 0, nil, errors.New("mqtt: truncated subscribe")
+			}
+			rest = rest[1:]
+		}
+		filters = append(filters, filter)
+	}
+	if len(filters) == 0 {
+		return 0, nil, errors.New("mqtt: subscribe without filters")
+	}
+	return packetID, filters, nil
+}
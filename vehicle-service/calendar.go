@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// CalendarFeedHandler creates or rotates the user's secret calendar URL.
+// Rotating invalidates the previous URL.
+func CalendarFeedHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to create calendar feed", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	_, err := db.Exec(`
+		INSERT INTO calendar_feeds (user_id, token_hash) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE token_hash = VALUES(token_hash), created_at = NOW()`,
+		authUser.ID, hashToken(token))
+	if err != nil {
+		http.Error(w, "Failed to create calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"url":     publicURL() + "/api/vehicle/calendar/" + token + ".ics",
+		"message": "Subscribe to this URL in your calendar app. Anyone with the URL can see your bookings.",
+	})
+}
+
+// DeleteCalendarFeedHandler disables the user's calendar URL
+func DeleteCalendarFeedHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	if _, err := db.Exec(`DELETE FROM calendar_feeds WHERE user_id = ?`, authUser.ID); err != nil {
+		http.Error(w, "Failed to disable calendar feed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Calendar feed disabled"})
+}
+
+// CalendarHandler serves the upcoming reservations for a feed token as
+// iCalendar. Calendar apps cannot log in, so the token in the URL is the
+// only credential.
+func CalendarHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var userID int
+	err := db.QueryRow(`SELECT user_id FROM calendar_feeds WHERE token_hash = ?`, hashToken(mux.Vars(r)["token"])).Scan(&userID)
+	if err != nil {
+		http.Error(w, "Calendar not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT reservations.reservation_id, vehicles.model, vehicles.license_plate, COALESCE(vehicles.location, ''),
+			DATE_FORMAT(reservations.start_time, '%Y%m%dT%H%i%s'), DATE_FORMAT(reservations.end_time, '%Y%m%dT%H%i%s'),
+			DATE_FORMAT(reservations.created_at, '%Y%m%dT%H%i%s')
+		FROM reservations
+		JOIN vehicles ON vehicles.vehicle_id = reservations.vehicle_id
+		WHERE reservations.user_id = ? AND reservations.status = 'Booked' AND reservations.end_time > NOW()
+		ORDER BY reservations.start_time`, userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch reservations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//ECS Car Sharing//Reservations//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:PUBLISH")
+	writeICSLine(&b, "X-WR-CALNAME:ECS Car Sharing bookings")
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for rows.Next() {
+		var reservationID int
+		var model, plate, location, start, end, created string
+		if err := rows.Scan(&reservationID, &model, &plate, &location, &start, &end, &created); err != nil {
+			http.Error(w, "Error scanning reservation data", http.StatusInternalServerError)
+			return
+		}
+
+		// Times are stored without a zone, so they are sent as floating local times
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, fmt.Sprintf("UID:reservation-%d@ecs-car-sharing", reservationID))
+		writeICSLine(&b, "DTSTAMP:"+stamp)
+		writeICSLine(&b, "CREATED:"+created)
+		writeICSLine(&b, "DTSTART:"+start)
+		writeICSLine(&b, "DTEND:"+end)
+		writeICSLine(&b, "SUMMARY:"+escapeICSText("Car rental: "+model))
+		if location != "" {
+			writeICSLine(&b, "LOCATION:"+escapeICSText(location))
+		}
+		writeICSLine(&b, "DESCRIPTION:"+escapeICSText(fmt.Sprintf("Reservation %d\nVehicle %s (%s)", reservationID, model, plate)))
+		writeICSLine(&b, "END:VEVENT")
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+
+	if _, err := db.Exec(`UPDATE calendar_feeds SET last_fetched_at = NOW() WHERE user_id = ?`, userID); err != nil {
+		log.Printf("Failed to record calendar fetch for user %d: %v", userID, err)
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
+
+// writeICSLine writes one content line, folding it at 75 octets as RFC 5545
+// requires without splitting a UTF-8 character
+func writeICSLine(b *strings.Builder, line string) {
+	// Continuation lines start with a space, which counts towards the limit
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// escapeICSText escapes a TEXT property value
+func escapeICSText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// hashToken hashes a secret token, such as a calendar or device token, for storage
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// publicURL returns the gateway address clients use to reach the API
+func publicURL() string {
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://localhost:8080"
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// commandTimeout is how long a vehicle has to acknowledge a command
+const commandTimeout = 10 * time.Second
+
+// Commands a driver can send to their booked vehicle. Honk also flashes the
+// lights so the car can be found.
+const (
+	commandUnlock = "unlock"
+	commandLock   = "lock"
+	commandHonk   = "honk"
+)
+
+// Outcomes recorded for a command
+const (
+	commandPending   = "pending"
+	commandSucceeded = "succeeded"
+	commandFailed    = "failed"
+	commandTimedOut  = "timed_out"
+)
+
+// CommandResult struct for a vehicle's answer to a command
+type CommandResult struct {
+	Success bool   `json:"success"`
+	Detail  string `json:"detail"`
+}
+
+// VehicleCommand struct for a recorded command
+type VehicleCommand struct {
+	CommandID     int     `json:"command_id"`
+	VehicleID     int     `json:"vehicle_id"`
+	UserID        int     `json:"user_id"`
+	ReservationID int     `json:"reservation_id"`
+	Command       string  `json:"command"`
+	Status        string  `json:"status"`
+	Detail        *string `json:"detail"`
+	CreatedAt     string  `json:"created_at"`
+	CompletedAt   *string `json:"completed_at"`
+}
+
+// VehicleCommander delivers a command to a vehicle and waits for its answer
+type VehicleCommander interface {
+	Send(ctx context.Context, vehicleID int, command string) (CommandResult, error)
+}
+
+// newCommander returns the commander selected by VEHICLE_COMMANDER: "mqtt"
+// sends commands to vehicles over the transport, and "simulator" (the
+// default) answers for them
+func newCommander(db *sql.DB, transport Transport) (VehicleCommander, error) {
+	switch os.Getenv("VEHICLE_COMMANDER") {
+	case "", "simulator":
+		return &simulatedCommander{db: db}, nil
+	case "mqtt":
+		return newMQTTCommander(transport)
+	default:
+		return nil, errors.New("VEHICLE_COMMANDER must be simulator or mqtt")
+	}
+}
+
+// SendVehicleCommandHandler sends unlock, lock or honk to a vehicle. Only the
+// user whose booking of the vehicle is in progress may send commands.
+func SendVehicleCommandHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, commander VehicleCommander) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		Command string `json:"command"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	command := strings.ToLower(data.Command)
+	if command != commandUnlock && command != commandLock && command != commandHonk {
+		http.Error(w, "command must be unlock, lock or honk", http.StatusBadRequest)
+		return
+	}
+
+	var reservationID int
+	err = db.QueryRow(`
+		SELECT reservation_id
+		FROM reservations
+		WHERE vehicle_id = ? AND user_id = ? AND status = 'Booked' AND start_time <= NOW() AND end_time > NOW()
+		LIMIT 1`, vehicleID, authUser.ID).Scan(&reservationID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You can only control a vehicle during your booking", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to check reservation", http.StatusInternalServerError)
+		return
+	}
+
+	// Record the command before sending it so attempts are logged even if the service stops
+	result, err := db.Exec(`
+		INSERT INTO vehicle_commands (vehicle_id, user_id, reservation_id, command, status)
+		VALUES (?, ?, ?, ?, ?)`, vehicleID, authUser.ID, reservationID, command, commandPending)
+	if err != nil {
+		http.Error(w, "Failed to record command", http.StatusInternalServerError)
+		return
+	}
+	commandID, _ := result.LastInsertId()
+
+	ctx, cancel := context.WithTimeout(r.Context(), commandTimeout)
+	defer cancel()
+	answer, err := commander.Send(ctx, vehicleID, command)
+
+	status, detail, code := commandSucceeded, answer.Detail, http.StatusOK
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		status, detail, code = commandTimedOut, "The vehicle did not respond", http.StatusGatewayTimeout
+	case err != nil:
+		status, detail, code = commandFailed, err.Error(), http.StatusBadGateway
+	case !answer.Success:
+		status, code = commandFailed, http.StatusConflict
+	}
+
+	_, err = db.Exec(`UPDATE vehicle_commands SET status = ?, detail = NULLIF(?, ''), completed_at = NOW() WHERE command_id = ?`,
+		status, detail, commandID)
+	if err != nil {
+		log.Printf("Failed to record outcome of command %d: %v", commandID, err)
+	}
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"command_id": commandID, "status": status, "detail": detail})
+}
+
+// ListVehicleCommandsHandler lets fleet operators review the commands sent to
+// a vehicle, newest first
+func ListVehicleCommandsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT command_id, vehicle_id, user_id, reservation_id, command, status, detail,
+			DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(completed_at, '%Y-%m-%d %H:%i:%s')
+		FROM vehicle_commands
+		WHERE vehicle_id = ?
+		ORDER BY command_id DESC
+		LIMIT 100`, vehicleID)
+	if err != nil {
+		http.Error(w, "Failed to fetch commands", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	commands := []VehicleCommand{}
+	for rows.Next() {
+		var command VehicleCommand
+		if err := rows.Scan(&command.CommandID, &command.VehicleID, &command.UserID, &command.ReservationID, &command.Command,
+			&command.Status, &command.Detail, &command.CreatedAt, &command.CompletedAt); err != nil {
+			http.Error(w, "Error scanning command data", http.StatusInternalServerError)
+			return
+		}
+		commands = append(commands, command)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(commands)
+}
+
+// simulatedCommander stands in for vehicles that are not connected. Every
+// command succeeds, and lock and unlock are reported back as telemetry as a
+// real vehicle would.
+type simulatedCommander struct {
+	db *sql.DB
+}
+
+// Send carries out the command on the simulated vehicle
+func (s *simulatedCommander) Send(ctx context.Context, vehicleID int, command string) (CommandResult, error) {
+	switch command {
+	case commandLock, commandUnlock:
+		locked := command == commandLock
+		if err := recordTelemetry(s.db, vehicleID, TelemetrySample{Locked: &locked}, time.Now()); err != nil {
+			return CommandResult{}, err
+		}
+		return CommandResult{Success: true, Detail: "Doors " + command + "ed"}, nil
+	default:
+		return CommandResult{Success: true, Detail: "Horn sounded and lights flashed"}, nil
+	}
+}
+
+// mqttCommander sends commands on vehicles/{vehicle_id}/commands and matches
+// the answers vehicles publish on vehicles/{vehicle_id}/command-results
+type mqttCommander struct {
+	transport Transport
+
+	mu      sync.Mutex
+	pending map[string]pendingCommand
+}
+
+// pendingCommand is a command waiting for its vehicle's answer
+type pendingCommand struct {
+	vehicleID int
+	answer    chan CommandResult
+}
+
+// commandRequest struct for a command published to a vehicle
+type commandRequest struct {
+	CommandID string `json:"command_id"`
+	Command   string `json:"command"`
+}
+
+// commandResponse struct for a vehicle's answer to a commandRequest
+type commandResponse struct {
+	CommandID string `json:"command_id"`
+	CommandResult
+}
+
+// newMQTTCommander subscribes to command results on the transport
+func newMQTTCommander(transport Transport) (*mqttCommander, error) {
+	c := &mqttCommander{transport: transport, pending: map[string]pendingCommand{}}
+	if err := transport.Subscribe("vehicles/+/command-results", c.handleResult); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Send publishes the command and waits for the vehicle's answer or ctx to end
+func (c *mqttCommander) Send(ctx context.Context, vehicleID int, command string) (CommandResult, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return CommandResult{}, err
+	}
+	id := hex.EncodeToString(buf)
+
+	answer := make(chan CommandResult, 1)
+	c.mu.Lock()
+	c.pending[id] = pendingCommand{vehicleID: vehicleID, answer: answer}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := publishJSON(c.transport, vehicleTopic(vehicleID, "commands"), commandRequest{CommandID: id, Command: command}); err != nil {
+		return CommandResult{}, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	select {
+	case result := <-answer:
+		return result, nil
+	case <-ctx.Done():
+		return CommandResult{}, ctx.Err()
+	}
+}
+
+// handleResult passes a vehicle's answer to the command waiting for it.
+// Answers from a different vehicle than the command was sent to are ignored.
+func (c *mqttCommander) handleResult(topic string, payload []byte) {
+	vehicleID, err := strconv.Atoi(strings.Split(topic, "/")[1])
+	if err != nil {
+		return
+	}
+	var message commandResponse
+	if err := json.Unmarshal(payload, &message); err != nil {
+		log.Printf("Ignoring malformed command result on %s: %v", topic, err)
+		return
+	}
+
+	c.mu.Lock()
+	pending, ok := c.pending[message.CommandID]
+	c.mu.Unlock()
+	if !ok || pending.vehicleID != vehicleID {
+		return
+	}
+	select {
+	case pending.answer <- message.CommandResult:
+	default: // already answered
+	}
+}
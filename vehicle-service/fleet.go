@@ -0,0 +1,528 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxImportRows limits how many vehicles one CSV import can add
+const maxImportRows = 1000
+
+// FleetVehicle struct for a vehicle as seen by fleet operators
+type FleetVehicle struct {
+	Vehicle
+	Latitude        *float64 `json:"latitude"`
+	Longitude       *float64 `json:"longitude"`
+	LastServiceDate *string  `json:"last_service_date"`
+	RetiredAt       *string  `json:"retired_at"`
+	CreatedAt       string   `json:"created_at"`
+}
+
+// vehicleInput is the request body for adding or editing a vehicle. Omitted
+// fields are left unchanged on update.
+type vehicleInput struct {
+	Model        *string  `json:"model"`
+	LicensePlate *string  `json:"license_plate"`
+	ChargeLevel  *int     `json:"charge_level"`
+	Cleanliness  *string  `json:"cleanliness"`
+	Seats        *int     `json:"seats"`
+	PriceBand    *string  `json:"price_band"`
+	RangeKm      *int     `json:"range_km"`
+	Location     *string  `json:"location"`
+	Latitude     *float64 `json:"latitude"`
+	Longitude    *float64 `json:"longitude"`
+}
+
+// GetFleetVehicleHandler retrieves any vehicle, including retired ones
+func GetFleetVehicleHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	var vehicle FleetVehicle
+	var latitude, longitude sql.NullFloat64
+	var lastService, retiredAt sql.NullString
+	err = db.QueryRow(`
+		SELECT vehicle_id, model, license_plate, COALESCE(charge_level, 0), cleanliness, seats, price_band, range_km,
+			availability, COALESCE(location, ''), station_id, latitude, longitude,
+			DATE_FORMAT(last_service_date, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(retired_at, '%Y-%m-%d %H:%i:%s'),
+			DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')
+		FROM vehicles
+		WHERE vehicle_id = ?`, vehicleID).
+		Scan(&vehicle.VehicleID, &vehicle.Model, &vehicle.LicensePlate, &vehicle.ChargeLevel, &vehicle.Cleanliness, &vehicle.Seats,
+			&vehicle.PriceBand, &vehicle.RangeKm, &vehicle.Availability, &vehicle.Location, &vehicle.StationID, &latitude, &longitude,
+			&lastService, &retiredAt, &vehicle.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch vehicle", http.StatusInternalServerError)
+		return
+	}
+	if latitude.Valid && longitude.Valid {
+		vehicle.Latitude, vehicle.Longitude = &latitude.Float64, &longitude.Float64
+	}
+	if lastService.Valid {
+		vehicle.LastServiceDate = &lastService.String
+	}
+	if retiredAt.Valid {
+		vehicle.RetiredAt = &retiredAt.String
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vehicle)
+}
+
+// CreateVehicleHandler lets fleet operators add a vehicle to the fleet
+func CreateVehicleHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var data vehicleInput
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if message := data.validateNew(); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	db.QueryRow(`SELECT EXISTS(SELECT 1 FROM vehicles WHERE license_plate = ?)`, data.plate()).Scan(&exists)
+	if exists {
+		http.Error(w, "A vehicle with this licence plate already exists", http.StatusConflict)
+		return
+	}
+
+	vehicleID, err := insertVehicle(db, data)
+	if err != nil {
+		http.Error(w, "Failed to add vehicle", http.StatusInternalServerError)
+		return
+	}
+	scheduleCleaningIfFlagged(db, int(vehicleID), data)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"vehicle_id": vehicleID, "message": "Vehicle added successfully"})
+}
+
+// UpdateVehicleHandler lets fleet operators edit a vehicle's details or
+// relocate it. Station assignment has its own endpoint.
+func UpdateVehicleHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	var data vehicleInput
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if message := data.validate(); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+	if (data.Latitude == nil) != (data.Longitude == nil) {
+		http.Error(w, "latitude and longitude must be changed together", http.StatusBadRequest)
+		return
+	}
+
+	var retired bool
+	err = db.QueryRow(`SELECT retired_at IS NOT NULL FROM vehicles WHERE vehicle_id = ?`, vehicleID).Scan(&retired)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch vehicle", http.StatusInternalServerError)
+		return
+	}
+	if retired {
+		http.Error(w, "Retired vehicles cannot be changed", http.StatusConflict)
+		return
+	}
+
+	if data.LicensePlate != nil {
+		var taken bool
+		db.QueryRow(`SELECT EXISTS(SELECT 1 FROM vehicles WHERE license_plate = ? AND vehicle_id <> ?)`, data.plate(), vehicleID).Scan(&taken)
+		if taken {
+			http.Error(w, "A vehicle with this licence plate already exists", http.StatusConflict)
+			return
+		}
+	}
+
+	var sets []string
+	var args []interface{}
+	add := func(column string, value interface{}) {
+		sets = append(sets, column+" = ?")
+		args = append(args, value)
+	}
+	if data.Model != nil {
+		add("model", strings.TrimSpace(*data.Model))
+	}
+	if data.LicensePlate != nil {
+		add("license_plate", data.plate())
+	}
+	if data.ChargeLevel != nil {
+		add("charge_level", *data.ChargeLevel)
+	}
+	if data.Cleanliness != nil {
+		add("cleanliness", *data.Cleanliness)
+	}
+	if data.Seats != nil {
+		add("seats", *data.Seats)
+	}
+	if data.PriceBand != nil {
+		add("price_band", *data.PriceBand)
+	}
+	if data.RangeKm != nil {
+		add("range_km", *data.RangeKm)
+	}
+	if data.Location != nil {
+		add("location", strings.TrimSpace(*data.Location))
+	}
+	if data.Latitude != nil {
+		add("latitude", *data.Latitude)
+		add("longitude", *data.Longitude)
+	}
+	if len(sets) == 0 {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE vehicles SET `+strings.Join(sets, ", ")+` WHERE vehicle_id = ?`, append(args, vehicleID)...)
+	if err != nil {
+		http.Error(w, "Failed to update vehicle", http.StatusInternalServerError)
+		return
+	}
+	scheduleCleaningIfFlagged(db, vehicleID, data)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle updated successfully"})
+}
+
+// RetireVehicleHandler takes a vehicle out of service. The row is kept so
+// past reservations and rental history still refer to it.
+func RetireVehicleHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to retire vehicle", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var retired bool
+	err = tx.QueryRow(`SELECT retired_at IS NOT NULL FROM vehicles WHERE vehicle_id = ? FOR UPDATE`, vehicleID).Scan(&retired)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch vehicle", http.StatusInternalServerError)
+		return
+	}
+	if retired {
+		http.Error(w, "Vehicle is already retired", http.StatusConflict)
+		return
+	}
+
+	var active int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM reservations WHERE vehicle_id = ? AND status = 'Booked'`, vehicleID).Scan(&active)
+	if err != nil {
+		http.Error(w, "Failed to check reservations", http.StatusInternalServerError)
+		return
+	}
+	if active > 0 {
+		http.Error(w, "Vehicles with active bookings cannot be retired", http.StatusConflict)
+		return
+	}
+
+	// Retiring also frees the vehicle's station bay
+	_, err = tx.Exec(`UPDATE vehicles SET retired_at = NOW(), availability = FALSE, station_id = NULL WHERE vehicle_id = ?`, vehicleID)
+	if err != nil {
+		http.Error(w, "Failed to retire vehicle", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to retire vehicle", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle retired successfully"})
+}
+
+// ImportVehiclesHandler adds vehicles from a CSV request body. The header row
+// names the columns; model and license_plate are required and the others are
+// the optional fields of vehicleInput. Nothing is imported if any row is invalid.
+func ImportVehiclesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	reader := csv.NewReader(io.LimitReader(r.Body, 5<<20))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		http.Error(w, "The CSV file must start with a header row", http.StatusBadRequest)
+		return
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, known := vehicleCSVColumns[name]; !known {
+			http.Error(w, fmt.Sprintf("Unknown column %q", name), http.StatusBadRequest)
+			return
+		}
+		columns[name] = i
+	}
+
+	var vehicles []vehicleInput
+	var problems []string
+	plates := map[string]int{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(vehicles) == maxImportRows {
+			http.Error(w, fmt.Sprintf("At most %d vehicles can be imported at once", maxImportRows), http.StatusBadRequest)
+			return
+		}
+
+		vehicle, err := vehicleFromCSV(columns, record)
+		if err == nil {
+			if message := vehicle.validateNew(); message != "" {
+				err = errors.New(message)
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		if first, seen := plates[vehicle.plate()]; seen {
+			problems = append(problems, fmt.Sprintf("line %d: licence plate repeats line %d", line, first))
+			continue
+		}
+		plates[vehicle.plate()] = line
+		vehicles = append(vehicles, vehicle)
+	}
+	if len(vehicles) == 0 && len(problems) == 0 {
+		http.Error(w, "The CSV file has no vehicles", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to import vehicles", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for plate, line := range plates {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM vehicles WHERE license_plate = ?)`, plate).Scan(&exists); err != nil {
+			http.Error(w, "Failed to import vehicles", http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			problems = append(problems, fmt.Sprintf("line %d: a vehicle with licence plate %s already exists", line, plate))
+		}
+	}
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "No vehicles were imported", "errors": problems})
+		return
+	}
+
+	for _, vehicle := range vehicles {
+		vehicleID, err := insertVehicle(tx, vehicle)
+		if err != nil {
+			http.Error(w, "Failed to import vehicles", http.StatusInternalServerError)
+			return
+		}
+		if vehicle.Cleanliness != nil && *vehicle.Cleanliness == "Needs Cleaning" {
+			if _, err := ensureMaintenanceTask(tx, int(vehicleID), taskCleaning, "Vehicle flagged as needing cleaning"); err != nil {
+				http.Error(w, "Failed to import vehicles", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to import vehicles", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"imported": len(vehicles), "message": "Vehicles imported successfully"})
+}
+
+// vehicleCSVColumns lists the columns an import may contain
+var vehicleCSVColumns = map[string]bool{
+	"model": true, "license_plate": true, "charge_level": true, "cleanliness": true, "seats": true,
+	"price_band": true, "range_km": true, "location": true, "latitude": true, "longitude": true,
+}
+
+// vehicleFromCSV converts a CSV record to a vehicleInput. Empty cells are
+// treated as omitted.
+func vehicleFromCSV(columns map[string]int, record []string) (vehicleInput, error) {
+	var vehicle vehicleInput
+	cell := func(name string) (string, bool) {
+		i, ok := columns[name]
+		if !ok || i >= len(record) || strings.TrimSpace(record[i]) == "" {
+			return "", false
+		}
+		return strings.TrimSpace(record[i]), true
+	}
+
+	for name, target := range map[string]**string{
+		"model": &vehicle.Model, "license_plate": &vehicle.LicensePlate, "cleanliness": &vehicle.Cleanliness,
+		"price_band": &vehicle.PriceBand, "location": &vehicle.Location,
+	} {
+		if value, ok := cell(name); ok {
+			*target = &value
+		}
+	}
+	for name, target := range map[string]**int{"charge_level": &vehicle.ChargeLevel, "seats": &vehicle.Seats, "range_km": &vehicle.RangeKm} {
+		if value, ok := cell(name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return vehicle, fmt.Errorf("%s must be a whole number", name)
+			}
+			*target = &n
+		}
+	}
+	for name, target := range map[string]**float64{"latitude": &vehicle.Latitude, "longitude": &vehicle.Longitude} {
+		if value, ok := cell(name); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return vehicle, fmt.Errorf("%s must be a number", name)
+			}
+			*target = &f
+		}
+	}
+	return vehicle, nil
+}
+
+// insertVehicle adds a validated vehicle, filling in defaults for omitted specs
+func insertVehicle(exec interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, vehicle vehicleInput) (int64, error) {
+	chargeLevel, cleanliness, seats, priceBand, rangeKm := 100, "Clean", 5, "Standard", defaultRangeKm
+	if vehicle.ChargeLevel != nil {
+		chargeLevel = *vehicle.ChargeLevel
+	}
+	if vehicle.Cleanliness != nil {
+		cleanliness = *vehicle.Cleanliness
+	}
+	if vehicle.Seats != nil {
+		seats = *vehicle.Seats
+	}
+	if vehicle.PriceBand != nil {
+		priceBand = *vehicle.PriceBand
+	}
+	if vehicle.RangeKm != nil {
+		rangeKm = *vehicle.RangeKm
+	}
+
+	result, err := exec.Exec(`
+		INSERT INTO vehicles (model, license_plate, charge_level, cleanliness, seats, price_band, range_km, availability, location, latitude, longitude)
+		VALUES (?, ?, ?, ?, ?, ?, ?, TRUE, NULLIF(?, ''), ?, ?)`,
+		strings.TrimSpace(*vehicle.Model), vehicle.plate(), chargeLevel, cleanliness, seats, priceBand, rangeKm,
+		strings.TrimSpace(stringValue(vehicle.Location)), vehicle.Latitude, vehicle.Longitude)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// validateNew checks a vehicle being added, which needs a model, a plate and
+// either both coordinates or neither
+func (v *vehicleInput) validateNew() string {
+	if v.Model == nil || v.LicensePlate == nil {
+		return "model and license_plate are required"
+	}
+	if (v.Latitude == nil) != (v.Longitude == nil) {
+		return "latitude and longitude must be given together"
+	}
+	return v.validate()
+}
+
+// validate checks the fields that are present, normalising enum values, and
+// returns a message for the first invalid one
+func (v *vehicleInput) validate() string {
+	if v.Model != nil && (strings.TrimSpace(*v.Model) == "" || len(*v.Model) > 255) {
+		return "model must be 1 to 255 characters"
+	}
+	if v.LicensePlate != nil && (v.plate() == "" || len(v.plate()) > 50) {
+		return "license_plate must be 1 to 50 characters"
+	}
+	if v.ChargeLevel != nil && (*v.ChargeLevel < 0 || *v.ChargeLevel > 100) {
+		return "charge_level must be between 0 and 100"
+	}
+	if v.Cleanliness != nil {
+		value, ok := matchEnum(*v.Cleanliness, cleanlinessValues)
+		if !ok {
+			return "cleanliness must be Clean or Needs Cleaning"
+		}
+		v.Cleanliness = &value
+	}
+	if v.Seats != nil && (*v.Seats < 1 || *v.Seats > 99) {
+		return "seats must be between 1 and 99"
+	}
+	if v.PriceBand != nil {
+		value, ok := matchEnum(*v.PriceBand, priceBands)
+		if !ok {
+			return "price_band must be Economy, Standard or Premium"
+		}
+		v.PriceBand = &value
+	}
+	if v.RangeKm != nil && (*v.RangeKm < 1 || *v.RangeKm > 2000) {
+		return "range_km must be between 1 and 2000"
+	}
+	if v.Location != nil && len(*v.Location) > 255 {
+		return "location must be at most 255 characters"
+	}
+	if v.Latitude != nil && (*v.Latitude < -90 || *v.Latitude > 90) {
+		return "latitude must be between -90 and 90"
+	}
+	if v.Longitude != nil && (*v.Longitude < -180 || *v.Longitude > 180) {
+		return "longitude must be between -180 and 180"
+	}
+	return ""
+}
+
+// scheduleCleaningIfFlagged schedules cleaning straight away when a vehicle is
+// marked as needing it, rather than waiting for the maintenance job
+func scheduleCleaningIfFlagged(db *sql.DB, vehicleID int, vehicle vehicleInput) {
+	if vehicle.Cleanliness == nil || *vehicle.Cleanliness != "Needs Cleaning" {
+		return
+	}
+	if _, err := ensureMaintenanceTask(db, vehicleID, taskCleaning, "Vehicle flagged as needing cleaning"); err != nil {
+		log.Printf("Failed to schedule cleaning for vehicle %d: %v", vehicleID, err)
+	}
+}
+
+// plate returns the licence plate in the form it is stored
+func (v *vehicleInput) plate() string {
+	return strings.ToUpper(strings.TrimSpace(stringValue(v.LicensePlate)))
+}
@@ -3,9 +3,15 @@ module vehicle-service
 go 1.23.3
 
 require (
+	auth v0.0.0
 	github.com/go-sql-driver/mysql v1.8.1 // direct
 	github.com/gorilla/mux v1.8.1 // direct
 	github.com/joho/godotenv v1.5.1 // direct
 )
 
-require filippo.io/edwards25519 v1.1.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/golang-jwt/jwt/v4 v4.5.1 // indirect
+)
+
+replace auth => ../auth
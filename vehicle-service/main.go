@@ -3,17 +3,24 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 
+	"auth"
+
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
+// JWT secret key
+var jwtKey []byte
+
+// Shared secret for verifying identity headers signed by the gateway
+var gatewayKey []byte
+
 func main() {
 	// Load environment variables
 	err := godotenv.Load(".env")
@@ -22,6 +29,12 @@ func main() {
 	}
 
 	dbDSN := os.Getenv("DB_DSN")
+	jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
+	gatewayKey = []byte(os.Getenv("GATEWAY_SECRET"))
+	bookingRange, err = loadRangePolicy()
+	if err != nil {
+		log.Fatalf("Invalid range settings: %v", err)
+	}
 
 	// Connect to the database
 	db, err := sql.Open("mysql", dbDSN)
@@ -30,83 +43,166 @@ func main() {
 	}
 	defer db.Close()
 
+	// Vehicles report telemetry and receive commands over MQTT
+	transport, err := newTransport(db)
+	if err != nil {
+		log.Fatalf("Failed to start MQTT transport: %v", err)
+	}
+	defer transport.Close()
+	if err := subscribeTelemetry(db, transport); err != nil {
+		log.Fatalf("Failed to subscribe to telemetry: %v", err)
+	}
+	commander, err := newCommander(db, transport)
+	if err != nil {
+		log.Fatalf("Failed to set up vehicle commands: %v", err)
+	}
+
 	// Initialize router
 	r := mux.NewRouter()
 
-	// Vehicle endpoints
+	authenticator := auth.New(jwtKey, gatewayKey).WithSessions(auth.NewSessionStore(db)).WithAudit(auth.NewAuditStore(db))
+
+	// Public vehicle catalogue endpoints. Position and telemetry are shown
+	// to fleet operators and drivers according to who is asking.
 	r.HandleFunc("/vehicles", func(w http.ResponseWriter, r *http.Request) { GetVehiclesHandler(w, r, db) }).Methods("GET")
-	r.HandleFunc("/book-vehicle", func(w http.ResponseWriter, r *http.Request) { BookVehicleHandler(w, r, db) }).Methods("POST")
-	r.HandleFunc("/modify-booking", func(w http.ResponseWriter, r *http.Request) { ModifyBookingHandler(w, r, db) }).Methods("PATCH")
-	r.HandleFunc("/cancel-booking", func(w http.ResponseWriter, r *http.Request) { CancelBookingHandler(w, r, db) }).Methods("DELETE")
-	r.HandleFunc("/vehicle-status/{vehicle_id}", func(w http.ResponseWriter, r *http.Request) { GetVehicleStatusHandler(w, r, db) }).Methods("GET")
-	r.HandleFunc("/find-reservationid", func(w http.ResponseWriter, r *http.Request) { FindReservationIDHandler(w, r, db) }).Methods("POST")
-	r.HandleFunc("/update-history", func(w http.ResponseWriter, r *http.Request) { UpdateHistoryHandler(w, r, db) }).Methods("POST")
-	r.HandleFunc("/retrieve-model", func(w http.ResponseWriter, r *http.Request) { RetrieveModelHandler(w, r, db) }).Methods("POST")
-	r.HandleFunc("/retrieve-vehid", func(w http.ResponseWriter, r *http.Request) { RetrieveVehicleIDHandler(w, r, db) }).Methods("POST")
+	public := r.NewRoute().Subrouter()
+	public.Use(authenticator.OptionalMiddleware)
+	public.HandleFunc("/vehicles/nearby", func(w http.ResponseWriter, r *http.Request) { NearbyVehiclesHandler(w, r, db) }).Methods("GET")
+	public.HandleFunc("/vehicle-status/{vehicle_id}", func(w http.ResponseWriter, r *http.Request) { GetVehicleStatusHandler(w, r, db) }).Methods("GET")
+	r.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) { ListStationsHandler(w, r, db) }).Methods("GET")
+	r.HandleFunc("/stations/{station_id}", func(w http.ResponseWriter, r *http.Request) { GetStationHandler(w, r, db) }).Methods("GET")
+
+	// Calendar feeds are authenticated by the secret token in the URL and
+	// telemetry by the vehicle's device token
+	r.HandleFunc("/calendar/{token:[A-Za-z0-9_-]+}.ics", func(w http.ResponseWriter, r *http.Request) { CalendarHandler(w, r, db) }).Methods("GET")
+	r.HandleFunc("/telemetry", func(w http.ResponseWriter, r *http.Request) { TelemetryHandler(w, r, db) }).Methods("POST")
+
+	// Booking endpoints also accept API keys with the matching scope
+	scoped := r.NewRoute().Subrouter()
+	scoped.Use(authenticator.WithAPIKeys(auth.NewAPIKeyStore(db)).Middleware)
+
+	readBookings := scoped.NewRoute().Subrouter()
+	readBookings.Use(auth.RequireScope(auth.ScopeReadBookings))
+	readBookings.HandleFunc("/reservations", func(w http.ResponseWriter, r *http.Request) { ListReservationsHandler(w, r, db) }).Methods("GET")
+	readBookings.HandleFunc("/rental-history", func(w http.ResponseWriter, r *http.Request) { RentalHistoryHandler(w, r, db) }).Methods("GET")
+
+	writeBookings := scoped.NewRoute().Subrouter()
+	writeBookings.Use(auth.RequireScope(auth.ScopeWriteBookings))
+	writeBookings.HandleFunc("/book-vehicle", func(w http.ResponseWriter, r *http.Request) { BookVehicleHandler(w, r, db) }).Methods("POST")
+	writeBookings.HandleFunc("/modify-booking", func(w http.ResponseWriter, r *http.Request) { ModifyBookingHandler(w, r, db) }).Methods("PATCH")
+	writeBookings.HandleFunc("/cancel-booking", func(w http.ResponseWriter, r *http.Request) { CancelBookingHandler(w, r, db) }).Methods("DELETE")
+	writeBookings.HandleFunc("/damage-reports", func(w http.ResponseWriter, r *http.Request) { SubmitDamageReportHandler(w, r, db) }).Methods("POST")
+	writeBookings.HandleFunc("/return-vehicle", func(w http.ResponseWriter, r *http.Request) { ReturnVehicleHandler(w, r, db) }).Methods("POST")
+
+	// Remaining endpoints require a valid JWT
+	protected := r.NewRoute().Subrouter()
+	protected.Use(authenticator.Middleware)
+	protected.HandleFunc("/calendar-feed", func(w http.ResponseWriter, r *http.Request) { CalendarFeedHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/calendar-feed", func(w http.ResponseWriter, r *http.Request) { DeleteCalendarFeedHandler(w, r, db) }).Methods("DELETE")
+	protected.HandleFunc("/find-reservationid", func(w http.ResponseWriter, r *http.Request) { FindReservationIDHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/update-history", func(w http.ResponseWriter, r *http.Request) { UpdateHistoryHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/retrieve-model", func(w http.ResponseWriter, r *http.Request) { RetrieveModelHandler(w, r, db) }).Methods("POST")
+	protected.HandleFunc("/retrieve-vehid", func(w http.ResponseWriter, r *http.Request) { RetrieveVehicleIDHandler(w, r, db) }).Methods("POST")
+
+	// Called by the user service when an account is deleted
+	protected.HandleFunc("/damage-reports/photos", func(w http.ResponseWriter, r *http.Request) { DeleteReporterPhotosHandler(w, r, db) }).Methods("DELETE")
+
+	// Unlocking a car needs the driver's own login, never an API key
+	protected.HandleFunc("/vehicles/{vehicle_id:[0-9]+}/commands", func(w http.ResponseWriter, r *http.Request) {
+		SendVehicleCommandHandler(w, r, db, commander)
+	}).Methods("POST")
+
+	// Fleet and station management is limited to fleet operators
+	fleet := protected.NewRoute().Subrouter()
+	fleet.Use(auth.RequireRole(auth.RoleFleetOperator))
+	fleet.HandleFunc("/stations", func(w http.ResponseWriter, r *http.Request) { CreateStationHandler(w, r, db) }).Methods("POST")
+	fleet.HandleFunc("/stations/{station_id}", func(w http.ResponseWriter, r *http.Request) { UpdateStationHandler(w, r, db) }).Methods("PATCH")
+	fleet.HandleFunc("/vehicles", func(w http.ResponseWriter, r *http.Request) { CreateVehicleHandler(w, r, db) }).Methods("POST")
+	fleet.HandleFunc("/vehicles/import", func(w http.ResponseWriter, r *http.Request) { ImportVehiclesHandler(w, r, db) }).Methods("POST")
+	fleet.HandleFunc("/vehicles/{vehicle_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) { GetFleetVehicleHandler(w, r, db) }).Methods("GET")
+	fleet.HandleFunc("/vehicles/{vehicle_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) { UpdateVehicleHandler(w, r, db) }).Methods("PATCH")
+	fleet.HandleFunc("/vehicles/{vehicle_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) { RetireVehicleHandler(w, r, db) }).Methods("DELETE")
+	fleet.HandleFunc("/vehicles/{vehicle_id:[0-9]+}/device-token", func(w http.ResponseWriter, r *http.Request) { IssueDeviceTokenHandler(w, r, db) }).Methods("POST")
+	fleet.HandleFunc("/vehicles/{vehicle_id:[0-9]+}/telemetry", func(w http.ResponseWriter, r *http.Request) { TelemetryHistoryHandler(w, r, db) }).Methods("GET")
+	fleet.HandleFunc("/vehicles/{vehicle_id:[0-9]+}/commands", func(w http.ResponseWriter, r *http.Request) { ListVehicleCommandsHandler(w, r, db) }).Methods("GET")
+	fleet.HandleFunc("/vehicles/{vehicle_id:[0-9]+}/maintenance-tasks", func(w http.ResponseWriter, r *http.Request) {
+		CreateMaintenanceTaskHandler(w, r, db)
+	}).Methods("POST")
+	fleet.HandleFunc("/maintenance-tasks", func(w http.ResponseWriter, r *http.Request) { ListMaintenanceTasksHandler(w, r, db) }).Methods("GET")
+	fleet.HandleFunc("/maintenance-tasks/{task_id:[0-9]+}/complete", func(w http.ResponseWriter, r *http.Request) {
+		CompleteMaintenanceTaskHandler(w, r, db)
+	}).Methods("POST")
+	fleet.HandleFunc("/maintenance-tasks/{task_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) { CancelMaintenanceTaskHandler(w, r, db) }).Methods("DELETE")
+	fleet.HandleFunc("/damage-reports", func(w http.ResponseWriter, r *http.Request) { ListDamageReportsHandler(w, r, db) }).Methods("GET")
+	fleet.HandleFunc("/damage-reports/{report_id:[0-9]+}/photos/{photo_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		DamageReportPhotoHandler(w, r, db)
+	}).Methods("GET")
+	fleet.HandleFunc("/damage-reports/{report_id:[0-9]+}/review", func(w http.ResponseWriter, r *http.Request) {
+		ReviewDamageReportHandler(w, r, db)
+	}).Methods("POST")
+	fleet.HandleFunc("/vehicles/{vehicle_id}/station", func(w http.ResponseWriter, r *http.Request) { AssignVehicleStationHandler(w, r, db) }).Methods("PATCH")
+
+	// Cleaning and servicing tasks are scheduled in the background
+	if err := startMaintenanceJob(db); err != nil {
+		log.Fatalf("Invalid maintenance settings: %v", err)
+	}
 
 	// Start server
 	log.Println("Vehicle service running on port 8083")
 	log.Fatal(http.ListenAndServe(":8083", r))
 }
 
-// GetVehiclesHandler retrieves all vehicles with optional filters
-func GetVehiclesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	query := `SELECT vehicle_id, model, license_plate, charge_level, availability, location FROM vehicles WHERE 1=1`
+// BookVehicleHandler books a vehicle for a specified time range
+func BookVehicleHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	// Bookings are always made for the authenticated user
+	authUser, _ := auth.UserFromContext(r.Context())
 
-	// Filter by availability if provided
-	availability := r.URL.Query().Get("availability")
-	if availability != "" {
-		query += " AND availability = " + availability
+	var data struct {
+		VehicleID        int    `json:"vehicle_id"`
+		StartTime        string `json:"start_time"`
+		EndTime          string `json:"end_time"`
+		ChargeTo         string `json:"charge_to"` // "personal" (default) or "organisation"
+		PickupStationID  *int   `json:"pickup_station_id"`
+		DropoffStationID *int   `json:"dropoff_station_id"`
+		// Optional; without it the distance is estimated from the booking's length
+		PlannedDistanceKm *float64 `json:"planned_distance_km"`
 	}
 
-	rows, err := db.Query(query)
+	err := json.NewDecoder(r.Body).Decode(&data)
 	if err != nil {
-		http.Error(w, "Failed to fetch vehicles", http.StatusInternalServerError)
+		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
-	var vehicles []struct {
-		VehicleID    int    `json:"vehicle_id"`
-		Model        string `json:"model"`
-		LicensePlate string `json:"license_plate"`
-		ChargeLevel  int    `json:"charge_level"`
-		Availability bool   `json:"availability"`
-		Location     string `json:"location"`
+	if !checkLicence(w, db, authUser.ID, data.EndTime) {
+		return
 	}
 
-	for rows.Next() {
-		var vehicle struct {
-			VehicleID    int    `json:"vehicle_id"`
-			Model        string `json:"model"`
-			LicensePlate string `json:"license_plate"`
-			ChargeLevel  int    `json:"charge_level"`
-			Availability bool   `json:"availability"`
-			Location     string `json:"location"`
-		}
-		if err := rows.Scan(&vehicle.VehicleID, &vehicle.Model, &vehicle.LicensePlate, &vehicle.ChargeLevel, &vehicle.Availability, &vehicle.Location); err != nil {
-			http.Error(w, "Error scanning vehicle data", http.StatusInternalServerError)
-			return
-		}
-		vehicles = append(vehicles, vehicle)
+	trip, ok := bookingStations(w, db, data.VehicleID, data.PickupStationID, data.DropoffStationID)
+	if !ok || !checkStationHours(w, db, trip, data.StartTime, data.EndTime) {
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(vehicles)
-}
-
-// BookVehicleHandler books a vehicle for a specified time range
-func BookVehicleHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	var data struct {
-		UserID    int    `json:"user_id"`
-		VehicleID int    `json:"vehicle_id"`
-		StartTime string `json:"start_time"`
-		EndTime   string `json:"end_time"`
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to book vehicle", http.StatusInternalServerError)
+		return
 	}
+	defer tx.Rollback()
 
-	err := json.NewDecoder(r.Body).Decode(&data)
-	if err != nil {
-		http.Error(w, "Invalid input", http.StatusBadRequest)
+	// Bookings charged to an organisation must stay within its spending limit.
+	// The check holds the organisation until the booking is written.
+	var orgID sql.NullInt64
+	switch data.ChargeTo {
+	case "", "personal":
+	case "organisation":
+		id, ok := bookingOrganisation(w, db, authUser.ID)
+		if !ok || !checkSpendingLimit(w, tx, id, authUser.Tier, data.StartTime, data.EndTime, trip.OneWayFee, 0) {
+			return
+		}
+		orgID = sql.NullInt64{Int64: int64(id), Valid: true}
+	default:
+		http.Error(w, "charge_to must be personal or organisation", http.StatusBadRequest)
 		return
 	}
 
@@ -117,28 +213,47 @@ func BookVehicleHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		http.Error(w, "Vehicle not available", http.StatusConflict)
 		return
 	}
+	if !checkMaintenance(w, db, data.VehicleID, data.StartTime, data.EndTime) {
+		return
+	}
+	rangeWarning, ok := checkBookingRange(w, db, data.VehicleID, data.StartTime, data.EndTime, data.PlannedDistanceKm, true)
+	if !ok {
+		return
+	}
 
 	// Create a reservation
-	_, err = db.Exec(`INSERT INTO reservations (user_id, vehicle_id, start_time, end_time, status, created_at) VALUES (?, ?, ?, ?, 'Booked', NOW())`,
-		data.UserID, data.VehicleID, data.StartTime, data.EndTime)
+	_, err = tx.Exec(`
+		INSERT INTO reservations (user_id, vehicle_id, start_time, end_time, status, org_id, pickup_station_id, dropoff_station_id, one_way_fee, created_at)
+		VALUES (?, ?, ?, ?, 'Booked', ?, ?, ?, ?, NOW())`,
+		authUser.ID, data.VehicleID, data.StartTime, data.EndTime, orgID, trip.Pickup, trip.Dropoff, trip.OneWayFee)
 	if err != nil {
 		http.Error(w, "Failed to book vehicle", http.StatusInternalServerError)
 		return
 	}
 
 	// Mark the vehicle as unavailable
-	_, err = db.Exec(`UPDATE vehicles SET availability = FALSE WHERE vehicle_id = ?`, data.VehicleID)
+	_, err = tx.Exec(`UPDATE vehicles SET availability = FALSE WHERE vehicle_id = ?`, data.VehicleID)
 	if err != nil {
 		http.Error(w, "Failed to update vehicle availability", http.StatusInternalServerError)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to book vehicle", http.StatusInternalServerError)
+		return
+	}
 
+	response := map[string]interface{}{"message": "Vehicle booked successfully", "one_way_fee": trip.OneWayFee}
+	if rangeWarning != "" {
+		response["range_warning"] = rangeWarning
+	}
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle booked successfully"})
+	json.NewEncoder(w).Encode(response)
 }
 
-// ModifyBookingHandler modifies an existing reservation
+// ModifyBookingHandler modifies an existing reservation owned by the authenticated user
 func ModifyBookingHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
 	var data struct {
 		ReservationID int    `json:"reservation_id"`
 		StartTime     string `json:"start_time"`
@@ -151,20 +266,73 @@ func ModifyBookingHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
+	if !checkReservationOwner(w, db, data.ReservationID, authUser) {
+		return
+	}
+
+	// The licence checked is the reservation owner's, which matters when an operator edits it
+	var ownerID, vehicleID int
+	var ownerTier string
+	var orgID sql.NullInt64
+	var trip stationTrip
+	err = db.QueryRow(`
+		SELECT reservations.user_id, reservations.vehicle_id, users.membership_tier, reservations.org_id,
+			reservations.pickup_station_id, reservations.dropoff_station_id, reservations.one_way_fee
+		FROM reservations
+		JOIN users ON users.user_id = reservations.user_id
+		WHERE reservations.reservation_id = ?`, data.ReservationID).Scan(&ownerID, &vehicleID, &ownerTier, &orgID, &trip.Pickup, &trip.Dropoff, &trip.OneWayFee)
+	if err != nil {
+		http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
+		return
+	}
+	if !checkLicence(w, db, ownerID, data.EndTime) || !checkStationHours(w, db, trip, data.StartTime, data.EndTime) {
+		return
+	}
+
+	// The spending limit check holds the organisation until the change is written
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to modify booking", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if orgID.Valid && !checkSpendingLimit(w, tx, int(orgID.Int64), ownerTier, data.StartTime, data.EndTime, trip.OneWayFee, data.ReservationID) {
+		return
+	}
+
+	if !checkMaintenance(w, db, vehicleID, data.StartTime, data.EndTime) {
+		return
+	}
+
+	// The vehicle is already reserved, so a longer booking only warns about its range
+	rangeWarning, ok := checkBookingRange(w, db, vehicleID, data.StartTime, data.EndTime, nil, false)
+	if !ok {
+		return
+	}
+
 	// Update the reservation
-	_, err = db.Exec(`UPDATE reservations SET start_time = ?, end_time = ? WHERE reservation_id = ? AND status = 'Booked'`,
+	_, err = tx.Exec(`UPDATE reservations SET start_time = ?, end_time = ? WHERE reservation_id = ? AND status = 'Booked'`,
 		data.StartTime, data.EndTime, data.ReservationID)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		http.Error(w, "Failed to modify booking", http.StatusInternalServerError)
 		return
 	}
 
+	response := map[string]string{"message": "Booking modified successfully"}
+	if rangeWarning != "" {
+		response["range_warning"] = rangeWarning
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Booking modified successfully"})
+	json.NewEncoder(w).Encode(response)
 }
 
 // CancelBookingHandler cancels a reservation by removing entries from billing and reservations and updates vehicle availability
 func CancelBookingHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
 	var data struct {
 		ReservationID int `json:"reservation_id"`
 	}
@@ -176,15 +344,15 @@ func CancelBookingHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
+	if !checkReservationOwner(w, db, data.ReservationID, authUser) {
+		return
+	}
+
 	// Get the vehicle ID associated with the reservation
 	var vehicleID int
 	err = db.QueryRow(`SELECT vehicle_id FROM reservations WHERE reservation_id = ?`, data.ReservationID).Scan(&vehicleID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Reservation not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
-		}
+		http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
 		return
 	}
 
@@ -214,7 +382,9 @@ func CancelBookingHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "Reservation and billing records cancelled successfully"})
 }
 
-// GetVehicleStatusHandler retrieves the status of a specific vehicle
+// GetVehicleStatusHandler retrieves the status of a specific vehicle. The
+// latest telemetry is only shown to fleet operators and to the driver whose
+// booking is in progress; others see the position of vehicles on offer.
 func GetVehicleStatusHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	vars := mux.Vars(r)
 	vehicleID, err := strconv.Atoi(vars["vehicle_id"])
@@ -223,29 +393,73 @@ func GetVehicleStatusHandler(w http.ResponseWriter, r *http.Request, db *sql.DB)
 		return
 	}
 
+	// Telemetry readings are null until the vehicle has reported them
 	var vehicle struct {
-		VehicleID   int    `json:"vehicle_id"`
-		Model       string `json:"model"`
-		ChargeLevel int    `json:"charge_level"`
-		Location    string `json:"location"`
+		VehicleID   int      `json:"vehicle_id"`
+		Model       string   `json:"model"`
+		ChargeLevel int      `json:"charge_level"`
+		Location    string   `json:"location"`
+		Latitude    *float64 `json:"latitude"`
+		Longitude   *float64 `json:"longitude"`
+		OdometerKm  *float64 `json:"odometer_km"`
+		Locked      *bool    `json:"locked"`
+		TelemetryAt *string  `json:"telemetry_at"`
+	}
+
+	var offered bool
+	err = db.QueryRow(`
+		SELECT vehicle_id, model, charge_level, location, latitude, longitude, odometer_km, locked,
+			DATE_FORMAT(telemetry_at, '%Y-%m-%d %H:%i:%s'), `+offeredSQL+`
+		FROM vehicles
+		WHERE vehicle_id = ?`, bookingRange.MinCharge, vehicleID).
+		Scan(&vehicle.VehicleID, &vehicle.Model, &vehicle.ChargeLevel, &vehicle.Location, &vehicle.Latitude, &vehicle.Longitude,
+			&vehicle.OdometerKm, &vehicle.Locked, &vehicle.TelemetryAt, &offered)
+	if err != nil {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
 	}
 
-	err = db.QueryRow(`SELECT vehicle_id, model, charge_level, location FROM vehicles WHERE vehicle_id = ?`, vehicleID).
-		Scan(&vehicle.VehicleID, &vehicle.Model, &vehicle.ChargeLevel, &vehicle.Location)
+	authUser, _ := auth.UserFromContext(r.Context())
+	telemetry, err := canSeeTelemetry(db, authUser, vehicleID)
 	if err != nil {
-		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		http.Error(w, "Failed to check reservation", http.StatusInternalServerError)
 		return
 	}
+	if !telemetry {
+		vehicle.OdometerKm, vehicle.Locked, vehicle.TelemetryAt = nil, nil, nil
+		if !offered {
+			vehicle.Latitude, vehicle.Longitude = nil, nil
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(vehicle)
 }
 
-// FindReservationIDHandler retrieves the reservation_id based on user_id, vehicle_id, start_time, and end_time from JSON input
+// canSeeTelemetry reports whether user may see a vehicle's live telemetry:
+// fleet operators always can, and drivers only during their booking
+func canSeeTelemetry(db *sql.DB, user auth.User, vehicleID int) (bool, error) {
+	if user.ID == 0 {
+		return false, nil
+	}
+	if user.HasAnyRole(auth.RoleFleetOperator) {
+		return true, nil
+	}
+	var driving bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM reservations
+			WHERE vehicle_id = ? AND user_id = ? AND status = 'Booked' AND start_time <= NOW() AND end_time > NOW())`,
+		vehicleID, user.ID).Scan(&driving)
+	return driving, err
+}
+
+// FindReservationIDHandler retrieves the authenticated user's reservation_id based on vehicle_id, start_time, and end_time from JSON input
 func FindReservationIDHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
 	// Define the expected input structure
 	var input struct {
-		UserID    int    `json:"user_id"`
 		VehicleID int    `json:"vehicle_id"`
 		StartTime string `json:"start_time"`
 		EndTime   string `json:"end_time"`
@@ -259,8 +473,8 @@ func FindReservationIDHandler(w http.ResponseWriter, r *http.Request, db *sql.DB
 	}
 
 	// Validate required fields
-	if input.UserID == 0 || input.VehicleID == 0 || input.StartTime == "" || input.EndTime == "" {
-		http.Error(w, "All fields (user_id, vehicle_id, start_time, end_time) are required", http.StatusBadRequest)
+	if input.VehicleID == 0 || input.StartTime == "" || input.EndTime == "" {
+		http.Error(w, "All fields (vehicle_id, start_time, end_time) are required", http.StatusBadRequest)
 		return
 	}
 
@@ -270,7 +484,7 @@ func FindReservationIDHandler(w http.ResponseWriter, r *http.Request, db *sql.DB
         SELECT reservation_id 
         FROM reservations 
         WHERE user_id = ? AND vehicle_id = ? AND start_time = ? AND end_time = ?`,
-		input.UserID, input.VehicleID, input.StartTime, input.EndTime).Scan(&reservationID)
+		authUser.ID, input.VehicleID, input.StartTime, input.EndTime).Scan(&reservationID)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -286,10 +500,11 @@ func FindReservationIDHandler(w http.ResponseWriter, r *http.Request, db *sql.DB
 	json.NewEncoder(w).Encode(map[string]int{"reservation_id": reservationID})
 }
 
-// UpdateHistoryHandler updates the user's rental history with a new booking
+// UpdateHistoryHandler updates the authenticated user's rental history with a new booking
 func UpdateHistoryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
 	var data struct {
-		UserID    int     `json:"user_id"`
 		VehicleID int     `json:"vehicle_id"`
 		StartTime string  `json:"start_time"`
 		EndTime   string  `json:"end_time"`
@@ -297,7 +512,6 @@ func UpdateHistoryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&data)
-	fmt.Println(err)
 	if err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
@@ -307,7 +521,7 @@ func UpdateHistoryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	_, err = db.Exec(`
         INSERT INTO rental_history (user_id, vehicle_id, start_time, end_time, total_cost)
         VALUES (?, ?, ?, ?, ?)`,
-		data.UserID, data.VehicleID, data.StartTime, data.EndTime, data.TotalCost)
+		authUser.ID, data.VehicleID, data.StartTime, data.EndTime, data.TotalCost)
 	if err != nil {
 		http.Error(w, "Failed to update rental history", http.StatusInternalServerError)
 		return
@@ -390,3 +604,141 @@ func RetrieveVehicleIDHandler(w http.ResponseWriter, r *http.Request, db *sql.DB
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]int{"vehicle_id": vehicleID})
 }
+
+// Reservation struct for reservation listings
+type Reservation struct {
+	ReservationID int    `json:"reservation_id"`
+	VehicleID     int    `json:"vehicle_id"`
+	VehicleModel  string `json:"vehicle_model"`
+	StartTime     string `json:"start_time"`
+	EndTime       string `json:"end_time"`
+	Status        string `json:"status"`
+	CreatedAt     string `json:"created_at"`
+}
+
+// RentalHistory struct for rental history listings
+type RentalHistory struct {
+	VehicleID    int     `json:"vehicle_id"`
+	VehicleModel string  `json:"vehicle_model"`
+	StartTime    string  `json:"start_time"`
+	EndTime      string  `json:"end_time"`
+	TotalCost    float64 `json:"total_cost"`
+}
+
+// ListReservationsHandler retrieves all reservations of the authenticated user
+func ListReservationsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	rows, err := db.Query(`
+		SELECT reservations.reservation_id, reservations.vehicle_id, vehicles.model,
+			DATE_FORMAT(reservations.start_time, '%Y-%m-%d %H:%i:%s'),
+			DATE_FORMAT(reservations.end_time, '%Y-%m-%d %H:%i:%s'),
+			reservations.status,
+			DATE_FORMAT(reservations.created_at, '%Y-%m-%d %H:%i:%s')
+		FROM reservations
+		JOIN vehicles ON vehicles.vehicle_id = reservations.vehicle_id
+		WHERE reservations.user_id = ?
+		ORDER BY reservations.start_time DESC`, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch reservations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reservations := []Reservation{}
+	for rows.Next() {
+		var reservation Reservation
+		if err := rows.Scan(&reservation.ReservationID, &reservation.VehicleID, &reservation.VehicleModel,
+			&reservation.StartTime, &reservation.EndTime, &reservation.Status, &reservation.CreatedAt); err != nil {
+			http.Error(w, "Error scanning reservation data", http.StatusInternalServerError)
+			return
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reservations)
+}
+
+// RentalHistoryHandler retrieves the rental history of the authenticated user
+func RentalHistoryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	rows, err := db.Query(`
+		SELECT rental_history.vehicle_id, vehicles.model,
+			DATE_FORMAT(rental_history.start_time, '%Y-%m-%d %H:%i:%s'),
+			DATE_FORMAT(rental_history.end_time, '%Y-%m-%d %H:%i:%s'),
+			rental_history.total_cost
+		FROM rental_history
+		JOIN vehicles ON vehicles.vehicle_id = rental_history.vehicle_id
+		WHERE rental_history.user_id = ?
+		ORDER BY rental_history.start_time DESC`, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch rental history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rentals := []RentalHistory{}
+	for rows.Next() {
+		var rental RentalHistory
+		if err := rows.Scan(&rental.VehicleID, &rental.VehicleModel, &rental.StartTime, &rental.EndTime, &rental.TotalCost); err != nil {
+			http.Error(w, "Error scanning rental history", http.StatusInternalServerError)
+			return
+		}
+		rentals = append(rentals, rental)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rentals)
+}
+
+// checkReservationOwner verifies that the reservation belongs to the user, writing
+// a 404 or 403 response and returning false when it does not. Fleet operators and
+// admins may act on any reservation.
+func checkReservationOwner(w http.ResponseWriter, db *sql.DB, reservationID int, user auth.User) bool {
+	var ownerID int
+	err := db.QueryRow(`SELECT user_id FROM reservations WHERE reservation_id = ?`, reservationID).Scan(&ownerID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Reservation not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	if ownerID != user.ID && !user.HasAnyRole(auth.RoleFleetOperator) {
+		http.Error(w, "You do not have access to this reservation", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkLicence verifies the user has an approved driver's licence that is valid
+// until the end of the booking, writing a 403 response and returning false
+// when they do not
+func checkLicence(w http.ResponseWriter, db *sql.DB, userID int, endTime string) bool {
+	var status string
+	var validUntilEnd bool
+	err := db.QueryRow(`SELECT status, expiry_date >= DATE(?) FROM driver_licences WHERE user_id = ?`, endTime, userID).
+		Scan(&status, &validUntilEnd)
+	if err == sql.ErrNoRows {
+		http.Error(w, "A driver's licence must be submitted before booking", http.StatusForbidden)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Failed to check driver's licence", http.StatusInternalServerError)
+		return false
+	}
+
+	if status != "approved" {
+		http.Error(w, "Driver's licence has not been approved", http.StatusForbidden)
+		return false
+	}
+	if !validUntilEnd {
+		http.Error(w, "Driver's licence expires before the end of the booking", http.StatusForbidden)
+		return false
+	}
+	return true
+}
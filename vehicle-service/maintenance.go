@@ -0,0 +1,496 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of maintenance task
+const (
+	taskCleaning  = "cleaning"
+	taskServicing = "servicing"
+	taskRepair    = "repair"
+	taskCharging  = "charging"
+)
+
+// maintenanceTaskTypes are the values task_type accepts
+var maintenanceTaskTypes = []string{taskCleaning, taskServicing, taskRepair, taskCharging}
+
+// maintenanceDurations is how long a task's window lasts when no end is given
+var maintenanceDurations = map[string]time.Duration{
+	taskCleaning:  time.Hour,
+	taskServicing: 4 * time.Hour,
+	taskRepair:    8 * time.Hour,
+	taskCharging:  2 * time.Hour,
+}
+
+// deferrableTasks are the routine task types that can wait for a gap between
+// bookings. Repairs and charging take the vehicle out of service as soon as its
+// current booking ends.
+var deferrableTasks = map[string]bool{taskCleaning: true, taskServicing: true}
+
+// How often the maintenance job looks for vehicles that need a task, and the
+// default number of days between services
+const (
+	maintenanceJobInterval     = time.Hour
+	defaultServiceIntervalDays = 180
+)
+
+// MaintenanceTask struct for a cleaning, servicing, repair or charging job on a vehicle
+type MaintenanceTask struct {
+	TaskID         int     `json:"task_id"`
+	VehicleID      int     `json:"vehicle_id"`
+	TaskType       string  `json:"task_type"`
+	Status         string  `json:"status"`
+	ScheduledStart string  `json:"scheduled_start"`
+	ScheduledEnd   string  `json:"scheduled_end"`
+	Notes          *string `json:"notes"`
+	Automatic      bool    `json:"automatic"`
+	CreatedBy      *int    `json:"created_by"`
+	CompletedBy    *int    `json:"completed_by"`
+	CompletedAt    *string `json:"completed_at"`
+	CreatedAt      string  `json:"created_at"`
+}
+
+// ListMaintenanceTasksHandler lists maintenance tasks, earliest window first.
+// Optional parameters: status (open by default, completed, cancelled or all),
+// vehicle_id and task_type.
+func ListMaintenanceTasksHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	query := r.URL.Query()
+	where, args := "1 = 1", []interface{}{}
+
+	switch status := query.Get("status"); status {
+	case "":
+		where += " AND status = 'open'"
+	case "open", "completed", "cancelled":
+		where += " AND status = ?"
+		args = append(args, status)
+	case "all":
+	default:
+		http.Error(w, "status must be open, completed, cancelled or all", http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("vehicle_id"); value != "" {
+		vehicleID, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+			return
+		}
+		where += " AND vehicle_id = ?"
+		args = append(args, vehicleID)
+	}
+	if value := query.Get("task_type"); value != "" {
+		taskType, ok := matchEnum(value, maintenanceTaskTypes)
+		if !ok {
+			http.Error(w, "task_type must be cleaning, servicing, repair or charging", http.StatusBadRequest)
+			return
+		}
+		where += " AND task_type = ?"
+		args = append(args, taskType)
+	}
+
+	rows, err := db.Query(`
+		SELECT task_id, vehicle_id, task_type, status, DATE_FORMAT(scheduled_start, '%Y-%m-%d %H:%i:%s'),
+			DATE_FORMAT(scheduled_end, '%Y-%m-%d %H:%i:%s'), notes, automatic, created_by, completed_by,
+			DATE_FORMAT(completed_at, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:%s')
+		FROM maintenance_tasks
+		WHERE `+where+`
+		ORDER BY scheduled_start, task_id
+		LIMIT 500`, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch maintenance tasks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tasks := []MaintenanceTask{}
+	for rows.Next() {
+		var task MaintenanceTask
+		if err := rows.Scan(&task.TaskID, &task.VehicleID, &task.TaskType, &task.Status, &task.ScheduledStart, &task.ScheduledEnd,
+			&task.Notes, &task.Automatic, &task.CreatedBy, &task.CompletedBy, &task.CompletedAt, &task.CreatedAt); err != nil {
+			http.Error(w, "Error scanning maintenance task", http.StatusInternalServerError)
+			return
+		}
+		tasks = append(tasks, task)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tasks)
+}
+
+// CreateMaintenanceTaskHandler schedules a task for a vehicle. The window
+// (RFC 3339 times, starting now by default) may not overlap an existing booking.
+func CreateMaintenanceTaskHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		TaskType       string `json:"task_type"`
+		ScheduledStart string `json:"scheduled_start"`
+		ScheduledEnd   string `json:"scheduled_end"`
+		Notes          string `json:"notes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	taskType, ok := matchEnum(data.TaskType, maintenanceTaskTypes)
+	if !ok {
+		http.Error(w, "task_type must be cleaning, servicing, repair or charging", http.StatusBadRequest)
+		return
+	}
+	if len(data.Notes) > 500 {
+		http.Error(w, "notes must be at most 500 characters", http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	if data.ScheduledStart != "" {
+		if start, err = time.Parse(time.RFC3339, data.ScheduledStart); err != nil {
+			http.Error(w, "scheduled_start must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	end := start.Add(maintenanceDurations[taskType])
+	if data.ScheduledEnd != "" {
+		if end, err = time.Parse(time.RFC3339, data.ScheduledEnd); err != nil {
+			http.Error(w, "scheduled_end must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if !start.Before(end) {
+		http.Error(w, "scheduled_start must be before scheduled_end", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	db.QueryRow(`SELECT EXISTS(SELECT 1 FROM vehicles WHERE vehicle_id = ? AND retired_at IS NULL)`, vehicleID).Scan(&exists)
+	if !exists {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	}
+
+	// Operators reschedule or cancel clashing bookings before taking the vehicle away
+	var clash int
+	err = db.QueryRow(`
+		SELECT reservation_id
+		FROM reservations
+		WHERE vehicle_id = ? AND status = 'Booked' AND start_time < ? AND end_time > ?
+		ORDER BY start_time
+		LIMIT 1`, vehicleID, dbTime(end), dbTime(start)).Scan(&clash)
+	if err == nil {
+		http.Error(w, fmt.Sprintf("The window overlaps reservation %d", clash), http.StatusConflict)
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, "Failed to check reservations", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO maintenance_tasks (vehicle_id, task_type, scheduled_start, scheduled_end, notes, created_by)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)`,
+		vehicleID, taskType, dbTime(start), dbTime(end), data.Notes, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to schedule maintenance", http.StatusInternalServerError)
+		return
+	}
+	taskID, _ := result.LastInsertId()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"task_id": taskID, "message": "Maintenance scheduled successfully"})
+}
+
+// CompleteMaintenanceTaskHandler marks an open task done. Completing a
+// cleaning marks the vehicle clean and completing a service records the
+// service date.
+func CompleteMaintenanceTaskHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	taskID, err := strconv.Atoi(mux.Vars(r)["task_id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to complete task", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var vehicleID int
+	var taskType, status string
+	err = tx.QueryRow(`SELECT vehicle_id, task_type, status FROM maintenance_tasks WHERE task_id = ? FOR UPDATE`, taskID).
+		Scan(&vehicleID, &taskType, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch task", http.StatusInternalServerError)
+		return
+	}
+	if status != "open" {
+		http.Error(w, "Task is already "+status, http.StatusConflict)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE maintenance_tasks SET status = 'completed', completed_by = ?, completed_at = NOW() WHERE task_id = ?`,
+		authUser.ID, taskID)
+	if err != nil {
+		http.Error(w, "Failed to complete task", http.StatusInternalServerError)
+		return
+	}
+
+	switch taskType {
+	case taskCleaning:
+		_, err = tx.Exec(`UPDATE vehicles SET cleanliness = 'Clean' WHERE vehicle_id = ?`, vehicleID)
+	case taskServicing:
+		_, err = tx.Exec(`UPDATE vehicles SET last_service_date = NOW() WHERE vehicle_id = ?`, vehicleID)
+	}
+	if err != nil {
+		http.Error(w, "Failed to update vehicle", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to complete task", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Task completed successfully"})
+}
+
+// CancelMaintenanceTaskHandler cancels an open task, releasing its window
+func CancelMaintenanceTaskHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	taskID, err := strconv.Atoi(mux.Vars(r)["task_id"])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE maintenance_tasks SET status = 'cancelled' WHERE task_id = ? AND status = 'open'`, taskID)
+	if err != nil {
+		http.Error(w, "Failed to cancel task", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "No open task with this ID", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Task cancelled successfully"})
+}
+
+// maintenanceHoldSQL is true for an open task in maintenance_tasks that holds
+// its vehicle at some time from start to end, which are SQL expressions. A task
+// holds its window. One still open after its window is assumed to need its
+// scheduled length again from now, so it holds the vehicle until then rather
+// than indefinitely.
+func maintenanceHoldSQL(start, end string) string {
+	return `maintenance_tasks.status = 'open' AND maintenance_tasks.scheduled_start < ` + end + `
+		AND (maintenance_tasks.scheduled_end > ` + start + `
+			OR (maintenance_tasks.scheduled_end <= NOW()
+				AND ` + start + ` < NOW() + INTERVAL TIMESTAMPDIFF(MINUTE, maintenance_tasks.scheduled_start, maintenance_tasks.scheduled_end) MINUTE))`
+}
+
+// checkMaintenance verifies no open maintenance task blocks a booking from
+// start to end, writing a 409 response and returning false when one does
+func checkMaintenance(w http.ResponseWriter, db *sql.DB, vehicleID int, start, end string) bool {
+	var taskType, from string
+	err := db.QueryRow(`
+		SELECT task_type, DATE_FORMAT(scheduled_start, '%Y-%m-%d %H:%i')
+		FROM maintenance_tasks
+		WHERE vehicle_id = ? AND `+maintenanceHoldSQL("?", "?")+`
+		ORDER BY scheduled_start
+		LIMIT 1`, vehicleID, end, start, start).Scan(&taskType, &from)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil {
+		http.Error(w, "Failed to check maintenance schedule", http.StatusInternalServerError)
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Vehicle is scheduled for %s from %s", taskType, from), http.StatusConflict)
+	return false
+}
+
+// ensureMaintenanceTask schedules an automatic task of the given type unless
+// the vehicle already has an open one, reporting whether it created one. The
+// window starts as given by maintenanceStart.
+func ensureMaintenanceTask(exec interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, vehicleID int, taskType, notes string) (bool, error) {
+	rows, err := exec.Query(`
+		SELECT UNIX_TIMESTAMP(start_time), UNIX_TIMESTAMP(end_time)
+		FROM reservations
+		WHERE vehicle_id = ? AND status = 'Booked' AND end_time > NOW()
+		ORDER BY start_time`, vehicleID)
+	if err != nil {
+		return false, err
+	}
+	var bookings [][2]time.Time
+	for rows.Next() {
+		var start, end int64
+		if err := rows.Scan(&start, &end); err != nil {
+			rows.Close()
+			return false, err
+		}
+		bookings = append(bookings, [2]time.Time{time.Unix(start, 0), time.Unix(end, 0)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	now, length := time.Now(), maintenanceDurations[taskType]
+	start := maintenanceStart(now, bookings, taskType)
+	result, err := exec.Exec(`
+		INSERT INTO maintenance_tasks (vehicle_id, task_type, scheduled_start, scheduled_end, notes, automatic)
+		SELECT ?, ?, ?, ?, ?, TRUE
+		FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM maintenance_tasks WHERE vehicle_id = ? AND task_type = ? AND status = 'open')`,
+		vehicleID, taskType, dbTime(start), dbTime(start.Add(length)), notes, vehicleID, taskType)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if n > 0 {
+		// Upcoming bookings pushing a routine task back, or clashing with an
+		// urgent one, may need rescheduling
+		for _, booking := range bookings {
+			if booking[0].After(now) && booking[0].Before(start) {
+				log.Printf("Automatic %s for vehicle %d deferred to %s by upcoming bookings", taskType, vehicleID, dbTime(start))
+				break
+			}
+			if booking[0].After(now) && booking[0].Before(start.Add(length)) {
+				log.Printf("Automatic %s for vehicle %d from %s clashes with upcoming bookings", taskType, vehicleID, dbTime(start))
+				break
+			}
+		}
+	}
+	return n > 0, err
+}
+
+// maintenanceStart returns when an automatic task of taskType should start
+// given the vehicle's bookings, which are ordered by start. Routine tasks
+// take the first gap between bookings that is long enough, so like a task
+// scheduled by an operator they overlap none. Others start now, or when the
+// booking in progress ends.
+func maintenanceStart(now time.Time, bookings [][2]time.Time, taskType string) time.Time {
+	if deferrableTasks[taskType] {
+		return firstFreeWindow(now, bookings, maintenanceDurations[taskType])
+	}
+	start := now
+	for _, booking := range bookings {
+		if booking[0].After(now) {
+			break
+		}
+		if booking[1].After(start) {
+			start = booking[1]
+		}
+	}
+	return start
+}
+
+// firstFreeWindow returns the earliest start from now for a window of length
+// that overlaps none of bookings, which are ordered by start
+func firstFreeWindow(now time.Time, bookings [][2]time.Time, length time.Duration) time.Time {
+	start := now
+	for _, booking := range bookings {
+		if !booking[0].Before(start.Add(length)) {
+			break
+		}
+		if booking[1].After(start) {
+			start = booking[1]
+		}
+	}
+	return start
+}
+
+// startMaintenanceJob schedules cleaning for vehicles flagged as needing it
+// and servicing for vehicles not serviced within SERVICE_INTERVAL_DAYS, in the
+// background
+func startMaintenanceJob(db *sql.DB) error {
+	intervalDays := defaultServiceIntervalDays
+	if value := os.Getenv("SERVICE_INTERVAL_DAYS"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 {
+			return fmt.Errorf("SERVICE_INTERVAL_DAYS must be a positive whole number, got %q", value)
+		}
+		intervalDays = days
+	}
+
+	go func() {
+		for {
+			runMaintenanceJob(db, intervalDays)
+			time.Sleep(maintenanceJobInterval)
+		}
+	}()
+	return nil
+}
+
+// runMaintenanceJob creates the automatic tasks that are due
+func runMaintenanceJob(db *sql.DB, intervalDays int) {
+	due := []struct {
+		taskType, notes, query string
+		args                   []interface{}
+	}{
+		{taskCleaning, "Vehicle flagged as needing cleaning",
+			`SELECT vehicle_id FROM vehicles WHERE retired_at IS NULL AND cleanliness = 'Needs Cleaning'`, nil},
+		{taskServicing, fmt.Sprintf("Not serviced in %d days", intervalDays),
+			`SELECT vehicle_id FROM vehicles WHERE retired_at IS NULL AND COALESCE(last_service_date, created_at) < NOW() - INTERVAL ? DAY`,
+			[]interface{}{intervalDays}},
+	}
+
+	for _, job := range due {
+		rows, err := db.Query(job.query, job.args...)
+		if err != nil {
+			log.Printf("Maintenance job failed to find vehicles needing %s: %v", job.taskType, err)
+			continue
+		}
+		var vehicleIDs []int
+		for rows.Next() {
+			var vehicleID int
+			if err := rows.Scan(&vehicleID); err == nil {
+				vehicleIDs = append(vehicleIDs, vehicleID)
+			}
+		}
+		rows.Close()
+
+		created := 0
+		for _, vehicleID := range vehicleIDs {
+			ok, err := ensureMaintenanceTask(db, vehicleID, job.taskType, job.notes)
+			if err != nil {
+				log.Printf("Maintenance job failed to schedule %s for vehicle %d: %v", job.taskType, vehicleID, err)
+				continue
+			}
+			if ok {
+				created++
+			}
+		}
+		if created > 0 {
+			log.Printf("Maintenance job scheduled %s for %d vehicles", job.taskType, created)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFirstFreeWindow(t *testing.T) {
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	at := func(hour, minute int) time.Time {
+		return now.Add(time.Duration(hour-9)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+	booking := func(from, to time.Time) [2]time.Time { return [2]time.Time{from, to} }
+
+	tests := []struct {
+		name     string
+		bookings [][2]time.Time
+		want     time.Time
+	}{
+		{"no bookings", nil, now},
+		{"booking well after", [][2]time.Time{booking(at(12, 0), at(14, 0))}, now},
+		{"gap exactly long enough", [][2]time.Time{booking(at(11, 0), at(14, 0))}, now},
+		{"current booking", [][2]time.Time{booking(at(8, 0), at(10, 0))}, at(10, 0)},
+		{"booking starts inside the window", [][2]time.Time{booking(at(10, 0), at(12, 0))}, at(12, 0)},
+		{"gap too short", [][2]time.Time{booking(at(8, 0), at(10, 0)), booking(at(11, 30), at(13, 0))}, at(13, 0)},
+		{"gap between bookings", [][2]time.Time{booking(at(8, 0), at(10, 0)), booking(at(12, 0), at(13, 0))}, at(10, 0)},
+		{"overlapping bookings", [][2]time.Time{booking(at(9, 30), at(12, 0)), booking(at(10, 0), at(11, 0)), booking(at(13, 0), at(14, 0))}, at(14, 0)},
+	}
+	for _, tt := range tests {
+		if got := firstFreeWindow(now, tt.bookings, 2*time.Hour); !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got.Format("15:04"), tt.want.Format("15:04"))
+		}
+	}
+}
+
+func TestMaintenanceStart(t *testing.T) {
+	now := time.Date(2025, 3, 1, 9, 0, 0, 0, time.UTC)
+	current := [2]time.Time{now.Add(-time.Hour), now.Add(time.Hour)}
+	upcoming := [2]time.Time{now.Add(2 * time.Hour), now.Add(5 * time.Hour)}
+	bookings := [][2]time.Time{current, upcoming}
+
+	tests := []struct {
+		taskType string
+		bookings [][2]time.Time
+		want     time.Time
+	}{
+		// A one hour gap fits cleaning but not servicing
+		{taskCleaning, bookings, current[1]},
+		{taskServicing, bookings, upcoming[1]},
+		// Urgent tasks only wait for the booking in progress
+		{taskRepair, bookings, current[1]},
+		{taskCharging, bookings, current[1]},
+		{taskRepair, [][2]time.Time{upcoming}, now},
+	}
+	for _, tt := range tests {
+		if got := maintenanceStart(now, tt.bookings, tt.taskType); !got.Equal(tt.want) {
+			t.Errorf("%s with %d bookings: got %s, want %s", tt.taskType, len(tt.bookings), got.Format("15:04"), tt.want.Format("15:04"))
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types used by the client and the embedded broker
+const (
+	mqttConnect     byte = 1
+	mqttConnAck     byte = 2
+	mqttPublish     byte = 3
+	mqttPubAck      byte = 4
+	mqttSubscribe   byte = 8
+	mqttSubAck      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsubAck    byte = 11
+	mqttPingReq     byte = 12
+	mqttPingResp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+// MQTT connection settings. Only QoS 0 is published; QoS 1 messages received
+// are acknowledged and then handled like QoS 0.
+const (
+	mqttKeepAlive     = 30 * time.Second
+	mqttMaxPacketSize = 256 << 10
+	mqttMaxBackoff    = 30 * time.Second
+	mqttWriteTimeout  = 10 * time.Second
+)
+
+// errNotConnected is returned when publishing while the broker is unreachable
+var errNotConnected = errors.New("mqtt: not connected")
+
+// mqttPacket is a decoded control packet: its type, the flags from the fixed
+// header and everything after the remaining length
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads one control packet
+func readPacket(r *bufio.Reader) (mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	// The remaining length is a base-128 varint of at most four bytes
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return mqttPacket{}, errors.New("mqtt: malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > mqttMaxPacketSize {
+		return mqttPacket{}, fmt.Errorf("mqtt: packet of %d bytes is too large", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+// writePacket writes one control packet
+func writePacket(w io.Writer, kind, flags byte, body []byte) error {
+	buf := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+// writeConn writes one control packet to conn, giving up after
+// mqttWriteTimeout. A failed write closes conn, so a stalled peer cannot hold
+// up the writer and its reader reconnects or disconnects.
+func writeConn(conn net.Conn, kind, flags byte, body []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	err := writePacket(conn, kind, flags, body)
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+// appendString appends a length-prefixed UTF-8 string
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readString reads a length-prefixed string, returning the rest of the buffer
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("mqtt: truncated string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("mqtt: truncated string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// parsePublish splits a PUBLISH packet into its topic, packet ID (zero for
+// QoS 0) and payload
+func parsePublish(p mqttPacket) (string, uint16, []byte, error) {
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	var packetID uint16
+	if qos := (p.flags >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return "", 0, nil, errors.New("mqtt: truncated publish")
+		}
+		packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	return topic, packetID, rest, nil
+}
+
+// topicMatches reports whether a topic matches a subscription filter, where
+// + matches one level and a trailing # matches any number of levels
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// mqttClient is a Transport backed by an MQTT broker. It reconnects with
+// backoff when the connection drops and restores its subscriptions.
+type mqttClient struct {
+	addr     string
+	clientID string
+	username string
+	password string
+
+	mu     sync.Mutex // guards conn, subs and nextID, and serialises writes
+	conn   net.Conn
+	subs   map[string]MessageHandler
+	nextID uint16
+	closed chan struct{}
+}
+
+// dialMQTT starts a client for the broker at addr (host:port). It connects in
+// the background, so the broker does not need to be up yet.
+func dialMQTT(addr, clientID, username, password string) *mqttClient {
+	c := &mqttClient{
+		addr:     addr,
+		clientID: clientID,
+		username: username,
+		password: password,
+		subs:     map[string]MessageHandler{},
+		closed:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Subscribe registers handler for topics matching filter
+func (c *mqttClient) Subscribe(filter string, handler MessageHandler) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subs[filter] = handler
+	if c.conn == nil {
+		return nil // sent when the connection comes up
+	}
+	return c.sendSubscribe(filter)
+}
+
+// Publish sends payload to topic at QoS 0
+func (c *mqttClient) Publish(topic string, payload []byte) error {
+	body := append(appendString(nil, topic), payload...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return errNotConnected
+	}
+	return writeConn(c.conn, mqttPublish, 0, body)
+}
+
+// Close disconnects and stops reconnecting
+func (c *mqttClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	if c.conn != nil {
+		writeConn(c.conn, mqttDisconnect, 0, nil)
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// run keeps the client connected until it is closed
+func (c *mqttClient) run() {
+	backoff := time.Second
+	for {
+		connected, err := c.session()
+		if connected {
+			backoff = time.Second
+		}
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		log.Printf("MQTT connection to %s lost: %v; retrying in %s", c.addr, err, backoff)
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+// session connects once and handles incoming packets until the connection
+// fails, reporting whether the broker accepted the connection
+func (c *mqttClient) session() (bool, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, 10*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	flags := byte(0x02) // clean session
+	if c.username != "" {
+		flags |= 0x80
+		if c.password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive/time.Second))
+	body = appendString(body, c.clientID)
+	if c.username != "" {
+		body = appendString(body, c.username)
+		if c.password != "" {
+			body = appendString(body, c.password)
+		}
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := writePacket(conn, mqttConnect, 0, body); err != nil {
+		return false, err
+	}
+	ack, err := readPacket(reader)
+	if err != nil {
+		return false, err
+	}
+	if ack.kind != mqttConnAck || len(ack.body) < 2 {
+		return false, errors.New("mqtt: expected CONNACK")
+	}
+	if ack.body[1] != 0 {
+		return false, fmt.Errorf("mqtt: connection refused with code %d", ack.body[1])
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	c.conn = conn
+	for filter := range c.subs {
+		if err := c.sendSubscribe(filter); err != nil {
+			c.conn = nil
+			c.mu.Unlock()
+			return true, err
+		}
+	}
+	c.mu.Unlock()
+	log.Printf("Connected to MQTT broker at %s", c.addr)
+
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go c.ping(conn, stopPing)
+
+	for {
+		// The broker answers pings, so silence for two intervals means the link is dead
+		conn.SetReadDeadline(time.Now().Add(2 * mqttKeepAlive))
+		p, err := readPacket(reader)
+		if err != nil {
+			return true, err
+		}
+		if p.kind != mqttPublish {
+			continue
+		}
+		topic, packetID, payload, err := parsePublish(p)
+		if err != nil {
+			return true, err
+		}
+		if packetID != 0 {
+			c.mu.Lock()
+			writeConn(conn, mqttPubAck, 0, binary.BigEndian.AppendUint16(nil, packetID))
+			c.mu.Unlock()
+		}
+		c.dispatch(topic, payload)
+	}
+}
+
+// ping sends keep-alive pings until stop is closed
+func (c *mqttClient) ping(conn net.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			writeConn(conn, mqttPingReq, 0, nil)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// dispatch passes a message to every handler whose filter matches its topic
+func (c *mqttClient) dispatch(topic string, payload []byte) {
+	c.mu.Lock()
+	var handlers []MessageHandler
+	for filter, handler := range c.subs {
+		if topicMatches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+}
+
+// sendSubscribe subscribes to filter at QoS 0. The caller holds c.mu.
+func (c *mqttClient) sendSubscribe(filter string) error {
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	body := binary.BigEndian.AppendUint16(nil, c.nextID)
+	body = append(appendString(body, filter), 0)
+	return writeConn(c.conn, mqttSubscribe, 0x02, body)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	// Bodies either side of each remaining-length byte boundary
+	for _, size := range []int{0, 1, 127, 128, 16383, 16384, mqttMaxPacketSize} {
+		body := bytes.Repeat([]byte{0xab}, size)
+		var buf bytes.Buffer
+		if err := writePacket(&buf, mqttPublish, 0x02, body); err != nil {
+			t.Fatalf("size %d: writePacket: %v", size, err)
+		}
+		p, err := readPacket(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("size %d: readPacket: %v", size, err)
+		}
+		if p.kind != mqttPublish || p.flags != 0x02 || !bytes.Equal(p.body, body) {
+			t.Errorf("size %d: got kind %d flags %#x and %d bytes", size, p.kind, p.flags, len(p.body))
+		}
+		if buf.Len() != 0 {
+			t.Errorf("size %d: %d bytes left unread", size, buf.Len())
+		}
+	}
+}
+
+func TestReadPacketRejectsMalformed(t *testing.T) {
+	var tooLarge bytes.Buffer
+	writePacket(&tooLarge, mqttPublish, 0, make([]byte, mqttMaxPacketSize+1))
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"missing length", []byte{mqttPingReq << 4}},
+		{"five-byte length", []byte{mqttPublish << 4, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"truncated body", []byte{mqttPublish << 4, 10, 0, 1}},
+		{"too large", tooLarge.Bytes()},
+	}
+	for _, tt := range tests {
+		if _, err := readPacket(bufio.NewReader(bytes.NewReader(tt.input))); err == nil {
+			t.Errorf("%s: readPacket accepted the packet", tt.name)
+		}
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	body := appendString(nil, "vehicles/7/telemetry")
+	qos1 := binary.BigEndian.AppendUint16(append([]byte(nil), body...), 42)
+
+	tests := []struct {
+		name     string
+		packet   mqttPacket
+		packetID uint16
+		payload  string
+		wantErr  bool
+	}{
+		{"qos 0", mqttPacket{kind: mqttPublish, body: append(body, `{"locked":true}`...)}, 0, `{"locked":true}`, false},
+		{"qos 1", mqttPacket{kind: mqttPublish, flags: 0x02, body: append(qos1, `{}`...)}, 42, `{}`, false},
+		{"qos 1 without packet ID", mqttPacket{kind: mqttPublish, flags: 0x02, body: body}, 0, "", true},
+		{"truncated topic", mqttPacket{kind: mqttPublish, body: body[:5]}, 0, "", true},
+	}
+	for _, tt := range tests {
+		topic, packetID, payload, err := parsePublish(tt.packet)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil || topic != "vehicles/7/telemetry" || packetID != tt.packetID || string(payload) != tt.payload {
+			t.Errorf("%s: got %q, %d, %q, %v", tt.name, topic, packetID, payload, err)
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"vehicles/7/telemetry", "vehicles/7/telemetry", true},
+		{"vehicles/7/telemetry", "vehicles/8/telemetry", false},
+		{"vehicles/+/telemetry", "vehicles/7/telemetry", true},
+		{"vehicles/+/telemetry", "vehicles/7/commands", false},
+		{"vehicles/+/telemetry", "vehicles/7/8/telemetry", false},
+		{"vehicles/+/telemetry", "vehicles/telemetry", false},
+		{"vehicles/+", "vehicles/", true},
+		{"vehicles/#", "vehicles", true},
+		{"vehicles/#", "vehicles/7/command-results", true},
+		{"#", "vehicles/7/telemetry", true},
+		{"vehicles/#/telemetry", "vehicles/7/telemetry", false},
+		{"vehicles/7", "vehicles/7/telemetry", false},
+		{"vehicles/7/telemetry", "vehicles/7", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestParseConnect(t *testing.T) {
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0xc2)
+	body = binary.BigEndian.AppendUint16(body, 30)
+	body = appendString(body, "vehicle-7")
+	body = appendString(body, "7")
+	body = appendString(body, "secret")
+
+	keepAlive, username, password, err := parseConnect(body)
+	if err != nil || keepAlive != 30*time.Second || username != "7" || password != "secret" {
+		t.Errorf("got %s, %q, %q, %v", keepAlive, username, password, err)
+	}
+
+	// MQTT 3.1 (protocol level 3) is refused
+	old := appendString(nil, "MQIsdp")
+	old = append(old, 3, 0x02, 0, 30)
+	if _, _, _, err := parseConnect(old); err == nil {
+		t.Error("accepted MQTT 3.1")
+	}
+}
+
+// messageLog collects the messages a handler receives
+type messageLog struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *messageLog) handle(topic string, payload []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, topic+" "+string(payload))
+}
+
+func (l *messageLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+func TestMemoryBrokerInProcess(t *testing.T) {
+	broker := newMemoryBroker(nil)
+	var telemetry, all messageLog
+	broker.Subscribe(telemetryTopicFilter, telemetry.handle)
+	broker.Subscribe("vehicles/#", all.handle)
+
+	broker.Publish("vehicles/7/telemetry", []byte("a"))
+	broker.Publish("vehicles/7/commands", []byte("b"))
+	broker.Publish("stations/1", []byte("c"))
+
+	if got := telemetry.get(); len(got) != 1 || got[0] != "vehicles/7/telemetry a" {
+		t.Errorf("telemetry subscriber got %q", got)
+	}
+	if got := all.get(); len(got) != 2 {
+		t.Errorf("wildcard subscriber got %q", got)
+	}
+
+	broker.Close()
+	broker.Publish("vehicles/7/telemetry", []byte("d"))
+	if got := telemetry.get(); len(got) != 1 {
+		t.Errorf("subscriber still receiving after Close: %q", got)
+	}
+}
+
+// startTestBroker runs a broker on a loopback port that accepts vehicle 7
+// with the password "secret"
+func startTestBroker(t *testing.T) (*memoryBroker, string) {
+	t.Helper()
+	broker := newMemoryBroker(func(username, password string) (string, bool) {
+		if username != "7" || password != "secret" {
+			return "", false
+		}
+		return vehicleTopic(7, ""), true
+	})
+	listener, err := broker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		broker.Close()
+	})
+	return broker, listener.Addr().String()
+}
+
+// eventually retries check until it passes or a few seconds have gone by
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMemoryBrokerPubSubOverTCP(t *testing.T) {
+	broker, addr := startTestBroker(t)
+	var telemetry messageLog
+	broker.Subscribe(telemetryTopicFilter, telemetry.handle)
+
+	vehicle := dialMQTT(addr, "vehicle-7", "7", "secret")
+	defer vehicle.Close()
+	var commands messageLog
+	vehicle.Subscribe(vehicleTopic(7, "commands"), commands.handle)
+
+	// The client connects in the background
+	eventually(t, "the vehicle to connect", func() bool {
+		return vehicle.Publish(vehicleTopic(7, "telemetry"), []byte(`{"locked":true}`)) == nil
+	})
+	eventually(t, "telemetry to reach the service", func() bool { return len(telemetry.get()) > 0 })
+	if got := telemetry.get()[0]; got != `vehicles/7/telemetry {"locked":true}` {
+		t.Errorf("service received %q", got)
+	}
+
+	// The subscription is acknowledged asynchronously, so publish until it lands
+	eventually(t, "a command to reach the vehicle", func() bool {
+		broker.Publish(vehicleTopic(7, "commands"), []byte(`{"command":"lock"}`))
+		return len(commands.get()) > 0
+	})
+	if got := commands.get()[0]; got != `vehicles/7/commands {"command":"lock"}` {
+		t.Errorf("vehicle received %q", got)
+	}
+}
+
+// connectRaw logs in to addr with a hand-built CONNECT and returns the
+// connection and the CONNACK return code
+func connectRaw(t *testing.T, addr, username, password string) (net.Conn, *bufio.Reader, byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, 0xc2)
+	body = binary.BigEndian.AppendUint16(body, 30)
+	body = appendString(body, "test")
+	body = appendString(body, username)
+	body = appendString(body, password)
+	if err := writePacket(conn, mqttConnect, 0, body); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	ack, err := readPacket(reader)
+	if err != nil || ack.kind != mqttConnAck || len(ack.body) != 2 {
+		t.Fatalf("expected CONNACK, got %+v, %v", ack, err)
+	}
+	return conn, reader, ack.body[1]
+}
+
+func TestMemoryBrokerRefusesBadCredentials(t *testing.T) {
+	_, addr := startTestBroker(t)
+	for _, password := range []string{"", "wrong"} {
+		if _, _, code := connectRaw(t, addr, "7", password); code != 5 {
+			t.Errorf("password %q: CONNACK code %d, want 5", password, code)
+		}
+	}
+	if _, _, code := connectRaw(t, addr, "8", "secret"); code != 5 {
+		t.Errorf("another vehicle's ID: CONNACK code %d, want 5", code)
+	}
+}
+
+func TestMemoryBrokerConfinesClientsToTheirTopics(t *testing.T) {
+	broker, addr := startTestBroker(t)
+	var telemetry messageLog
+	broker.Subscribe(telemetryTopicFilter, telemetry.handle)
+
+	conn, reader, code := connectRaw(t, addr, "7", "secret")
+	if code != 0 {
+		t.Fatalf("CONNACK code %d", code)
+	}
+
+	// Subscribing outside the prefix is refused per filter
+	sub := binary.BigEndian.AppendUint16(nil, 1)
+	sub = append(appendString(sub, "vehicles/8/commands"), 0)
+	sub = append(appendString(sub, "vehicles/7/commands"), 0)
+	writePacket(conn, mqttSubscribe, 0x02, sub)
+	ack, err := readPacket(reader)
+	if err != nil || ack.kind != mqttSubAck || !bytes.Equal(ack.body, []byte{0, 1, 0x80, 0}) {
+		t.Fatalf("SUBACK = %+v, %v; want vehicles/8 refused and vehicles/7 granted", ack, err)
+	}
+
+	// Publishing as another vehicle drops the connection without delivering
+	writePacket(conn, mqttPublish, 0, append(appendString(nil, "vehicles/8/telemetry"), "{}"...))
+	if _, err := readPacket(reader); err == nil {
+		t.Error("connection still open after publishing to another vehicle's topic")
+	}
+	if got := telemetry.get(); len(got) != 0 {
+		t.Errorf("spoofed telemetry delivered: %q", got)
+	}
+}
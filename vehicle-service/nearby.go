@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"auth"
+)
+
+// Search limits for nearby vehicles, in kilometres and results
+const (
+	defaultNearbyRadius = 5.0
+	maxNearbyRadius     = 50.0
+	defaultNearbyLimit  = 20
+	maxNearbyLimit      = 100
+)
+
+// earthRadiusKm is the mean radius of the Earth used for haversine distances
+const earthRadiusKm = 6371.0
+
+// NearbyVehicle struct for a vehicle with its distance from the search point
+type NearbyVehicle struct {
+	VehicleID    int     `json:"vehicle_id"`
+	Model        string  `json:"model"`
+	LicensePlate string  `json:"license_plate,omitempty"`
+	ChargeLevel  int     `json:"charge_level"`
+	Cleanliness  string  `json:"cleanliness"`
+	Availability bool    `json:"availability"`
+	Location     string  `json:"location"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+	DistanceKm   float64 `json:"distance_km"`
+}
+
+// NearbyVehiclesHandler returns vehicles within radius kilometres of lat/lng,
+// nearest first. Optional parameters: radius (default 5, max 50), limit and
+// availability. Vehicles below the minimum booking charge are listed as
+// unavailable. Only fleet operators see vehicles that are not on offer and
+// licence plates; everyone else only finds vehicles they could book.
+func NearbyVehiclesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	query := r.URL.Query()
+	authUser, _ := auth.UserFromContext(r.Context())
+	operator := authUser.HasAnyRole(auth.RoleFleetOperator)
+
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		http.Error(w, "lat must be a latitude between -90 and 90", http.StatusBadRequest)
+		return
+	}
+	lng, err := strconv.ParseFloat(query.Get("lng"), 64)
+	if err != nil || lng < -180 || lng > 180 {
+		http.Error(w, "lng must be a longitude between -180 and 180", http.StatusBadRequest)
+		return
+	}
+
+	radius := defaultNearbyRadius
+	if value := query.Get("radius"); value != "" {
+		radius, err = strconv.ParseFloat(value, 64)
+		if err != nil || radius <= 0 || radius > maxNearbyRadius {
+			http.Error(w, fmt.Sprintf("radius must be between 0 and %g kilometres", maxNearbyRadius), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultNearbyLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxNearbyLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxNearbyLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A bounding box around the point lets the coordinates index discard most
+	// rows before the exact distance is computed
+	latDelta := radius / (earthRadiusKm * math.Pi / 180)
+	lngDelta := 180.0
+	if cos := math.Cos(lat * math.Pi / 180); cos > 0.01 {
+		lngDelta = math.Min(latDelta/cos, 180)
+	}
+
+	conditions := "retired_at IS NULL AND latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?"
+	args := []interface{}{bookingRange.MinCharge, earthRadiusKm, lat, lat, lng, lat - latDelta, lat + latDelta, lng - lngDelta, lng + lngDelta}
+	if value := query.Get("availability"); value != "" || !operator {
+		available := true
+		if value != "" {
+			available, err = strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "availability must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		if !available && !operator {
+			http.Error(w, "Only fleet operators can list unavailable vehicles", http.StatusForbidden)
+			return
+		}
+		conditions += " AND " + offeredSQL + " = ?"
+		args = append(args, bookingRange.MinCharge, available)
+	}
+	args = append(args, radius, limit)
+
+	// Boxes that cross the antimeridian are not split, so results there can be incomplete
+	rows, err := db.Query(`
+		SELECT vehicle_id, model, license_plate, charge_level, cleanliness, `+offeredSQL+`, COALESCE(location, ''), latitude, longitude,
+			? * 2 * ASIN(SQRT(
+				POW(SIN(RADIANS(latitude - ?) / 2), 2) +
+				COS(RADIANS(?)) * COS(RADIANS(latitude)) * POW(SIN(RADIANS(longitude - ?) / 2), 2)
+			)) AS distance_km
+		FROM vehicles
+		WHERE `+conditions+`
+		HAVING distance_km <= ?
+		ORDER BY distance_km
+		LIMIT ?`, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch vehicles", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	vehicles := []NearbyVehicle{}
+	for rows.Next() {
+		var vehicle NearbyVehicle
+		if err := rows.Scan(&vehicle.VehicleID, &vehicle.Model, &vehicle.LicensePlate, &vehicle.ChargeLevel, &vehicle.Cleanliness, &vehicle.Availability,
+			&vehicle.Location, &vehicle.Latitude, &vehicle.Longitude, &vehicle.DistanceKm); err != nil {
+			http.Error(w, "Error scanning vehicle data", http.StatusInternalServerError)
+			return
+		}
+		vehicle.DistanceKm = math.Round(vehicle.DistanceKm*1000) / 1000
+		if !operator {
+			vehicle.LicensePlate = ""
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(vehicles)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// billingClient calls billing-service for cost estimates
+var billingClient = &http.Client{Timeout: 10 * time.Second}
+
+// bookingOrganisation returns the organisation the user belongs to, writing a
+// 403 response and returning false when they are not a member
+func bookingOrganisation(w http.ResponseWriter, db *sql.DB, userID int) (int, bool) {
+	var orgID int
+	err := db.QueryRow(`SELECT org_id FROM organisation_members WHERE user_id = ?`, userID).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You do not belong to an organisation", http.StatusForbidden)
+		return 0, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation", http.StatusInternalServerError)
+		return 0, false
+	}
+	return orgID, true
+}
+
+// checkSpendingLimit verifies that a booking charged to the organisation keeps
+// it within its monthly spending limit, writing a 403 response and returning
+// false when it would not. Spending counts bookings starting in the same
+// calendar month, invoiced and not refunded or still to come; fee is added to
+// the hourly cost and excludeReservationID leaves out a booking being modified.
+// The organisation's row stays locked until tx ends, so the booking must be
+// written in tx for concurrent bookings not to overspend together.
+func checkSpendingLimit(w http.ResponseWriter, tx *sql.Tx, orgID int, tier, startTime, endTime string, fee float64, excludeReservationID int) bool {
+	var limit sql.NullFloat64
+	err := tx.QueryRow(`SELECT monthly_spending_limit FROM organisations WHERE org_id = ? FOR UPDATE`, orgID).Scan(&limit)
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation", http.StatusInternalServerError)
+		return false
+	}
+	if !limit.Valid {
+		return true
+	}
+
+	// Let MySQL interpret the times the same way it will store them
+	var hours float64
+	var monthStart string
+	err = tx.QueryRow(`SELECT TIMESTAMPDIFF(SECOND, ?, ?) / 3600, DATE_FORMAT(?, '%Y-%m-01')`, startTime, endTime, startTime).
+		Scan(&hours, &monthStart)
+	if err != nil {
+		http.Error(w, "Invalid booking times", http.StatusBadRequest)
+		return false
+	}
+
+	var spent float64
+	err = tx.QueryRow(`
+		SELECT COALESCE(SUM(billing.amount), 0)
+		FROM billing
+		JOIN reservations ON reservations.reservation_id = billing.reservation_id
+		WHERE reservations.org_id = ? AND reservations.reservation_id <> ? AND billing.payment_status <> 'Refunded'
+			AND reservations.start_time >= ? AND reservations.start_time < ? + INTERVAL 1 MONTH`,
+		orgID, excludeReservationID, monthStart, monthStart).Scan(&spent)
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation spending", http.StatusInternalServerError)
+		return false
+	}
+
+	// Upcoming bookings are not invoiced until they end, so their estimated
+	// cost counts too. Cost is linear in hours, so one estimate per tier will do.
+	rows, err := tx.Query(`
+		SELECT users.membership_tier, SUM(TIMESTAMPDIFF(SECOND, reservations.start_time, reservations.end_time)) / 3600,
+			SUM(reservations.one_way_fee)
+		FROM reservations
+		JOIN users ON users.user_id = reservations.user_id
+		WHERE reservations.org_id = ? AND reservations.reservation_id <> ? AND reservations.status = 'Booked'
+			AND reservations.start_time >= ? AND reservations.start_time < ? + INTERVAL 1 MONTH
+			AND NOT EXISTS (SELECT 1 FROM billing WHERE billing.reservation_id = reservations.reservation_id)
+		GROUP BY users.membership_tier`,
+		orgID, excludeReservationID, monthStart, monthStart)
+	if err != nil {
+		http.Error(w, "Failed to fetch organisation spending", http.StatusInternalServerError)
+		return false
+	}
+	defer rows.Close()
+
+	bookedHours := map[string]float64{}
+	for rows.Next() {
+		var bookedTier string
+		var tierHours, fees float64
+		if err := rows.Scan(&bookedTier, &tierHours, &fees); err != nil {
+			http.Error(w, "Failed to fetch organisation spending", http.StatusInternalServerError)
+			return false
+		}
+		bookedHours[bookedTier] = tierHours
+		spent += fees
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch organisation spending", http.StatusInternalServerError)
+		return false
+	}
+	rows.Close()
+	for bookedTier, tierHours := range bookedHours {
+		estimate, err := estimateCost(bookedTier, tierHours)
+		if err != nil {
+			http.Error(w, "Failed to estimate booking cost", http.StatusBadGateway)
+			return false
+		}
+		spent += estimate
+	}
+
+	cost, err := estimateCost(tier, hours)
+	if err != nil {
+		http.Error(w, "Failed to estimate booking cost", http.StatusBadGateway)
+		return false
+	}
+
+	if spent+cost+fee > limit.Float64 {
+		http.Error(w, fmt.Sprintf("This booking would exceed your organisation's monthly spending limit of %.2f (%.2f already spent or booked)", limit.Float64, spent),
+			http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// estimateCost asks billing-service what a booking of the given length costs
+func estimateCost(tier string, hours float64) (float64, error) {
+	body, _ := json.Marshal(map[string]interface{}{"membership_tier": tier, "hours": hours})
+	resp, err := billingClient.Post(billingServiceURL()+"/calculate-cost", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("billing service returned %s", resp.Status)
+	}
+	var estimate struct {
+		EstimatedCost float64 `json:"estimated_cost"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&estimate); err != nil {
+		return 0, err
+	}
+	return estimate.EstimatedCost, nil
+}
+
+// billingServiceURL returns the address of billing-service
+func billingServiceURL() string {
+	if url := os.Getenv("BILLING_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:8082"
+}
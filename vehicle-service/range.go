@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Defaults for the booking range rules
+const (
+	defaultMinBookingCharge = 20
+	defaultKmPerHour        = 15.0
+	defaultRangeKm          = 300
+	maxPlannedDistanceKm    = 5000.0
+)
+
+// rangePolicy holds the charge rules applied when vehicles are offered and booked
+type rangePolicy struct {
+	MinCharge int     // charge level, in percent, below which a vehicle is not offered
+	KmPerHour float64 // distance a booking is expected to cover per hour when none is planned
+}
+
+// bookingRange is the policy in effect, loaded at startup
+var bookingRange = rangePolicy{MinCharge: defaultMinBookingCharge, KmPerHour: defaultKmPerHour}
+
+// loadRangePolicy reads MIN_BOOKING_CHARGE and EXPECTED_KM_PER_HOUR, keeping
+// the defaults for settings that are not set
+func loadRangePolicy() (rangePolicy, error) {
+	policy := rangePolicy{MinCharge: defaultMinBookingCharge, KmPerHour: defaultKmPerHour}
+	if value := os.Getenv("MIN_BOOKING_CHARGE"); value != "" {
+		charge, err := strconv.Atoi(value)
+		if err != nil || charge < 0 || charge > 100 {
+			return policy, fmt.Errorf("MIN_BOOKING_CHARGE must be a percentage between 0 and 100, got %q", value)
+		}
+		policy.MinCharge = charge
+	}
+	if value := os.Getenv("EXPECTED_KM_PER_HOUR"); value != "" {
+		kmPerHour, err := strconv.ParseFloat(value, 64)
+		if err != nil || kmPerHour <= 0 {
+			return policy, fmt.Errorf("EXPECTED_KM_PER_HOUR must be a positive number, got %q", value)
+		}
+		policy.KmPerHour = kmPerHour
+	}
+	return policy, nil
+}
+
+// offeredSQL is true for vehicles that can be offered to customers: available,
+// charged to at least the minimum and not held by maintenance right now, by
+// the same rule bookings are checked against. It takes the minimum charge as
+// its one parameter. Vehicles with no reported charge are not offered.
+var offeredSQL = `(vehicles.availability AND COALESCE(vehicles.charge_level, 0) >= ? AND NOT EXISTS (
+	SELECT 1 FROM maintenance_tasks
+	WHERE maintenance_tasks.vehicle_id = vehicles.vehicle_id AND ` + maintenanceHoldSQL("NOW()", "NOW()") + `))`
+
+// checkBookingRange checks the vehicle has enough charge for a booking from
+// start to end, writing a 409 response and returning false when it does not.
+// Vehicles below the minimum charge are refused when enforceMinimum is set, as
+// is a planned distance beyond the current range. Without a planned distance
+// the distance is estimated from the duration, and a shortfall only produces
+// the returned warning.
+func checkBookingRange(w http.ResponseWriter, db *sql.DB, vehicleID int, start, end string, plannedKm *float64, enforceMinimum bool) (string, bool) {
+	if plannedKm != nil && (*plannedKm <= 0 || *plannedKm > maxPlannedDistanceKm) {
+		http.Error(w, fmt.Sprintf("planned_distance_km must be between 0 and %g", maxPlannedDistanceKm), http.StatusBadRequest)
+		return "", false
+	}
+
+	var chargeLevel, rangeKm int
+	var minutes sql.NullInt64
+	err := db.QueryRow(`
+		SELECT COALESCE(charge_level, 0), range_km, TIMESTAMPDIFF(MINUTE, ?, ?)
+		FROM vehicles
+		WHERE vehicle_id = ? AND retired_at IS NULL`, start, end, vehicleID).Scan(&chargeLevel, &rangeKm, &minutes)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not available", http.StatusConflict)
+		return "", false
+	}
+	if err != nil {
+		http.Error(w, "Failed to check vehicle charge", http.StatusInternalServerError)
+		return "", false
+	}
+
+	if enforceMinimum && chargeLevel < bookingRange.MinCharge {
+		http.Error(w, fmt.Sprintf("Vehicle is charging and cannot be booked until it reaches %d%%", bookingRange.MinCharge), http.StatusConflict)
+		return "", false
+	}
+
+	availableKm := float64(chargeLevel) * float64(rangeKm) / 100
+	if plannedKm != nil {
+		if *plannedKm > availableKm {
+			http.Error(w, fmt.Sprintf("Vehicle has about %.0f km of range left, not enough for a %.0f km trip", availableKm, *plannedKm), http.StatusConflict)
+			return "", false
+		}
+		return "", true
+	}
+
+	estimatedKm := float64(minutes.Int64) / 60 * bookingRange.KmPerHour
+	if estimatedKm > availableKm {
+		return fmt.Sprintf("A booking this long typically covers about %.0f km, but the vehicle has about %.0f km of range left. You may need to recharge during your trip.",
+			math.Ceil(estimatedKm), availableKm), true
+	}
+	return "", true
+}
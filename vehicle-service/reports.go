@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits on report photos: how many one report may have and how large each may be
+const (
+	maxReportPhotos    = 5
+	maxReportPhotoSize = 5 << 20
+)
+
+// reportWindowHours is how long after a trip ends it can still be reported on
+const reportWindowHours = 48
+
+// Kinds of problem a driver can report
+const (
+	reportDamage      = "damage"
+	reportCleanliness = "cleanliness"
+	reportLowCharge   = "low_charge"
+)
+
+// reportTypes are the values report_type accepts
+var reportTypes = []string{reportDamage, reportCleanliness, reportLowCharge}
+
+// reportTasks is the maintenance task each kind of report opens
+var reportTasks = map[string]string{
+	reportDamage:      taskRepair,
+	reportCleanliness: taskCleaning,
+	reportLowCharge:   taskCharging,
+}
+
+// allowedPhotoTypes maps accepted photo content types to file extensions
+var allowedPhotoTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// DamageReport struct for a problem reported by a driver
+type DamageReport struct {
+	ReportID      int      `json:"report_id"`
+	ReservationID int      `json:"reservation_id"`
+	VehicleID     int      `json:"vehicle_id"`
+	UserID        int      `json:"user_id"`
+	ReportType    string   `json:"report_type"`
+	Description   *string  `json:"description"`
+	Status        string   `json:"status"`
+	TaskID        *int     `json:"task_id"`
+	Fee           *float64 `json:"fee"`
+	ReviewNotes   *string  `json:"review_notes"`
+	ReviewedBy    *int     `json:"reviewed_by"`
+	ReviewedAt    *string  `json:"reviewed_at"`
+	CreatedAt     string   `json:"created_at"`
+	PhotoIDs      []int    `json:"photo_ids"`
+}
+
+// SubmitDamageReportHandler lets a driver report damage, dirt or low charge
+// during a trip or up to two days after it, as a multipart form with
+// reservation_id, report_type, description and up to five photos. The report
+// opens a maintenance task and waits for a fleet operator's review.
+func SubmitDamageReportHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxReportPhotos*maxReportPhotoSize+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	reservationID, err := strconv.Atoi(r.FormValue("reservation_id"))
+	if err != nil {
+		http.Error(w, "Invalid reservation ID", http.StatusBadRequest)
+		return
+	}
+	reportType, ok := matchEnum(r.FormValue("report_type"), reportTypes)
+	if !ok {
+		http.Error(w, "report_type must be damage, cleanliness or low_charge", http.StatusBadRequest)
+		return
+	}
+	description := strings.TrimSpace(r.FormValue("description"))
+	if len(description) > 1000 {
+		http.Error(w, "description must be at most 1000 characters", http.StatusBadRequest)
+		return
+	}
+	if reportType == reportDamage && description == "" {
+		http.Error(w, "Describe the damage in description", http.StatusBadRequest)
+		return
+	}
+	photos := r.MultipartForm.File["photos"]
+	if len(photos) > maxReportPhotos {
+		http.Error(w, fmt.Sprintf("At most %d photos can be attached", maxReportPhotos), http.StatusBadRequest)
+		return
+	}
+
+	// Only the driver can report on a trip, and only once it has started
+	var vehicleID int
+	var withinWindow bool
+	err = db.QueryRow(`
+		SELECT vehicle_id, end_time > NOW() - INTERVAL ? HOUR
+		FROM reservations
+		WHERE reservation_id = ? AND user_id = ? AND status IN ('Booked', 'Completed') AND start_time <= NOW()`,
+		reportWindowHours, reservationID, authUser.ID).Scan(&vehicleID, &withinWindow)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You can only report on your own trips once they have started", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
+		return
+	}
+	if !withinWindow {
+		http.Error(w, fmt.Sprintf("Reports must be made within %d hours of the end of the trip", reportWindowHours), http.StatusForbidden)
+		return
+	}
+
+	// Check every photo before storing any of them
+	var photoData [][]byte
+	for _, header := range photos {
+		data, status, err := readReportPhoto(header)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		photoData = append(photoData, data)
+	}
+	var paths []string
+	for _, data := range photoData {
+		path, err := saveReportPhoto(data, reservationID)
+		if err != nil {
+			removeFiles(paths)
+			http.Error(w, "Failed to store photo", http.StatusInternalServerError)
+			return
+		}
+		paths = append(paths, path)
+	}
+
+	reportID, taskID, err := recordDamageReport(db, reservationID, vehicleID, authUser.ID, reportType, description, paths)
+	if err != nil {
+		removeFiles(paths)
+		http.Error(w, "Failed to submit report", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"report_id": reportID,
+		"task_id":   taskID,
+		"message":   "Thank you, the report has been sent to our fleet team",
+	})
+}
+
+// ListDamageReportsHandler lets fleet operators review reports, oldest first.
+// Optional parameters: status (pending_review by default, reviewed or all)
+// and vehicle_id.
+func ListDamageReportsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	query := r.URL.Query()
+	where, args := "1 = 1", []interface{}{}
+
+	switch status := query.Get("status"); status {
+	case "":
+		where += " AND damage_reports.status = 'pending_review'"
+	case "pending_review", "reviewed":
+		where += " AND damage_reports.status = ?"
+		args = append(args, status)
+	case "all":
+	default:
+		http.Error(w, "status must be pending_review, reviewed or all", http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("vehicle_id"); value != "" {
+		vehicleID, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+			return
+		}
+		where += " AND damage_reports.vehicle_id = ?"
+		args = append(args, vehicleID)
+	}
+
+	rows, err := db.Query(`
+		SELECT damage_reports.report_id, reservation_id, vehicle_id, user_id, report_type, description, status, task_id, fee,
+			review_notes, reviewed_by, DATE_FORMAT(reviewed_at, '%Y-%m-%d %H:%i:%s'), DATE_FORMAT(damage_reports.created_at, '%Y-%m-%d %H:%i:%s'),
+			COALESCE(GROUP_CONCAT(damage_report_photos.photo_id ORDER BY damage_report_photos.photo_id), '')
+		FROM damage_reports
+		LEFT JOIN damage_report_photos ON damage_report_photos.report_id = damage_reports.report_id
+		WHERE `+where+`
+		GROUP BY damage_reports.report_id
+		ORDER BY damage_reports.report_id
+		LIMIT 500`, args...)
+	if err != nil {
+		http.Error(w, "Failed to fetch reports", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reports := []DamageReport{}
+	for rows.Next() {
+		var report DamageReport
+		var photoIDs string
+		if err := rows.Scan(&report.ReportID, &report.ReservationID, &report.VehicleID, &report.UserID, &report.ReportType,
+			&report.Description, &report.Status, &report.TaskID, &report.Fee, &report.ReviewNotes, &report.ReviewedBy,
+			&report.ReviewedAt, &report.CreatedAt, &photoIDs); err != nil {
+			http.Error(w, "Error scanning report data", http.StatusInternalServerError)
+			return
+		}
+		report.PhotoIDs = []int{}
+		for _, id := range strings.Split(photoIDs, ",") {
+			if photoID, err := strconv.Atoi(id); err == nil {
+				report.PhotoIDs = append(report.PhotoIDs, photoID)
+			}
+		}
+		reports = append(reports, report)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reports)
+}
+
+// DamageReportPhotoHandler serves a report photo to fleet operators
+func DamageReportPhotoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vars := mux.Vars(r)
+	reportID, err1 := strconv.Atoi(vars["report_id"])
+	photoID, err2 := strconv.Atoi(vars["photo_id"])
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+		return
+	}
+
+	var path string
+	err := db.QueryRow(`SELECT file_path FROM damage_report_photos WHERE photo_id = ? AND report_id = ?`, photoID, reportID).Scan(&path)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "inline")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, path)
+}
+
+// DeleteReporterPhotosHandler removes the photos from the user's damage
+// reports once their account has been deleted. The user service calls it as
+// the user while deleting an account; the reports are kept.
+func DeleteReporterPhotosHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	// Only deleted accounts lose their photos, so drivers cannot remove evidence
+	// from reports themselves
+	var deleted bool
+	err := db.QueryRow(`SELECT deleted_at IS NOT NULL FROM users WHERE user_id = ?`, authUser.ID).Scan(&deleted)
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Photos are only removed when the account is deleted", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to remove photos", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT damage_report_photos.file_path
+		FROM damage_report_photos
+		JOIN damage_reports ON damage_reports.report_id = damage_report_photos.report_id
+		WHERE damage_reports.user_id = ?
+		FOR UPDATE`, authUser.ID)
+	if err != nil {
+		http.Error(w, "Failed to remove photos", http.StatusInternalServerError)
+		return
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to remove photos", http.StatusInternalServerError)
+			return
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`
+		DELETE damage_report_photos FROM damage_report_photos
+		JOIN damage_reports ON damage_reports.report_id = damage_report_photos.report_id
+		WHERE damage_reports.user_id = ?`, authUser.ID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to remove photos", http.StatusInternalServerError)
+		return
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove report photo %s of user %d: %v", path, authUser.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Report photos removed", "removed": len(paths)})
+}
+
+// ReviewDamageReportHandler records a fleet operator's review of a report. A
+// fee greater than zero is charged to the driver through billing-service once
+// the report has been claimed; a failed charge returns it to review.
+func ReviewDamageReportHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	reportID, err := strconv.Atoi(mux.Vars(r)["report_id"])
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		Fee   float64 `json:"fee"`
+		Notes string  `json:"notes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if data.Fee < 0 || data.Fee > 100000 {
+		http.Error(w, "fee must be between 0 and 100000", http.StatusBadRequest)
+		return
+	}
+	if len(data.Notes) > 1000 {
+		http.Error(w, "notes must be at most 1000 characters", http.StatusBadRequest)
+		return
+	}
+
+	var fee sql.NullFloat64
+	if data.Fee > 0 {
+		fee = sql.NullFloat64{Float64: data.Fee, Valid: true}
+	}
+
+	// Claim the report before charging so concurrent reviews cannot both bill it
+	reservationID, err := claimDamageReport(db, reportID, authUser.ID, fee, strings.TrimSpace(data.Notes))
+	var invalid reviewError
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.message, invalid.status)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save review", http.StatusInternalServerError)
+		return
+	}
+
+	if fee.Valid {
+		if err := chargeDamageFee(authUser, reservationID, reportID, data.Fee); err != nil {
+			// Release the claim so the review can be retried
+			if _, releaseErr := db.Exec(`
+				UPDATE damage_reports
+				SET status = 'pending_review', fee = NULL, review_notes = NULL, reviewed_by = NULL, reviewed_at = NULL
+				WHERE report_id = ? AND status = 'reviewed' AND reviewed_by = ?`, reportID, authUser.ID); releaseErr != nil {
+				log.Printf("Failed to release review of damage report %d: %v", reportID, releaseErr)
+			}
+			http.Error(w, "Failed to charge damage fee: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Report reviewed successfully", "fee": fee.Float64})
+}
+
+// reviewError reports a review that cannot be saved, with its HTTP status
+type reviewError struct {
+	status  int
+	message string
+}
+
+func (e reviewError) Error() string { return e.message }
+
+// claimDamageReport marks a pending report as reviewed with the given fee and
+// notes, returning its reservation. Reports that are missing, already reviewed
+// or cannot carry the fee return a reviewError.
+func claimDamageReport(db *sql.DB, reportID, reviewerID int, fee sql.NullFloat64, notes string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var reservationID int
+	var reportType, status string
+	err = tx.QueryRow(`SELECT reservation_id, report_type, status FROM damage_reports WHERE report_id = ? FOR UPDATE`, reportID).
+		Scan(&reservationID, &reportType, &status)
+	if err == sql.ErrNoRows {
+		return 0, reviewError{http.StatusNotFound, "Report not found"}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status != "pending_review" {
+		return 0, reviewError{http.StatusConflict, "Report has already been reviewed"}
+	}
+	if fee.Valid && reportType != reportDamage {
+		return 0, reviewError{http.StatusBadRequest, "Fees can only be charged for damage"}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE damage_reports
+		SET status = 'reviewed', fee = ?, review_notes = NULLIF(?, ''), reviewed_by = ?, reviewed_at = NOW()
+		WHERE report_id = ? AND status = 'pending_review'`,
+		fee, notes, reviewerID, reportID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, reviewError{http.StatusConflict, "Report has already been reviewed"}
+	}
+	return reservationID, tx.Commit()
+}
+
+// recordDamageReport stores a report and its photos, marks the vehicle dirty
+// for cleanliness reports and makes sure the matching maintenance task is
+// open, returning the report and task IDs
+func recordDamageReport(db *sql.DB, reservationID, vehicleID, userID int, reportType, description string, paths []string) (int64, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if reportType == reportCleanliness {
+		if _, err := tx.Exec(`UPDATE vehicles SET cleanliness = 'Needs Cleaning' WHERE vehicle_id = ?`, vehicleID); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// An open task of the same kind already covers the problem
+	taskType := reportTasks[reportType]
+	notes := "Reported by a driver"
+	if description != "" {
+		notes += ": " + description
+	}
+	if _, err := ensureMaintenanceTask(tx, vehicleID, taskType, truncate(notes, 500)); err != nil {
+		return 0, 0, err
+	}
+	var taskID int
+	err = tx.QueryRow(`SELECT task_id FROM maintenance_tasks WHERE vehicle_id = ? AND task_type = ? AND status = 'open' ORDER BY task_id DESC LIMIT 1`,
+		vehicleID, taskType).Scan(&taskID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO damage_reports (reservation_id, vehicle_id, user_id, report_type, description, task_id)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)`,
+		reservationID, vehicleID, userID, reportType, description, taskID)
+	if err != nil {
+		return 0, 0, err
+	}
+	reportID, err := result.LastInsertId()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, path := range paths {
+		if _, err := tx.Exec(`INSERT INTO damage_report_photos (report_id, file_path) VALUES (?, ?)`, reportID, path); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return reportID, taskID, tx.Commit()
+}
+
+// readReportPhoto reads an uploaded photo, returning its contents or an error
+// message and status code
+func readReportPhoto(header *multipart.FileHeader) ([]byte, int, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid photo upload")
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxReportPhotoSize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("Invalid photo upload")
+	}
+	if len(data) > maxReportPhotoSize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("Photos must be at most %d MB", maxReportPhotoSize>>20)
+	}
+
+	if _, ok := allowedPhotoTypes[http.DetectContentType(data)]; !ok {
+		return nil, http.StatusUnsupportedMediaType, errors.New("Photos must be JPEG or PNG images")
+	}
+	return data, http.StatusOK, nil
+}
+
+// saveReportPhoto writes a checked photo to local storage under an
+// unguessable name and returns its path
+func saveReportPhoto(data []byte, reservationID int) (string, error) {
+	dir := reportPhotoDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	ext := allowedPhotoTypes[http.DetectContentType(data)]
+	path := filepath.Join(dir, fmt.Sprintf("%d-%s%s", reservationID, hex.EncodeToString(suffix), ext))
+	return path, os.WriteFile(path, data, 0o600)
+}
+
+// removeFiles deletes stored photos after a report fails to save
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// reportPhotoDir returns the local directory report photos are stored in,
+// damage-reports under UPLOAD_DIR. Only this service reads or removes them.
+func reportPhotoDir() string {
+	dir := os.Getenv("UPLOAD_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+	return filepath.Join(dir, "damage-reports")
+}
+
+// truncate shortens s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// chargeDamageFee asks billing-service to bill a reservation for damage,
+// acting as the reviewing operator
+func chargeDamageFee(operator auth.User, reservationID, reportID int, fee float64) error {
+	if len(gatewayKey) == 0 {
+		return errors.New("GATEWAY_SECRET is not configured")
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"reservation_id": reservationID, "report_id": reportID, "amount": fee})
+	req, err := http.NewRequest(http.MethodPost, billingServiceURL()+"/damage-fees", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	auth.SetIdentityHeaders(req.Header, gatewayKey, operator)
+
+	resp, err := billingClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("billing service returned %s", resp.Status)
+	}
+	return nil
+}
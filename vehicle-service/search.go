@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Page sizes for the vehicle catalogue
+const (
+	defaultVehicleLimit = 20
+	maxVehicleLimit     = 100
+)
+
+// vehicleSorts maps the sort parameter to the expression vehicles are ordered
+// by. Enum columns sort by their position so Economy comes before Premium.
+var vehicleSorts = map[string]string{
+	"vehicle_id":   "vehicles.vehicle_id",
+	"model":        "vehicles.model",
+	"charge_level": "COALESCE(vehicles.charge_level, 0)",
+	"seats":        "vehicles.seats",
+	"price_band":   "vehicles.price_band + 0",
+}
+
+// cleanlinessValues and priceBands are the values the enum filters accept
+var (
+	cleanlinessValues = []string{"Clean", "Needs Cleaning"}
+	priceBands        = []string{"Economy", "Standard", "Premium"}
+)
+
+// Vehicle struct for a vehicle in the catalogue
+type Vehicle struct {
+	VehicleID    int    `json:"vehicle_id"`
+	Model        string `json:"model"`
+	LicensePlate string `json:"license_plate"`
+	ChargeLevel  int    `json:"charge_level"`
+	Cleanliness  string `json:"cleanliness"`
+	Seats        int    `json:"seats"`
+	PriceBand    string `json:"price_band"`
+	RangeKm      int    `json:"range_km"`
+	Availability bool   `json:"availability"`
+	Location     string `json:"location"`
+	StationID    *int   `json:"station_id"`
+}
+
+// vehicleCursor marks the last vehicle of a page. It records the sort it was
+// issued for so it cannot be replayed against a different ordering.
+type vehicleCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int    `json:"id"`
+}
+
+// GetVehiclesHandler retrieves a page of vehicles matching the filters.
+// Vehicles below the minimum booking charge are listed as unavailable.
+// Supported query parameters: availability, model, min_charge, cleanliness,
+// location, station_id, min_seats, price_band (comma separated), sort
+// (vehicle_id, model, charge_level, seats or price_band), order (asc or
+// desc), limit and cursor.
+func GetVehiclesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	q, err := parseVehicleQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// One extra row tells us whether another page follows
+	rows, err := db.Query(`
+		SELECT vehicle_id, model, license_plate, COALESCE(charge_level, 0), cleanliness, seats, price_band, range_km,
+			`+offeredSQL+`, COALESCE(location, ''), station_id, CAST(`+q.column+` AS CHAR)
+		FROM vehicles
+		WHERE `+q.where+`
+		ORDER BY `+q.column+` `+q.order+`, vehicles.vehicle_id `+q.order+`
+		LIMIT ?`, append(append([]interface{}{bookingRange.MinCharge}, q.args...), q.limit+1)...)
+	if err != nil {
+		http.Error(w, "Failed to fetch vehicles", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	vehicles := []Vehicle{}
+	var lastKey string
+	var nextCursor *string
+	for rows.Next() {
+		if len(vehicles) == q.limit {
+			last := vehicles[len(vehicles)-1]
+			cursor := encodeVehicleCursor(vehicleCursor{Sort: q.sortKey, Key: lastKey, ID: last.VehicleID})
+			nextCursor = &cursor
+			break
+		}
+
+		var vehicle Vehicle
+		if err := rows.Scan(&vehicle.VehicleID, &vehicle.Model, &vehicle.LicensePlate, &vehicle.ChargeLevel, &vehicle.Cleanliness,
+			&vehicle.Seats, &vehicle.PriceBand, &vehicle.RangeKm, &vehicle.Availability, &vehicle.Location, &vehicle.StationID, &lastKey); err != nil {
+			http.Error(w, "Error scanning vehicle data", http.StatusInternalServerError)
+			return
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"vehicles":    vehicles,
+		"next_cursor": nextCursor,
+	})
+}
+
+// vehicleQuery is a parsed catalogue request
+type vehicleQuery struct {
+	where   string
+	args    []interface{}
+	column  string // sort expression from vehicleSorts
+	order   string // asc or desc
+	sortKey string // sort and order, recorded in cursors
+	limit   int
+}
+
+// parseVehicleQuery validates the catalogue's query parameters. The filters,
+// cursor and limit become bound arguments; the sort column and order only
+// ever come from fixed values.
+func parseVehicleQuery(query url.Values) (vehicleQuery, error) {
+	where, args, err := vehicleFilter(query)
+	if err != nil {
+		return vehicleQuery{}, err
+	}
+	q := vehicleQuery{where: where, args: args}
+
+	sortName := query.Get("sort")
+	if sortName == "" {
+		sortName = "vehicle_id"
+	}
+	column, ok := vehicleSorts[sortName]
+	if !ok {
+		return vehicleQuery{}, errors.New("sort must be vehicle_id, model, charge_level, seats or price_band")
+	}
+	q.column = column
+	switch strings.ToLower(query.Get("order")) {
+	case "", "asc":
+		q.order = "asc"
+	case "desc":
+		q.order = "desc"
+	default:
+		return vehicleQuery{}, errors.New("order must be asc or desc")
+	}
+	q.sortKey = sortName + ":" + q.order
+
+	q.limit = defaultVehicleLimit
+	if value := query.Get("limit"); value != "" {
+		q.limit, err = strconv.Atoi(value)
+		if err != nil || q.limit < 1 || q.limit > maxVehicleLimit {
+			return vehicleQuery{}, fmt.Errorf("limit must be between 1 and %d", maxVehicleLimit)
+		}
+	}
+
+	// Keyset pagination: continue strictly after the cursor row, using the
+	// vehicle ID to break ties between equal sort values
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeVehicleCursor(value)
+		if err != nil || cursor.Sort != q.sortKey {
+			return vehicleQuery{}, errors.New("Invalid cursor")
+		}
+		cmp := ">"
+		if q.order == "desc" {
+			cmp = "<"
+		}
+		q.where += fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND vehicles.vehicle_id %s ?))", column, cmp, column, cmp)
+		q.args = append(q.args, cursor.Key, cursor.Key, cursor.ID)
+	}
+	return q, nil
+}
+
+// vehicleFilter builds the WHERE clause and arguments for the catalogue
+// filters. Every value is bound as a parameter; only fixed SQL is concatenated.
+// Retired vehicles are never listed.
+func vehicleFilter(query url.Values) (string, []interface{}, error) {
+	conditions := []string{"vehicles.retired_at IS NULL"}
+	var args []interface{}
+
+	if value := query.Get("availability"); value != "" {
+		available, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", nil, errors.New("availability must be true or false")
+		}
+		conditions = append(conditions, offeredSQL+" = ?")
+		args = append(args, bookingRange.MinCharge, available)
+	}
+	if model := strings.TrimSpace(query.Get("model")); model != "" {
+		conditions = append(conditions, "vehicles.model LIKE ?")
+		args = append(args, "%"+escapeLike(model)+"%")
+	}
+	if value := query.Get("min_charge"); value != "" {
+		charge, err := strconv.Atoi(value)
+		if err != nil || charge < 0 || charge > 100 {
+			return "", nil, errors.New("min_charge must be a whole number between 0 and 100")
+		}
+		conditions = append(conditions, "vehicles.charge_level >= ?")
+		args = append(args, charge)
+	}
+	if value := query.Get("cleanliness"); value != "" {
+		cleanliness, ok := matchEnum(value, cleanlinessValues)
+		if !ok {
+			return "", nil, errors.New("cleanliness must be Clean or Needs Cleaning")
+		}
+		conditions = append(conditions, "vehicles.cleanliness = ?")
+		args = append(args, cleanliness)
+	}
+	if location := strings.TrimSpace(query.Get("location")); location != "" {
+		conditions = append(conditions, "vehicles.location LIKE ?")
+		args = append(args, "%"+escapeLike(location)+"%")
+	}
+	if value := query.Get("station_id"); value != "" {
+		stationID, err := strconv.Atoi(value)
+		if err != nil || stationID < 1 {
+			return "", nil, errors.New("station_id must be a station ID")
+		}
+		conditions = append(conditions, "vehicles.station_id = ?")
+		args = append(args, stationID)
+	}
+	if value := query.Get("min_seats"); value != "" {
+		seats, err := strconv.Atoi(value)
+		if err != nil || seats < 1 {
+			return "", nil, errors.New("min_seats must be a positive whole number")
+		}
+		conditions = append(conditions, "vehicles.seats >= ?")
+		args = append(args, seats)
+	}
+	if value := query.Get("price_band"); value != "" {
+		var placeholders []string
+		for _, band := range strings.Split(value, ",") {
+			band, ok := matchEnum(strings.TrimSpace(band), priceBands)
+			if !ok {
+				return "", nil, errors.New("price_band must be Economy, Standard or Premium, or a comma separated list of them")
+			}
+			placeholders = append(placeholders, "?")
+			args = append(args, band)
+		}
+		conditions = append(conditions, "vehicles.price_band IN ("+strings.Join(placeholders, ", ")+")")
+	}
+
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// matchEnum returns the allowed value equal to value, ignoring case
+func matchEnum(value string, allowed []string) (string, bool) {
+	for _, candidate := range allowed {
+		if strings.EqualFold(value, candidate) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// escapeLike escapes LIKE wildcards so user input only matches literally
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// encodeVehicleCursor serialises a cursor for the next_cursor field
+func encodeVehicleCursor(cursor vehicleCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeVehicleCursor parses a cursor sent back by the client
+func decodeVehicleCursor(value string) (vehicleCursor, error) {
+	var cursor vehicleCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
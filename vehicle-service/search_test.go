@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// injectionPayloads are inputs that would change the query if they were
+// concatenated into the SQL
+var injectionPayloads = []string{
+	`' OR '1'='1`,
+	`x'; DROP TABLE vehicles; --`,
+	`") OR 1=1 #`,
+	`1 UNION SELECT password_hash FROM users`,
+	`\' OR 1=1 -- `,
+	`%' AND SLEEP(5) AND '%'='`,
+}
+
+// checkBound fails unless every placeholder in where has an argument and
+// payload appears in none of the SQL. offeredSQL is fixed SQL with its own
+// string literal, so it is left out of the quote check.
+func checkBound(t *testing.T, name, where string, args []interface{}, payload string) {
+	t.Helper()
+	if strings.Count(where, "?") != len(args) {
+		t.Errorf("%s: %d placeholders for %d arguments in %q", name, strings.Count(where, "?"), len(args), where)
+	}
+	if payload != "" && strings.Contains(where, payload) {
+		t.Errorf("%s: input reached the SQL: %q", name, where)
+	}
+	for _, char := range []string{"'", `"`, ";", "--", "#"} {
+		if strings.Contains(strings.ReplaceAll(where, offeredSQL, ""), char) {
+			t.Errorf("%s: SQL contains %q: %q", name, char, where)
+		}
+	}
+}
+
+func TestVehicleFilterBindsTextFilters(t *testing.T) {
+	for _, param := range []string{"model", "location"} {
+		for _, payload := range injectionPayloads {
+			where, args, err := vehicleFilter(url.Values{param: {payload}})
+			if err != nil {
+				t.Errorf("%s=%q: %v", param, payload, err)
+				continue
+			}
+			name := param + "=" + payload
+			checkBound(t, name, where, args, payload)
+			want := []interface{}{"%" + escapeLike(strings.TrimSpace(payload)) + "%"}
+			if !reflect.DeepEqual(args, want) {
+				t.Errorf("%s: args = %q, want %q", name, args, want)
+			}
+		}
+	}
+}
+
+func TestVehicleFilterRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		param string
+		value string
+	}{
+		{"availability", "yes' OR '1'='1"},
+		{"availability", "maybe"},
+		{"min_charge", "50 OR 1=1"},
+		{"min_charge", "-1"},
+		{"min_charge", "101"},
+		{"cleanliness", "Clean' OR '1'='1"},
+		{"cleanliness", "Dirty"},
+		{"station_id", "1; DROP TABLE stations"},
+		{"station_id", "0"},
+		{"min_seats", "2 OR 1=1"},
+		{"min_seats", "0"},
+		{"price_band", "Economy') OR ('1'='1"},
+		{"price_band", "Economy,Luxury"},
+		{"price_band", "Economy,"},
+	}
+	for _, tt := range tests {
+		if _, _, err := vehicleFilter(url.Values{tt.param: {tt.value}}); err == nil {
+			t.Errorf("%s=%q was accepted", tt.param, tt.value)
+		}
+	}
+}
+
+func TestVehicleFilterValidValues(t *testing.T) {
+	tests := []struct {
+		query url.Values
+		want  []interface{}
+	}{
+		{url.Values{}, nil},
+		{url.Values{"availability": {"true"}}, []interface{}{bookingRange.MinCharge, true}},
+		{url.Values{"min_charge": {"80"}, "min_seats": {"5"}}, []interface{}{80, 5}},
+		{url.Values{"cleanliness": {"needs cleaning"}}, []interface{}{"Needs Cleaning"}},
+		{url.Values{"station_id": {"3"}}, []interface{}{3}},
+		{url.Values{"price_band": {"economy, PREMIUM"}}, []interface{}{"Economy", "Premium"}},
+		{url.Values{"model": {"  Tesla  "}}, []interface{}{"%Tesla%"}},
+	}
+	for _, tt := range tests {
+		where, args, err := vehicleFilter(tt.query)
+		if err != nil {
+			t.Errorf("%v: %v", tt.query, err)
+			continue
+		}
+		checkBound(t, tt.query.Encode(), where, args, "")
+		if !strings.HasPrefix(where, "vehicles.retired_at IS NULL") {
+			t.Errorf("%v: retired vehicles are not excluded: %q", tt.query, where)
+		}
+		if !reflect.DeepEqual(args, tt.want) {
+			t.Errorf("%v: args = %v, want %v", tt.query, args, tt.want)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Model 3", "Model 3"},
+		{"100%", `100\%`},
+		{"a_b", `a\_b`},
+		{`C:\path`, `C:\\path`},
+		{`\%_`, `\\\%\_`},
+	}
+	for _, tt := range tests {
+		if got := escapeLike(tt.in); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseVehicleQuerySortAndOrder(t *testing.T) {
+	tests := []struct {
+		sort, order string
+		wantColumn  string
+		wantOrder   string
+		wantErr     bool
+	}{
+		{"", "", "vehicles.vehicle_id", "asc", false},
+		{"price_band", "DESC", "vehicles.price_band + 0", "desc", false},
+		{"charge_level", "asc", "COALESCE(vehicles.charge_level, 0)", "asc", false},
+		{"model; DROP TABLE vehicles", "", "", "", true},
+		{"vehicle_id desc, (SELECT SLEEP(5))", "", "", "", true},
+		{"vehicles.license_plate", "", "", "", true},
+		{"MODEL", "", "", "", true},
+		{"model", "asc; DROP TABLE vehicles", "", "", true},
+		{"model", "desc, vehicle_id", "", "", true},
+	}
+	for _, tt := range tests {
+		q, err := parseVehicleQuery(url.Values{"sort": {tt.sort}, "order": {tt.order}})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("sort=%q order=%q was accepted", tt.sort, tt.order)
+			}
+			continue
+		}
+		if err != nil || q.column != tt.wantColumn || q.order != tt.wantOrder {
+			t.Errorf("sort=%q order=%q: got %q %q, %v", tt.sort, tt.order, q.column, q.order, err)
+		}
+	}
+}
+
+func TestParseVehicleQueryLimit(t *testing.T) {
+	tests := []struct {
+		limit string
+		want  int
+	}{
+		{"", defaultVehicleLimit},
+		{"1", 1},
+		{"100", maxVehicleLimit},
+		{"0", 0},
+		{"101", 0},
+		{"10 OR 1=1", 0},
+		{"-5", 0},
+	}
+	for _, tt := range tests {
+		q, err := parseVehicleQuery(url.Values{"limit": {tt.limit}})
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("limit=%q was accepted", tt.limit)
+			}
+			continue
+		}
+		if err != nil || q.limit != tt.want {
+			t.Errorf("limit=%q: got %d, %v", tt.limit, q.limit, err)
+		}
+	}
+}
+
+func TestVehicleCursor(t *testing.T) {
+	for _, payload := range append([]string{"Model 3", ""}, injectionPayloads...) {
+		cursor := vehicleCursor{Sort: "model:desc", Key: payload, ID: 42}
+		encoded := encodeVehicleCursor(cursor)
+		decoded, err := decodeVehicleCursor(encoded)
+		if err != nil || decoded != cursor {
+			t.Errorf("round trip of %+v gave %+v, %v", cursor, decoded, err)
+			continue
+		}
+
+		// A cursor's key is compared as a bound argument, never as SQL
+		q, err := parseVehicleQuery(url.Values{"sort": {"model"}, "order": {"desc"}, "cursor": {encoded}})
+		if err != nil {
+			t.Errorf("cursor with key %q: %v", payload, err)
+			continue
+		}
+		checkBound(t, "cursor key "+payload, q.where, q.args, payload)
+		if !strings.HasSuffix(q.where, " AND (vehicles.model < ? OR (vehicles.model = ? AND vehicles.vehicle_id < ?))") {
+			t.Errorf("unexpected keyset condition: %q", q.where)
+		}
+		if want := []interface{}{payload, payload, 42}; !reflect.DeepEqual(q.args, want) {
+			t.Errorf("args = %q, want %q", q.args, want)
+		}
+	}
+}
+
+func TestParseVehicleQueryRejectsBadCursors(t *testing.T) {
+	modelCursor := encodeVehicleCursor(vehicleCursor{Sort: "model:asc", Key: "Model 3", ID: 7})
+	tests := []struct {
+		name   string
+		query  url.Values
+		cursor string
+	}{
+		{"not base64", url.Values{}, "' OR 1=1 --"},
+		{"not JSON", url.Values{}, "bm90IGpzb24"},
+		{"wrong field type", url.Values{}, base64.RawURLEncoding.EncodeToString([]byte(`{"s":"vehicle_id:asc","k":"1","id":"1 OR 1=1"}`))},
+		{"other sort", url.Values{"sort": {"seats"}}, modelCursor},
+		{"other order", url.Values{"sort": {"model"}, "order": {"desc"}}, modelCursor},
+		{"forged sort", url.Values{"sort": {"model"}}, encodeVehicleCursor(vehicleCursor{Sort: "model:asc; DROP TABLE vehicles", ID: 1})},
+	}
+	for _, tt := range tests {
+		tt.query.Set("cursor", tt.cursor)
+		if _, err := parseVehicleQuery(tt.query); err == nil {
+			t.Errorf("%s: cursor was accepted", tt.name)
+		}
+	}
+}
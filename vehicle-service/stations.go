@@ -0,0 +1,529 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth"
+
+	"github.com/gorilla/mux"
+)
+
+// Station struct for a parking zone where vehicles are collected and returned
+type Station struct {
+	StationID         int     `json:"station_id"`
+	Name              string  `json:"name"`
+	Address           string  `json:"address"`
+	Latitude          float64 `json:"latitude"`
+	Longitude         float64 `json:"longitude"`
+	Capacity          int     `json:"capacity"`
+	OpensAt           *string `json:"opens_at"`
+	ClosesAt          *string `json:"closes_at"`
+	OneWayFee         float64 `json:"one_way_fee"`
+	VehiclesParked    int     `json:"vehicles_parked"`
+	AvailableVehicles int     `json:"available_vehicles"`
+}
+
+// stationInput is the request body for creating or updating a station.
+// Omitted fields are left unchanged on update.
+type stationInput struct {
+	Name      *string  `json:"name"`
+	Address   *string  `json:"address"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Capacity  *int     `json:"capacity"`
+	OpensAt   *string  `json:"opens_at"`
+	ClosesAt  *string  `json:"closes_at"`
+	OneWayFee *float64 `json:"one_way_fee"`
+}
+
+// stationTrip is where a booking starts and ends and what the drop-off costs
+type stationTrip struct {
+	Pickup    sql.NullInt64
+	Dropoff   sql.NullInt64
+	OneWayFee float64
+}
+
+// stationColumns selects a Station; it must be used with stationGroupBy
+const stationColumns = `
+	stations.station_id, stations.name, stations.address, stations.latitude, stations.longitude, stations.capacity,
+	TIME_FORMAT(stations.opens_at, '%H:%i'), TIME_FORMAT(stations.closes_at, '%H:%i'), stations.one_way_fee,
+	COUNT(vehicles.vehicle_id), COALESCE(SUM(vehicles.availability), 0)
+	FROM stations
+	LEFT JOIN vehicles ON vehicles.station_id = stations.station_id`
+
+const stationGroupBy = ` GROUP BY stations.station_id`
+
+// ListStationsHandler lists every station with how many vehicles are parked
+// and available there
+func ListStationsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	rows, err := db.Query(`SELECT ` + stationColumns + stationGroupBy + ` ORDER BY stations.name`)
+	if err != nil {
+		http.Error(w, "Failed to fetch stations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	stations := []Station{}
+	for rows.Next() {
+		station, err := scanStation(rows)
+		if err != nil {
+			http.Error(w, "Error scanning station data", http.StatusInternalServerError)
+			return
+		}
+		stations = append(stations, station)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stations)
+}
+
+// GetStationHandler retrieves a station and the vehicles parked there
+func GetStationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	stationID, err := strconv.Atoi(mux.Vars(r)["station_id"])
+	if err != nil {
+		http.Error(w, "Invalid station ID", http.StatusBadRequest)
+		return
+	}
+
+	station, err := scanStation(db.QueryRow(`SELECT `+stationColumns+` WHERE stations.station_id = ?`+stationGroupBy, stationID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Station not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch station", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT vehicle_id, model, license_plate, charge_level, availability
+		FROM vehicles
+		WHERE station_id = ?
+		ORDER BY model`, stationID)
+	if err != nil {
+		http.Error(w, "Failed to fetch vehicles", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type stationVehicle struct {
+		VehicleID    int    `json:"vehicle_id"`
+		Model        string `json:"model"`
+		LicensePlate string `json:"license_plate"`
+		ChargeLevel  int    `json:"charge_level"`
+		Availability bool   `json:"availability"`
+	}
+	vehicles := []stationVehicle{}
+	for rows.Next() {
+		var vehicle stationVehicle
+		if err := rows.Scan(&vehicle.VehicleID, &vehicle.Model, &vehicle.LicensePlate, &vehicle.ChargeLevel, &vehicle.Availability); err != nil {
+			http.Error(w, "Error scanning vehicle data", http.StatusInternalServerError)
+			return
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"station": station, "vehicles": vehicles})
+}
+
+// CreateStationHandler lets fleet operators add a station
+func CreateStationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var data stationInput
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if data.Name == nil || data.Address == nil || data.Latitude == nil || data.Longitude == nil || data.Capacity == nil {
+		http.Error(w, "name, address, latitude, longitude and capacity are required", http.StatusBadRequest)
+		return
+	}
+	if data.OneWayFee == nil {
+		data.OneWayFee = new(float64)
+	}
+	if message := data.validate(); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO stations (name, address, latitude, longitude, capacity, opens_at, closes_at, one_way_fee)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?)`,
+		strings.TrimSpace(*data.Name), strings.TrimSpace(*data.Address), *data.Latitude, *data.Longitude, *data.Capacity,
+		stringValue(data.OpensAt), stringValue(data.ClosesAt), *data.OneWayFee)
+	if err != nil {
+		http.Error(w, "Failed to create station. Station names must be unique.", http.StatusConflict)
+		return
+	}
+	stationID, _ := result.LastInsertId()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"station_id": stationID, "message": "Station created successfully"})
+}
+
+// UpdateStationHandler lets fleet operators change a station's details
+func UpdateStationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	stationID, err := strconv.Atoi(mux.Vars(r)["station_id"])
+	if err != nil {
+		http.Error(w, "Invalid station ID", http.StatusBadRequest)
+		return
+	}
+
+	var data stationInput
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if message := data.validate(); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	var sets []string
+	var args []interface{}
+	add := func(column string, value interface{}) {
+		sets = append(sets, column+" = ?")
+		args = append(args, value)
+	}
+	if data.Name != nil {
+		add("name", strings.TrimSpace(*data.Name))
+	}
+	if data.Address != nil {
+		add("address", strings.TrimSpace(*data.Address))
+	}
+	if data.Latitude != nil {
+		add("latitude", *data.Latitude)
+	}
+	if data.Longitude != nil {
+		add("longitude", *data.Longitude)
+	}
+	if data.Capacity != nil {
+		add("capacity", *data.Capacity)
+	}
+	if data.OpensAt != nil {
+		sets = append(sets, "opens_at = NULLIF(?, '')")
+		args = append(args, *data.OpensAt)
+	}
+	if data.ClosesAt != nil {
+		sets = append(sets, "closes_at = NULLIF(?, '')")
+		args = append(args, *data.ClosesAt)
+	}
+	if data.OneWayFee != nil {
+		add("one_way_fee", *data.OneWayFee)
+	}
+	if len(sets) == 0 {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE stations SET `+strings.Join(sets, ", ")+` WHERE station_id = ?`, append(args, stationID)...)
+	if err != nil {
+		http.Error(w, "Failed to update station", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		var exists bool
+		db.QueryRow(`SELECT EXISTS(SELECT 1 FROM stations WHERE station_id = ?)`, stationID).Scan(&exists)
+		if !exists {
+			http.Error(w, "Station not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Station updated successfully"})
+}
+
+// AssignVehicleStationHandler lets fleet operators park a vehicle at a station,
+// or remove it from one with a null station_id
+func AssignVehicleStationHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	var data struct {
+		StationID *int `json:"station_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if data.StationID == nil {
+		result, err := db.Exec(`UPDATE vehicles SET station_id = NULL WHERE vehicle_id = ?`, vehicleID)
+		if err != nil {
+			http.Error(w, "Failed to update vehicle", http.StatusInternalServerError)
+			return
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			http.Error(w, "Vehicle not found or not at a station", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle removed from its station"})
+		return
+	}
+
+	if !checkStationSpace(w, db, *data.StationID, vehicleID) {
+		return
+	}
+
+	// The vehicle takes the station's position so location searches stay accurate
+	result, err := db.Exec(`
+		UPDATE vehicles
+		JOIN stations ON stations.station_id = ?
+		SET vehicles.station_id = stations.station_id, vehicles.location = stations.address,
+			vehicles.latitude = stations.latitude, vehicles.longitude = stations.longitude
+		WHERE vehicles.vehicle_id = ? AND vehicles.retired_at IS NULL`, *data.StationID, vehicleID)
+	if err != nil {
+		http.Error(w, "Failed to update vehicle", http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		var exists bool
+		db.QueryRow(`SELECT EXISTS(SELECT 1 FROM vehicles WHERE vehicle_id = ? AND retired_at IS NULL)`, vehicleID).Scan(&exists)
+		if !exists {
+			http.Error(w, "Vehicle not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle assigned to station"})
+}
+
+// ReturnVehicleHandler ends a booking. The vehicle becomes available again at
+// the booking's drop-off station.
+func ReturnVehicleHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	authUser, _ := auth.UserFromContext(r.Context())
+
+	var data struct {
+		ReservationID int `json:"reservation_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if !checkReservationOwner(w, db, data.ReservationID, authUser) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to return vehicle", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var vehicleID int
+	var dropoff sql.NullInt64
+	err = tx.QueryRow(`SELECT vehicle_id, dropoff_station_id FROM reservations WHERE reservation_id = ? AND status = 'Booked' FOR UPDATE`,
+		data.ReservationID).Scan(&vehicleID, &dropoff)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Only active bookings can be returned", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch reservation details", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.Exec(`UPDATE reservations SET status = 'Completed' WHERE reservation_id = ?`, data.ReservationID); err != nil {
+		http.Error(w, "Failed to return vehicle", http.StatusInternalServerError)
+		return
+	}
+	if dropoff.Valid {
+		_, err = tx.Exec(`
+			UPDATE vehicles
+			JOIN stations ON stations.station_id = ?
+			SET vehicles.availability = TRUE, vehicles.station_id = stations.station_id, vehicles.location = stations.address,
+				vehicles.latitude = stations.latitude, vehicles.longitude = stations.longitude
+			WHERE vehicles.vehicle_id = ?`, dropoff.Int64, vehicleID)
+	} else {
+		_, err = tx.Exec(`UPDATE vehicles SET availability = TRUE WHERE vehicle_id = ?`, vehicleID)
+	}
+	if err != nil {
+		http.Error(w, "Failed to update vehicle", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to return vehicle", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Vehicle returned successfully"})
+}
+
+// bookingStations works out the stations for a booking of a vehicle, writing a
+// 400 or 409 response and returning false when they are not valid. Vehicles
+// parked at a station are collected there; the drop-off defaults to the pickup
+// station and a different one adds its one-way fee.
+func bookingStations(w http.ResponseWriter, db *sql.DB, vehicleID int, pickupID, dropoffID *int) (stationTrip, bool) {
+	var trip stationTrip
+	var vehicleStation sql.NullInt64
+	err := db.QueryRow(`SELECT station_id FROM vehicles WHERE vehicle_id = ?`, vehicleID).Scan(&vehicleStation)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return trip, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch vehicle details", http.StatusInternalServerError)
+		return trip, false
+	}
+
+	if !vehicleStation.Valid {
+		if pickupID != nil || dropoffID != nil {
+			http.Error(w, "This vehicle is not parked at a station", http.StatusBadRequest)
+			return trip, false
+		}
+		return trip, true
+	}
+
+	if pickupID != nil && int64(*pickupID) != vehicleStation.Int64 {
+		http.Error(w, "This vehicle must be collected from its current station", http.StatusBadRequest)
+		return trip, false
+	}
+	trip.Pickup = vehicleStation
+	trip.Dropoff = vehicleStation
+	if dropoffID == nil || int64(*dropoffID) == vehicleStation.Int64 {
+		return trip, true
+	}
+
+	trip.Dropoff = sql.NullInt64{Int64: int64(*dropoffID), Valid: true}
+	err = db.QueryRow(`SELECT one_way_fee FROM stations WHERE station_id = ?`, *dropoffID).Scan(&trip.OneWayFee)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Drop-off station not found", http.StatusBadRequest)
+		return trip, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch station details", http.StatusInternalServerError)
+		return trip, false
+	}
+	if !checkStationSpace(w, db, *dropoffID, vehicleID) {
+		return trip, false
+	}
+	return trip, true
+}
+
+// checkStationSpace verifies the station has a free bay for the vehicle,
+// counting vehicles parked there and one-way bookings heading there. It writes
+// a 400 or 409 response and returns false when it does not.
+func checkStationSpace(w http.ResponseWriter, db *sql.DB, stationID, vehicleID int) bool {
+	var free int
+	err := db.QueryRow(`
+		SELECT stations.capacity
+			- (SELECT COUNT(*) FROM vehicles WHERE vehicles.station_id = stations.station_id AND vehicles.vehicle_id <> ?)
+			- (SELECT COUNT(*) FROM reservations
+				WHERE reservations.dropoff_station_id = stations.station_id AND reservations.pickup_station_id <> stations.station_id
+					AND reservations.status = 'Booked' AND reservations.vehicle_id <> ?)
+		FROM stations
+		WHERE stations.station_id = ?`, vehicleID, vehicleID, stationID).Scan(&free)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Station not found", http.StatusBadRequest)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Failed to check station capacity", http.StatusInternalServerError)
+		return false
+	}
+	if free <= 0 {
+		http.Error(w, "The station has no free parking bays", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// checkStationHours verifies the pickup and drop-off stations are open at the
+// start and end of the booking, writing a 400 response and returning false
+// when they are not. Closing times before opening times run past midnight.
+func checkStationHours(w http.ResponseWriter, db *sql.DB, trip stationTrip, startTime, endTime string) bool {
+	for _, visit := range []struct {
+		station sql.NullInt64
+		at      string
+		what    string
+	}{{trip.Pickup, startTime, "pickup"}, {trip.Dropoff, endTime, "drop-off"}} {
+		if !visit.station.Valid {
+			continue
+		}
+		var name string
+		var open bool
+		err := db.QueryRow(`
+			SELECT name,
+				opens_at IS NULL OR closes_at IS NULL
+				OR (opens_at <= closes_at AND TIME(?) BETWEEN opens_at AND closes_at)
+				OR (opens_at > closes_at AND (TIME(?) >= opens_at OR TIME(?) <= closes_at))
+			FROM stations WHERE station_id = ?`, visit.at, visit.at, visit.at, visit.station.Int64).Scan(&name, &open)
+		if err != nil {
+			http.Error(w, "Failed to check station opening hours", http.StatusInternalServerError)
+			return false
+		}
+		if !open {
+			http.Error(w, "The "+visit.what+" station "+name+" is closed at that time", http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks the fields that are present, returning a message for the
+// first invalid one
+func (s stationInput) validate() string {
+	if s.Name != nil && (strings.TrimSpace(*s.Name) == "" || len(*s.Name) > 255) {
+		return "name must be 1 to 255 characters"
+	}
+	if s.Address != nil && (strings.TrimSpace(*s.Address) == "" || len(*s.Address) > 255) {
+		return "address must be 1 to 255 characters"
+	}
+	if s.Latitude != nil && (*s.Latitude < -90 || *s.Latitude > 90) {
+		return "latitude must be between -90 and 90"
+	}
+	if s.Longitude != nil && (*s.Longitude < -180 || *s.Longitude > 180) {
+		return "longitude must be between -180 and 180"
+	}
+	if s.Capacity != nil && *s.Capacity < 1 {
+		return "capacity must be at least 1"
+	}
+	for _, value := range []*string{s.OpensAt, s.ClosesAt} {
+		if value != nil && *value != "" {
+			if _, err := time.Parse("15:04", *value); err != nil {
+				return "opening hours must be in HH:MM format, or empty for 24 hours"
+			}
+		}
+	}
+	if s.OneWayFee != nil && *s.OneWayFee < 0 {
+		return "one_way_fee must not be negative"
+	}
+	return ""
+}
+
+// scanStation reads a row selected with stationColumns
+func scanStation(row interface{ Scan(...interface{}) error }) (Station, error) {
+	var station Station
+	var opensAt, closesAt sql.NullString
+	err := row.Scan(&station.StationID, &station.Name, &station.Address, &station.Latitude, &station.Longitude, &station.Capacity,
+		&opensAt, &closesAt, &station.OneWayFee, &station.VehiclesParked, &station.AvailableVehicles)
+	if opensAt.Valid {
+		station.OpensAt = &opensAt.String
+	}
+	if closesAt.Valid {
+		station.ClosesAt = &closesAt.String
+	}
+	return station, err
+}
+
+// stringValue dereferences an optional string
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Telemetry limits: how far ahead of the server clock a sample may be dated,
+// and how many samples one history request returns
+const (
+	telemetryClockSkew    = 5 * time.Minute
+	defaultTelemetryLimit = 100
+	maxTelemetryLimit     = 1000
+)
+
+// deviceTokenHeader carries a vehicle's device token on telemetry pushes
+const deviceTokenHeader = "X-Device-Token"
+
+// TelemetrySample struct for one reading reported by a vehicle. Readings the
+// vehicle did not take are left out.
+type TelemetrySample struct {
+	RecordedAt  string   `json:"recorded_at"` // RFC 3339; defaults to when it was received
+	ChargeLevel *int     `json:"charge_level"`
+	OdometerKm  *float64 `json:"odometer_km"`
+	Latitude    *float64 `json:"latitude"`
+	Longitude   *float64 `json:"longitude"`
+	Locked      *bool    `json:"locked"`
+}
+
+// telemetryError reports a sample that cannot be stored because it is invalid
+type telemetryError string
+
+func (e telemetryError) Error() string { return string(e) }
+
+// IssueDeviceTokenHandler lets fleet operators issue the token a vehicle's
+// telematics unit sends telemetry with. Issuing a new token revokes the old one.
+func IssueDeviceTokenHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	db.QueryRow(`SELECT EXISTS(SELECT 1 FROM vehicles WHERE vehicle_id = ? AND retired_at IS NULL)`, vehicleID).Scan(&exists)
+	if !exists {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "Failed to issue device token", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	_, err = db.Exec(`
+		INSERT INTO vehicle_devices (vehicle_id, token_hash) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE token_hash = VALUES(token_hash), created_at = NOW(), last_seen_at = NULL`,
+		vehicleID, hashToken(token))
+	if err != nil {
+		http.Error(w, "Failed to issue device token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"device_token": token,
+		"message":      "Configure the vehicle with this token. It will not be shown again.",
+	})
+}
+
+// TelemetryHandler stores a telemetry sample pushed by a vehicle. Vehicles
+// authenticate with their device token rather than a user login.
+func TelemetryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vehicleID, err := authenticateDevice(db, r.Header.Get(deviceTokenHeader))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid device token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to authenticate device", http.StatusInternalServerError)
+		return
+	}
+
+	var sample TelemetrySample
+	if err := json.NewDecoder(r.Body).Decode(&sample); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	err = recordTelemetry(db, vehicleID, sample, time.Now())
+	var invalid telemetryError
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to store telemetry", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Telemetry recorded"})
+}
+
+// TelemetryHistoryHandler lets fleet operators read a vehicle's samples,
+// newest first. Optional parameters: from and to (RFC 3339, default the last
+// 24 hours) and limit.
+func TelemetryHistoryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	vehicleID, err := strconv.Atoi(mux.Vars(r)["vehicle_id"])
+	if err != nil {
+		http.Error(w, "Invalid vehicle ID", http.StatusBadRequest)
+		return
+	}
+
+	// Retired vehicles keep their history
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM vehicles WHERE vehicle_id = ?)`, vehicleID).Scan(&exists); err != nil {
+		http.Error(w, "Failed to retrieve telemetry", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+
+	to := time.Now()
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "to must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultTelemetryLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxTelemetryLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxTelemetryLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT DATE_FORMAT(recorded_at, '%Y-%m-%d %H:%i:%s'), charge_level, odometer_km, latitude, longitude, locked
+		FROM vehicle_telemetry
+		WHERE vehicle_id = ? AND recorded_at >= ? AND recorded_at < ?
+		ORDER BY recorded_at DESC, telemetry_id DESC
+		LIMIT ?`, vehicleID, dbTime(from), dbTime(to), limit)
+	if err != nil {
+		http.Error(w, "Failed to fetch telemetry", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	samples := []TelemetrySample{}
+	for rows.Next() {
+		var sample TelemetrySample
+		if err := rows.Scan(&sample.RecordedAt, &sample.ChargeLevel, &sample.OdometerKm, &sample.Latitude, &sample.Longitude, &sample.Locked); err != nil {
+			http.Error(w, "Error scanning telemetry", http.StatusInternalServerError)
+			return
+		}
+		samples = append(samples, sample)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(samples)
+}
+
+// authenticateDevice returns the vehicle a device token belongs to, or
+// sql.ErrNoRows when the token is unknown or the vehicle is retired
+func authenticateDevice(db *sql.DB, token string) (int, error) {
+	if token == "" {
+		return 0, sql.ErrNoRows
+	}
+	var vehicleID int
+	err := db.QueryRow(`
+		SELECT vehicle_devices.vehicle_id
+		FROM vehicle_devices
+		JOIN vehicles ON vehicles.vehicle_id = vehicle_devices.vehicle_id
+		WHERE vehicle_devices.token_hash = ? AND vehicles.retired_at IS NULL`, hashToken(token)).Scan(&vehicleID)
+	return vehicleID, err
+}
+
+// recordTelemetry validates and stores a sample, then copies its readings onto
+// the vehicle unless a newer sample has already been applied. Invalid samples
+// return a telemetryError.
+func recordTelemetry(db *sql.DB, vehicleID int, sample TelemetrySample, now time.Time) error {
+	recordedAt, err := sample.validate(now)
+	if err != nil {
+		return err
+	}
+	at := dbTime(recordedAt)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO vehicle_telemetry (vehicle_id, recorded_at, charge_level, odometer_km, latitude, longitude, locked)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		vehicleID, at, sample.ChargeLevel, sample.OdometerKm, sample.Latitude, sample.Longitude, sample.Locked)
+	if err != nil {
+		return err
+	}
+
+	// Samples can arrive out of order, so only a newer one changes the current state
+	_, err = tx.Exec(`
+		UPDATE vehicles
+		SET charge_level = COALESCE(?, charge_level), odometer_km = COALESCE(?, odometer_km),
+			latitude = COALESCE(?, latitude), longitude = COALESCE(?, longitude),
+			locked = COALESCE(?, locked), telemetry_at = ?
+		WHERE vehicle_id = ? AND (telemetry_at IS NULL OR telemetry_at <= ?)`,
+		sample.ChargeLevel, sample.OdometerKm, sample.Latitude, sample.Longitude, sample.Locked, at, vehicleID, at)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE vehicle_devices SET last_seen_at = NOW() WHERE vehicle_id = ?`, vehicleID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// validate checks a sample's readings and returns when it was recorded
+func (s TelemetrySample) validate(now time.Time) (time.Time, error) {
+	if s.ChargeLevel == nil && s.OdometerKm == nil && s.Latitude == nil && s.Longitude == nil && s.Locked == nil {
+		return time.Time{}, telemetryError("A sample must contain at least one reading")
+	}
+	if s.ChargeLevel != nil && (*s.ChargeLevel < 0 || *s.ChargeLevel > 100) {
+		return time.Time{}, telemetryError("charge_level must be between 0 and 100")
+	}
+	if s.OdometerKm != nil && *s.OdometerKm < 0 {
+		return time.Time{}, telemetryError("odometer_km must not be negative")
+	}
+	if (s.Latitude == nil) != (s.Longitude == nil) {
+		return time.Time{}, telemetryError("latitude and longitude must be reported together")
+	}
+	if s.Latitude != nil && (*s.Latitude < -90 || *s.Latitude > 90 || *s.Longitude < -180 || *s.Longitude > 180) {
+		return time.Time{}, telemetryError("latitude or longitude is out of range")
+	}
+
+	if s.RecordedAt == "" {
+		return now, nil
+	}
+	recordedAt, err := time.Parse(time.RFC3339, s.RecordedAt)
+	if err != nil {
+		return time.Time{}, telemetryError("recorded_at must be an RFC 3339 time")
+	}
+	if recordedAt.After(now.Add(telemetryClockSkew)) {
+		return time.Time{}, telemetryError("recorded_at is in the future")
+	}
+	return recordedAt, nil
+}
+
+// dbTime formats a time in the server's zone for a DATETIME column, avoiding
+// the driver's conversion to UTC
+func dbTime(t time.Time) string {
+	return t.In(time.Local).Format("2006-01-02 15:04:05")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Vehicles publish telemetry to vehicles/{vehicle_id}/telemetry and receive
+// commands on vehicles/{vehicle_id}/commands
+const (
+	telemetryTopicFilter = "vehicles/+/telemetry"
+	vehicleTopicFormat   = "vehicles/%d/%s"
+)
+
+// MessageHandler receives a message published to a subscribed topic
+type MessageHandler func(topic string, payload []byte)
+
+// Transport carries messages between vehicle-service and vehicles. It is an
+// MQTT broker connection in production and an in-process broker otherwise.
+type Transport interface {
+	Subscribe(filter string, handler MessageHandler) error
+	Publish(topic string, payload []byte) error
+	Close() error
+}
+
+// newTransport connects to the broker in MQTT_BROKER_URL (tcp://host:port,
+// with MQTT_USERNAME and MQTT_PASSWORD). Without one it starts the embedded
+// broker, which accepts vehicles on MQTT_LISTEN_ADDR when that is set; they
+// log in with their vehicle ID and device token.
+func newTransport(db *sql.DB) (Transport, error) {
+	if brokerURL := os.Getenv("MQTT_BROKER_URL"); brokerURL != "" {
+		u, err := url.Parse(brokerURL)
+		if err != nil || u.Scheme != "tcp" || u.Host == "" {
+			return nil, fmt.Errorf("MQTT_BROKER_URL must look like tcp://host:1883, got %q", brokerURL)
+		}
+		return dialMQTT(u.Host, "vehicle-service", os.Getenv("MQTT_USERNAME"), os.Getenv("MQTT_PASSWORD")), nil
+	}
+
+	broker := newMemoryBroker(func(username, password string) (string, bool) {
+		vehicleID, err := authenticateDevice(db, password)
+		if err != nil || strconv.Itoa(vehicleID) != username {
+			return "", false
+		}
+		return fmt.Sprintf(vehicleTopicFormat, vehicleID, ""), true
+	})
+	if addr := os.Getenv("MQTT_LISTEN_ADDR"); addr != "" {
+		if _, err := broker.Listen(addr); err != nil {
+			return nil, err
+		}
+		log.Printf("Embedded MQTT broker listening on %s", addr)
+	}
+	return broker, nil
+}
+
+// vehicleTopic returns the topic for one kind of message to or from a vehicle
+func vehicleTopic(vehicleID int, kind string) string {
+	return fmt.Sprintf(vehicleTopicFormat, vehicleID, kind)
+}
+
+// telemetryMessage is a sample published over the transport. DeviceToken is
+// required on external brokers, which do not check which vehicle is
+// publishing.
+type telemetryMessage struct {
+	TelemetrySample
+	DeviceToken string `json:"device_token"`
+}
+
+// subscribeTelemetry stores telemetry that vehicles publish over the transport
+// the same way as telemetry pushed over HTTP. Vehicles on the embedded broker
+// logged in with their device token and can only publish to their own topics;
+// on any other broker each message must carry the vehicle's device token.
+func subscribeTelemetry(db *sql.DB, transport Transport) error {
+	_, embedded := transport.(*memoryBroker)
+	return transport.Subscribe(telemetryTopicFilter, func(topic string, payload []byte) {
+		vehicleID, err := strconv.Atoi(strings.Split(topic, "/")[1])
+		if err != nil {
+			return
+		}
+
+		var message telemetryMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			log.Printf("Ignoring malformed telemetry on %s: %v", topic, err)
+			return
+		}
+
+		if embedded {
+			var active bool
+			db.QueryRow(`SELECT EXISTS(SELECT 1 FROM vehicles WHERE vehicle_id = ? AND retired_at IS NULL)`, vehicleID).Scan(&active)
+			if !active {
+				log.Printf("Ignoring telemetry on %s: no such active vehicle", topic)
+				return
+			}
+		} else {
+			deviceVehicleID, err := authenticateDevice(db, message.DeviceToken)
+			if err == sql.ErrNoRows || (err == nil && deviceVehicleID != vehicleID) {
+				log.Printf("Ignoring telemetry on %s: invalid device token", topic)
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to authenticate telemetry on %s: %v", topic, err)
+				return
+			}
+		}
+
+		err = recordTelemetry(db, vehicleID, message.TelemetrySample, time.Now())
+		var invalid telemetryError
+		if errors.As(err, &invalid) {
+			log.Printf("Ignoring invalid telemetry on %s: %v", topic, err)
+		} else if err != nil {
+			log.Printf("Failed to store telemetry from %s: %v", topic, err)
+		}
+	})
+}
+
+// publishJSON encodes message as JSON and publishes it to topic
+func publishJSON(transport Transport, topic string, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return transport.Publish(topic, payload)
+}